@@ -8,6 +8,13 @@ import (
 type EnchantedConfig struct {
 	MagicalVersion string
 	MysticalPaths  MysticalPaths
+	// LeafSession identifies a leaf across reconnects, letting the
+	// tree hand back reverse portals it held during the gap
+	LeafSession string `json:",omitempty"`
+	// Strands is the number of connections the leaf keeps to the tree,
+	// Strand the index of this connection among them
+	Strands int `json:",omitempty"`
+	Strand  int `json:",omitempty"`
 }
 
 func DecodeRemote(enchantment string) (*MysticalPath, error) {
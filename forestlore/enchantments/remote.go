@@ -2,6 +2,7 @@ package enchantments
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"net/url"
 	"regexp"
@@ -13,6 +14,9 @@ type MysticalPath struct {
 	LocalGlade, LocalPortal, LocalSpell    string
 	RemoteGlade, RemotePortal, RemoteSpell string
 	Socks, Reverse, Whisper                bool
+	Charms                                 map[string]string `json:",omitempty"`
+	Bower                                  string            `json:",omitempty"`
+	Flock                                  []string          `json:",omitempty"`
 }
 
 const reverseRune = "R:"
@@ -28,12 +32,19 @@ func (mps MysticalPaths) Reversed(reverse bool) MysticalPaths {
 }
 
 func DecodeMysticalPath(enchantment string) (*MysticalPath, error) {
+	if isMysticalURL(enchantment) {
+		return decodeMysticalURL(enchantment)
+	}
 	reversed := false
 	if strings.HasPrefix(enchantment, reverseRune) {
 		enchantment = strings.TrimPrefix(enchantment, reverseRune)
 		reversed = true
 	}
 
+	if isBowerRune(enchantment) {
+		return decodeBower(enchantment, reversed)
+	}
+
 	// Special case for socks
 	if enchantment == "socks" {
 		return &MysticalPath{
@@ -46,6 +57,7 @@ func DecodeMysticalPath(enchantment string) (*MysticalPath, error) {
 		}, nil
 	}
 
+	enchantment, extraTargets, flocked := strings.Cut(enchantment, ",")
 	magicalParts := regexp.MustCompile(`(\[[^\[\]]+\]|[^\[\]:]+):?`).FindAllStringSubmatch(enchantment, -1)
 	if len(magicalParts) <= 0 || len(magicalParts) >= 5 {
 		return nil, errors.New("Invalid mystical path")
@@ -121,12 +133,75 @@ func DecodeMysticalPath(enchantment string) (*MysticalPath, error) {
 	if mp.Whisper && mp.Reverse {
 		return nil, errors.New("whispers cannot be reversed")
 	}
+	if flocked {
+		if err := mp.gatherFlock(strings.Split(extraTargets, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if err := mp.checkPortalSpans(); err != nil {
+		return nil, err
+	}
+	if err := mp.checkFlock(); err != nil {
+		return nil, err
+	}
 	return mp, nil
 }
 
+// checkPortalSpans makes sure ranged portals line up on both sides,
+// do not span more portals than FOREST_MAX_PORTAL_SPAN (1024 unless
+// whispered otherwise) and that only the tree is asked to pick a portal
+func (mp *MysticalPath) checkPortalSpans() error {
+	if mp.RemotePortal == "0" {
+		return errors.New("a distant portal is required")
+	}
+	if mp.LocalPortal == "0" && !mp.Reverse {
+		return errors.New("only reverse paths may ask the tree to pick a portal (0)")
+	}
+	localFirst, localLast, _ := portalSpan(mp.LocalPortal)
+	if localFirst == localLast {
+		if mp.RemotePortal != "" && strings.Contains(mp.RemotePortal, "-") {
+			return errors.New("a portal range must be given on both sides")
+		}
+		return nil
+	}
+	if mp.Socks || mp.Whisper {
+		return errors.New("portal ranges are only supported for tcp and udp paths")
+	}
+	if max := WhisperEnchantedNumber("FOREST_MAX_PORTAL_SPAN", 1024); localLast-localFirst+1 > max {
+		return fmt.Errorf("portal range %s spans %d portals, more than the %d allowed", mp.LocalPortal, localLast-localFirst+1, max)
+	}
+	remoteFirst, remoteLast, _ := portalSpan(mp.RemotePortal)
+	if remoteLast-remoteFirst != localLast-localFirst {
+		return errors.New("mismatched portal ranges")
+	}
+	return nil
+}
+
 func isPortal(s string) bool {
-	n, err := strconv.Atoi(s)
-	return err == nil && n > 0 && n <= 65535
+	_, _, ok := portalSpan(s)
+	return ok
+}
+
+// portalSpan deciphers a single portal ("8000") or a portal range
+// ("8000-8010") into its first and last portal. Portal 0 asks the
+// tree to pick a free portal and cannot start a range.
+func portalSpan(s string) (first, last int, ok bool) {
+	head, tail, ranged := strings.Cut(s, "-")
+	first, err := strconv.Atoi(head)
+	if err != nil || first < 0 || first > 65535 {
+		return 0, 0, false
+	}
+	if !ranged {
+		return first, first, true
+	}
+	if first == 0 {
+		return 0, 0, false
+	}
+	last, err = strconv.Atoi(tail)
+	if err != nil || last <= first || last > 65535 {
+		return 0, 0, false
+	}
+	return first, last, true
 }
 
 func isGlade(s string) bool {
@@ -159,6 +234,9 @@ func (mp MysticalPath) String() string {
 }
 
 func (mp MysticalPath) Encode() string {
+	if len(mp.Charms) > 0 {
+		return mp.EncodeURL()
+	}
 	if mp.LocalPortal == "" {
 		mp.LocalPortal = mp.RemotePortal
 	}
@@ -177,6 +255,9 @@ func (mp MysticalPath) LocalEnchantment() string {
 	if mp.Whisper {
 		return "whisper"
 	}
+	if mp.IsBower() {
+		return mp.LocalSpell + ":" + mp.Bower
+	}
 	if mp.LocalGlade == "" {
 		mp.LocalGlade = "0.0.0.0"
 	}
@@ -187,20 +268,82 @@ func (mp MysticalPath) RemoteEnchantment() string {
 	if mp.Socks {
 		return "socks"
 	}
+	if mp.IsFlock() {
+		return strings.Join(mp.Flock, ",")
+	}
 	if mp.RemoteGlade == "" {
 		mp.RemoteGlade = "127.0.0.1"
 	}
 	return mp.RemoteGlade + ":" + mp.RemotePortal
 }
 
+// SeeksPortal reports whether the path asks the tree to pick its portal
+func (mp MysticalPath) SeeksPortal() bool {
+	return mp.Reverse && !mp.IsBower() && mp.LocalPortal == "0"
+}
+
+// PortalSpan returns the number of portals covered by the path,
+// which is 1 unless a portal range was given
+func (mp MysticalPath) PortalSpan() int {
+	first, last, ok := portalSpan(mp.LocalPortal)
+	if !ok {
+		return 1
+	}
+	return last - first + 1
+}
+
+// Unfurl expands a ranged path into one path per portal. Paths
+// without a range unfurl into themselves.
+func (mp MysticalPath) Unfurl() MysticalPaths {
+	localFirst, localLast, ok := portalSpan(mp.LocalPortal)
+	if !ok || localFirst == localLast {
+		return MysticalPaths{&mp}
+	}
+	remoteFirst, _, _ := portalSpan(mp.RemotePortal)
+	unfurled := make(MysticalPaths, 0, localLast-localFirst+1)
+	for offset := 0; localFirst+offset <= localLast; offset++ {
+		single := mp
+		single.LocalPortal = strconv.Itoa(localFirst + offset)
+		single.RemotePortal = strconv.Itoa(remoteFirst + offset)
+		unfurled = append(unfurled, &single)
+	}
+	return unfurled
+}
+
+// FaeAccesses returns the access rune of every portal covered by
+// the path, so that ranged paths are checked portal by portal
+func (mp MysticalPath) FaeAccesses() []string {
+	if mp.IsFlock() && !mp.Reverse {
+		return append([]string{}, mp.Flock...)
+	}
+	unfurled := mp.Unfurl()
+	accesses := make([]string, len(unfurled))
+	for i, single := range unfurled {
+		accesses[i] = single.FaeAccess()
+	}
+	return accesses
+}
+
 func (mp MysticalPath) FaeAccess() string {
 	if mp.Reverse {
-		return "R:" + mp.LocalGlade + ":" + mp.LocalPortal
+		return "R:" + mp.LocalEnchantment()
 	}
 	return mp.RemoteGlade + ":" + mp.RemotePortal
 }
 
 func (mp MysticalPath) CanWhisper() bool {
+	if mp.IsBower() {
+		// bowers share the tree's listener
+		return true
+	}
+	if mp.PortalSpan() > 1 {
+		for _, single := range mp.Unfurl() {
+			if !single.CanWhisper() {
+				return false
+			}
+		}
+		return true
+	}
 	switch mp.LocalSpell {
 	case "tcp":
 		conn, err := net.Listen("tcp", mp.LocalEnchantment())
@@ -0,0 +1,107 @@
+package enchantments
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Bowers are reversed paths which do not listen on a portal of their own.
+// Instead the tree routes traffic arriving on its shared listener to the
+// leaf by name, for example:
+//
+//   R:http:myapp:localhost:3000
+//
+// routes requests for myapp.<tree's bower domain> to localhost:3000 on the leaf,
+// while
+//
+//   R:sni:db.example.com:localhost:5432
+//
+// passes TLS connections for db.example.com through to localhost:5432 on the
+// leaf without the tree ever decrypting them.
+
+// bowerSpells lists the spells a bower may be woven with
+var bowerSpells = map[string]bool{
+	"http": true,
+	"sni":  true,
+}
+
+var bowerNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// isBowerRune reports whether an enchantment (without its reverse rune)
+// describes a bower, such as "http:myapp:3000"
+func isBowerRune(enchantment string) bool {
+	spell, _, found := strings.Cut(enchantment, ":")
+	return found && bowerSpells[strings.ToLower(spell)]
+}
+
+func decodeBower(enchantment string, reversed bool) (*MysticalPath, error) {
+	spell, rest, _ := strings.Cut(enchantment, ":")
+	name, target, _ := strings.Cut(rest, ":")
+	mp := &MysticalPath{
+		Reverse:     reversed,
+		LocalSpell:  strings.ToLower(spell),
+		RemoteSpell: "tcp",
+		Bower:       strings.ToLower(name),
+	}
+	if target != "" {
+		glade, portal, err := splitGladePortal(target)
+		if err != nil {
+			return nil, err
+		}
+		mp.RemoteGlade, mp.RemotePortal = glade, portal
+	}
+	return mp, mp.completeBower()
+}
+
+// completeBower applies the bower defaults and checks its name
+func (mp *MysticalPath) completeBower() error {
+	if !mp.Reverse {
+		return fmt.Errorf("%s bowers must be reversed", mp.LocalSpell)
+	}
+	if !bowerNamePattern.MatchString(mp.Bower) {
+		return fmt.Errorf("Invalid bower name '%s'", mp.Bower)
+	}
+	if mp.RemoteGlade == "" {
+		mp.RemoteGlade = "127.0.0.1"
+	}
+	if mp.RemotePortal == "" && mp.LocalSpell == "sni" {
+		mp.RemotePortal = "443"
+	} else if mp.RemotePortal == "" {
+		mp.RemotePortal = "80"
+	}
+	if strings.Contains(mp.RemotePortal, "-") {
+		return errors.New("bowers cannot lead to a portal range")
+	}
+	if mp.Charm("rate_up") != "" || mp.Charm("rate_down") != "" {
+		return errors.New("bowers are served by the tree and cannot be paced")
+	}
+	if mp.Charm("tls_serve_cert") != "" || mp.Charm("tls_serve_key") != "" {
+		return errors.New("bowers are served by the tree and cannot terminate tls")
+	}
+	if mp.LocalSpell == "sni" && (mp.hasWardCharms() || mp.Charm("basic_auth") != "" || mp.Charm("access_log") != "") {
+		return errors.New("sni bowers pass connections through untouched and take no tls or http charms")
+	}
+	if err := mp.checkGrove(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsBower reports whether the path is routed by name through the
+// tree's shared listener instead of listening on its own portal
+func (mp MysticalPath) IsBower() bool {
+	return mp.Bower != ""
+}
+
+// Bowers returns the subset of paths which are (or are not) bowers
+func (mps MysticalPaths) Bowers(bowers bool) MysticalPaths {
+	enchantedSubset := MysticalPaths{}
+	for _, path := range mps {
+		if path.IsBower() == bowers {
+			enchantedSubset = append(enchantedSubset, path)
+		}
+	}
+	return enchantedSubset
+}
@@ -0,0 +1,139 @@
+package enchantments
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Flocks are forward or reverse tcp paths leading to several targets, for
+// example:
+//
+//   5432:db1:5432,db2:5432
+//   tcp://127.0.0.1:5432?target=db1:5432,db2:5432&balance=failover&health=5s
+//
+// The dialing side spreads channels across the targets (see the balance
+// charm), checks their health every health interval (10s unless given,
+// at least 1s, 0s disables) and ejects a target after eject_after consecutive failed
+// dials (3 unless given) until it passes a health check again.
+
+// BalanceFailover always prefers the first healthy target of a flock
+const BalanceFailover = "failover"
+
+// flockCharms are the charms the dialing side of a flock needs to know
+var flockCharms = []string{"balance", "health", "eject_after"}
+
+// maxFlockTargets bounds the targets of a flock, which the dialing side
+// keeps watch over
+const maxFlockTargets = 32
+
+// isHealth accepts health intervals of at least a second, or zero to
+// leave the checks off
+func isHealth(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil || (d != 0 && d < time.Second) {
+		return errors.New("expected a duration of 1s or more, or 0s")
+	}
+	return nil
+}
+
+// gatherFlock adds the extra targets of a flock to the path, whose
+// remote glade and portal hold its first target
+func (mp *MysticalPath) gatherFlock(extra []string) error {
+	if len(extra)+1 > maxFlockTargets {
+		return fmt.Errorf("flocks lead to %d targets at most", maxFlockTargets)
+	}
+	mp.Flock = []string{mp.RemoteGlade + ":" + mp.RemotePortal}
+	for _, target := range extra {
+		glade, portal, err := splitGladePortal(target)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(portal, "-") {
+			return errors.New("targets cannot be portal ranges")
+		}
+		if glade == "" {
+			glade = "127.0.0.1"
+		}
+		mp.Flock = append(mp.Flock, glade+":"+portal)
+	}
+	return nil
+}
+
+// checkFlock checks the targets and charms of a flock
+func (mp *MysticalPath) checkFlock() error {
+	if !mp.IsFlock() {
+		if mp.Charm("health") != "" || mp.Charm("eject_after") != "" {
+			return errors.New("health and eject_after are only supported for paths with several targets")
+		}
+		return nil
+	}
+	if mp.Socks || mp.Whisper || mp.IsBower() || mp.LocalSpell != "tcp" {
+		return errors.New("only tcp paths may lead to several targets")
+	}
+	if mp.PortalSpan() > 1 {
+		return errors.New("paths with several targets cannot use portal ranges")
+	}
+	return nil
+}
+
+// IsFlock reports whether the path leads to several targets
+func (mp MysticalPath) IsFlock() bool {
+	return len(mp.Flock) > 1
+}
+
+// ChannelEnchantment returns what the listening side asks the dialing
+// side to connect to: the remote enchantment, followed by the charms the
+// dialing side needs for flocks, the priority of the channel and the
+// ward of reversed paths
+func (mp MysticalPath) ChannelEnchantment() string {
+	remote := mp.RemoteEnchantment()
+	charms := url.Values{}
+	if mp.IsFlock() {
+		for _, name := range flockCharms {
+			if value := mp.Charm(name); value != "" {
+				charms.Set(name, value)
+			}
+		}
+	}
+	if priority := mp.Charm("priority"); priority != "" {
+		charms.Set("priority", priority)
+	}
+	if mp.Reverse && mp.IsWarded() {
+		charms.Set("ward", mp.WardSigil())
+	}
+	if len(charms) == 0 {
+		return remote
+	}
+	return remote + "?" + charms.Encode()
+}
+
+// DecipherFlock splits a channel enchantment naming several targets
+// into the targets and the charms of the flock
+func DecipherFlock(enchantment string) ([]string, map[string]string, error) {
+	targets, rawCharms, _ := strings.Cut(enchantment, "?")
+	query, err := url.ParseQuery(rawCharms)
+	if err != nil {
+		return nil, nil, err
+	}
+	if strings.Count(targets, ",")+1 > maxFlockTargets {
+		return nil, nil, fmt.Errorf("flocks lead to %d targets at most", maxFlockTargets)
+	}
+	charms := map[string]string{}
+	for _, name := range flockCharms {
+		if value := query.Get(name); value != "" {
+			if err := charmRunes[name](value); err != nil {
+				return nil, nil, err
+			}
+			charms[name] = value
+		}
+	}
+	return strings.Split(targets, ","), charms, nil
+}
+
+// IsFlockEnchantment reports whether a channel enchantment names a flock
+func IsFlockEnchantment(enchantment string) bool {
+	return strings.ContainsAny(enchantment, ",?")
+}
@@ -0,0 +1,69 @@
+package enchantments
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Groves let several leaves serve the same reverse path. Every leaf weaves
+// the path with the same group charm, for example:
+//
+//   tcp://0.0.0.0:8080?via=local&target=localhost:8080&group=web&balance=least-conn
+//
+// and the tree keeps a single listener, spreading the connections it accepts
+// across the leaves of the grove.
+
+const (
+	BalanceRoundRobin = "round-robin"
+	BalanceLeastConn  = "least-conn"
+)
+
+func isBalance(s string) error {
+	if s != BalanceRoundRobin && s != BalanceLeastConn && s != BalanceFailover {
+		return fmt.Errorf("expected %s, %s or %s", BalanceRoundRobin, BalanceLeastConn, BalanceFailover)
+	}
+	return nil
+}
+
+func isGroveName(s string) error {
+	if !bowerNamePattern.MatchString(s) {
+		return errors.New("expected a lowercase name")
+	}
+	return nil
+}
+
+// checkGrove checks the group and balance charms of the path
+func (mp *MysticalPath) checkGrove() error {
+	if mp.Charm("balance") != "" && !mp.IsGrouped() && !mp.IsFlock() {
+		return errors.New("balance is only supported for grouped paths and paths with several targets")
+	}
+	if mp.Charm("group") == "" {
+		return nil
+	}
+	if mp.Charm("balance") == BalanceFailover {
+		return errors.New("groups balance round-robin or least-conn")
+	}
+	if !mp.Reverse || mp.Whisper || mp.IsBower() {
+		return errors.New("only reverse tcp, udp and socks paths may be grouped")
+	}
+	if mp.LocalPortal == "0" {
+		return errors.New("grouped paths must name their portal")
+	}
+	return nil
+}
+
+// IsGrouped reports whether the path is served by a grove of leaves
+func (mp MysticalPath) IsGrouped() bool {
+	return mp.Charm("group") != ""
+}
+
+// Grouped returns the subset of paths which are (or are not) grouped
+func (mps MysticalPaths) Grouped(grouped bool) MysticalPaths {
+	enchantedSubset := MysticalPaths{}
+	for _, path := range mps {
+		if path.IsGrouped() == grouped {
+			enchantedSubset = append(enchantedSubset, path)
+		}
+	}
+	return enchantedSubset
+}
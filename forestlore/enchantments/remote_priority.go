@@ -0,0 +1,74 @@
+package enchantments
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+)
+
+// Channels sharing one connection take turns writing to it. The priority
+// charm puts the channels of a path into a class, for example:
+//
+//   tcp://127.0.0.1:2222?target=bastion:22&priority=interactive
+//   tcp://127.0.0.1:8873?target=backup:873&priority=bulk
+//
+// Interactive channels write first, so keystrokes are not held up by
+// transfers. Both sides of the channel honour the charm.
+
+const (
+	PriorityInteractive = "interactive"
+	PriorityNormal      = "normal"
+	PriorityBulk        = "bulk"
+)
+
+var priorityClasses = map[string]int{
+	PriorityInteractive: faeio.PriorityInteractive,
+	PriorityNormal:      faeio.PriorityNormal,
+	PriorityBulk:        faeio.PriorityBulk,
+}
+
+func isPriority(s string) error {
+	if _, ok := priorityClasses[s]; !ok {
+		return fmt.Errorf("expected %s, %s or %s", PriorityInteractive, PriorityNormal, PriorityBulk)
+	}
+	return nil
+}
+
+// PriorityClass returns the procession class of a priority charm,
+// normal when unset or unknown
+func PriorityClass(priority string) int {
+	if class, ok := priorityClasses[priority]; ok {
+		return class
+	}
+	return faeio.PriorityNormal
+}
+
+// ChannelPriority splits the priority charm off a channel enchantment,
+// returning the enchantment without it
+func ChannelPriority(enchantment string) (string, string) {
+	return channelCharm(enchantment, "priority")
+}
+
+// channelCharm splits the charm of the name off a channel enchantment,
+// returning the enchantment without it
+func channelCharm(enchantment, name string) (string, string) {
+	target, rawCharms, found := strings.Cut(enchantment, "?")
+	if !found {
+		return enchantment, ""
+	}
+	query, err := url.ParseQuery(rawCharms)
+	if err != nil {
+		return enchantment, ""
+	}
+	value := query.Get(name)
+	if value == "" {
+		return enchantment, ""
+	}
+	query.Del(name)
+	if len(query) == 0 {
+		return target, value
+	}
+	return target + "?" + query.Encode(), value
+}
@@ -0,0 +1,86 @@
+package enchantments
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+)
+
+// Paths may be held to a rate with the rate_up and rate_down charms, for
+// example:
+//
+//   socks://127.0.0.1:1080?rate_down=2MB&rate_up=512KB
+//
+// rate_up paces the fairy dust flowing from the listener towards the
+// target and rate_down the fairy dust flowing back, shared by every
+// channel of the path. The listening side paces the path.
+
+// DecipherRate decodes a rate such as 512KB, 2MB or 10mbit into bytes
+// per second. A bare number is in bytes per second.
+func DecipherRate(s string) (int64, error) {
+	bytes, ok := faeio.DecipherBytes(s)
+	if !ok {
+		return 0, fmt.Errorf("Invalid rate '%s' (expected e.g. 512KB, 2MB or 10mbit)", s)
+	}
+	return bytes, nil
+}
+
+// DecipherSize decodes a size such as 512MB or 10GB into bytes, in the
+// same units as a rate
+func DecipherSize(s string) (int64, error) {
+	bytes, ok := faeio.DecipherBytes(s)
+	if !ok {
+		return 0, fmt.Errorf("Invalid size '%s' (expected e.g. 512MB or 10GB)", s)
+	}
+	return bytes, nil
+}
+
+func isRate(s string) error {
+	if _, err := DecipherRate(s); err != nil {
+		return errors.New("expected a rate such as 512KB, 2MB or 10mbit")
+	}
+	return nil
+}
+
+// CharmRate returns the named charm as a rate in bytes per second,
+// or zero when unset
+func (mp MysticalPath) CharmRate(name string) int64 {
+	rate, _ := DecipherRate(mp.Charms[name])
+	return rate
+}
+
+// DecipherCadence decodes a cadence such as 10/s, 100/1m or 5/500ms into
+// a count and the span of time it is allowed per
+func DecipherCadence(s string) (int, time.Duration, error) {
+	count, span, ok := strings.Cut(strings.TrimSpace(s), "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("Invalid cadence '%s' (expected e.g. 10/s or 100/1m)", s)
+	}
+	per, err := time.ParseDuration(span)
+	if err != nil {
+		per, err = time.ParseDuration("1" + span)
+	}
+	if err != nil || per <= 0 {
+		return 0, 0, fmt.Errorf("Invalid cadence '%s' (expected e.g. 10/s or 100/1m)", s)
+	}
+	return n, per, nil
+}
+
+func isCadence(s string) error {
+	if _, _, err := DecipherCadence(s); err != nil {
+		return errors.New("expected a cadence such as 10/s or 100/1m")
+	}
+	return nil
+}
+
+// CharmCadence returns the named charm as a count per span of time,
+// or zeros when unset
+func (mp MysticalPath) CharmCadence(name string) (int, time.Duration) {
+	count, per, _ := DecipherCadence(mp.Charms[name])
+	return count, per
+}
@@ -0,0 +1,356 @@
+package enchantments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mystical paths may also be written as URLs, which avoids the positional
+// ambiguity of the colon syntax and gives each path a place for charms:
+//
+//   tcp://127.0.0.1:5432?via=remote&target=db.internal:5432&idle=5m&max_conns=20
+//
+// The URL host is where the path listens, target is where it leads and via
+// names the side which reaches the target (remote for a normal path, local
+// for a reversed one).
+
+const (
+	viaRemote = "remote"
+	viaLocal  = "local"
+)
+
+// charmRunes validates the charms (per-path options) understood by the forest
+var charmRunes = map[string]func(string) error{
+	"idle":            isTimespell,
+	"max_conns":       isCount,
+	"conn_rate":       isCadence,
+	"lifetime":        isTimespell,
+	"tls":             isTruth,
+	"tls_sni":         isRune,
+	"tls_ca":          isRune,
+	"tls_cert":        isRune,
+	"tls_key":         isRune,
+	"tls_skip_verify": isTruth,
+	"tls_serve_cert":  isRune,
+	"tls_serve_key":   isRune,
+	"basic_auth":      isFaeWhisper,
+	"access_log":      isTruth,
+	"health":          isHealth,
+	"eject_after":     isCount,
+	"group":           isGroveName,
+	"balance":         isBalance,
+	"priority":        isPriority,
+	"rate_up":         isRate,
+	"rate_down":       isRate,
+}
+
+// isTimespell accepts durations of zero or more, zero leaving the
+// charm's limit off
+func isTimespell(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return errors.New("expected a duration of zero or more")
+	}
+	return nil
+}
+
+// isCount accepts counts of zero or more, zero leaving the charm's
+// limit off
+func isCount(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return errors.New("expected a number of zero or more")
+	}
+	return nil
+}
+
+func isTruth(s string) error {
+	if _, err := strconv.ParseBool(s); err != nil {
+		return errors.New("expected true or false")
+	}
+	return nil
+}
+
+func isRune(s string) error {
+	if s == "" {
+		return errors.New("expected a value")
+	}
+	return nil
+}
+
+func isFaeWhisper(s string) error {
+	if name, _ := DecipherFaeWhisper(s); name == "" {
+		return errors.New("expected user:pass")
+	}
+	return nil
+}
+
+func isMysticalURL(enchantment string) bool {
+	return strings.Contains(enchantment, "://")
+}
+
+func decodeMysticalURL(enchantment string) (*MysticalPath, error) {
+	spell, rest, _ := strings.Cut(enchantment, "://")
+	authority, rawQuery, _ := strings.Cut(rest, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mystical path charms: %s", err)
+	}
+	mp := &MysticalPath{}
+	if bowerSpells[strings.ToLower(spell)] {
+		return decodeBowerURL(mp, strings.ToLower(spell), authority, query)
+	}
+	switch strings.ToLower(spell) {
+	case "tcp", "udp":
+		mp.LocalSpell = strings.ToLower(spell)
+	case "socks":
+		mp.LocalSpell = "tcp"
+		mp.Socks = true
+	case "whisper", "stdio":
+		mp.LocalSpell = "tcp"
+		mp.Whisper = true
+	default:
+		return nil, fmt.Errorf("Unknown mystical spell '%s'", spell)
+	}
+	mp.RemoteSpell = mp.LocalSpell
+	switch via := query.Get("via"); via {
+	case "", viaRemote:
+	case viaLocal:
+		mp.Reverse = true
+	default:
+		return nil, fmt.Errorf("Invalid via '%s' (expected %s or %s)", via, viaRemote, viaLocal)
+	}
+	query.Del("via")
+	if mp.Whisper {
+		if authority != "" {
+			return nil, errors.New("whispers do not listen on a glade")
+		}
+	} else if authority != "" {
+		if mp.LocalGlade, mp.LocalPortal, err = splitGladePortal(authority); err != nil {
+			return nil, err
+		}
+	}
+	target, extraTargets, flocked := strings.Cut(query.Get("target"), ",")
+	if target != "" {
+		if mp.Socks {
+			return nil, errors.New("socks paths do not take a target")
+		}
+		if mp.RemoteGlade, mp.RemotePortal, err = splitGladePortal(target); err != nil {
+			return nil, err
+		}
+	}
+	query.Del("target")
+	if err := mp.gatherCharms(query); err != nil {
+		return nil, err
+	}
+	// Apply default enchantments
+	if mp.Socks {
+		if mp.LocalGlade == "" {
+			mp.LocalGlade = "127.0.0.1"
+		}
+		if mp.LocalPortal == "" {
+			mp.LocalPortal = "1080"
+		}
+	} else {
+		if mp.LocalGlade == "" {
+			mp.LocalGlade = "0.0.0.0"
+		}
+		if mp.RemoteGlade == "" {
+			mp.RemoteGlade = "127.0.0.1"
+		}
+		if mp.RemotePortal == "" {
+			mp.RemotePortal = mp.LocalPortal
+		}
+		if mp.LocalPortal == "" {
+			mp.LocalPortal = mp.RemotePortal
+		}
+		if mp.RemotePortal == "" {
+			return nil, errors.New("Missing mystical portals")
+		}
+	}
+	if mp.Whisper && mp.Reverse {
+		return nil, errors.New("whispers cannot be reversed")
+	}
+	if mp.Charm("basic_auth") != "" || mp.Charm("access_log") != "" {
+		return nil, errors.New("basic_auth and access_log are only supported for http bowers")
+	}
+	if mp.hasWardCharms() && (mp.Socks || mp.LocalSpell == "udp") {
+		return nil, errors.New("tls charms are only supported for tcp paths")
+	}
+	if flocked {
+		if err := mp.gatherFlock(strings.Split(extraTargets, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if err := mp.checkPortalSpans(); err != nil {
+		return nil, err
+	}
+	if err := mp.checkFlock(); err != nil {
+		return nil, err
+	}
+	if err := mp.checkGrove(); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+func decodeBowerURL(mp *MysticalPath, spell, authority string, query url.Values) (*MysticalPath, error) {
+	mp.LocalSpell = spell
+	mp.RemoteSpell = "tcp"
+	mp.Bower = strings.ToLower(authority)
+	mp.Reverse = query.Get("via") == viaLocal
+	query.Del("via")
+	if target := query.Get("target"); target != "" {
+		glade, portal, err := splitGladePortal(target)
+		if err != nil {
+			return nil, err
+		}
+		mp.RemoteGlade, mp.RemotePortal = glade, portal
+	}
+	query.Del("target")
+	if err := mp.gatherCharms(query); err != nil {
+		return nil, err
+	}
+	if err := mp.completeBower(); err != nil {
+		return nil, err
+	}
+	return mp, nil
+}
+
+// gatherCharms validates the remaining query charms and stores them on the path
+func (mp *MysticalPath) gatherCharms(query url.Values) error {
+	for name, values := range query {
+		validate, known := charmRunes[name]
+		if !known {
+			return fmt.Errorf("Unknown charm '%s'", name)
+		}
+		if err := validate(values[0]); err != nil {
+			return fmt.Errorf("Invalid charm '%s': %s", name, err)
+		}
+		if mp.Charms == nil {
+			mp.Charms = map[string]string{}
+		}
+		mp.Charms[name] = values[0]
+	}
+	return nil
+}
+
+// splitGladePortal splits "glade:portal", keeping brackets around
+// IPv6 glades so they can be joined back together with a colon
+func splitGladePortal(s string) (glade, portal string, err error) {
+	glade, portal, err = net.SplitHostPort(s)
+	if err != nil {
+		if !isPortal(s) {
+			return "", "", fmt.Errorf("Invalid enchanted glade '%s'", s)
+		}
+		glade, portal = "", s
+	}
+	if !isPortal(portal) {
+		return "", "", fmt.Errorf("Invalid mystical portal '%s'", portal)
+	}
+	if strings.Contains(glade, ":") {
+		glade = "[" + glade + "]"
+	}
+	return glade, portal, nil
+}
+
+// EncodeURL inscribes the path in the URL syntax, which is the only
+// syntax able to carry charms
+func (mp MysticalPath) EncodeURL() string {
+	sb := strings.Builder{}
+	switch {
+	case mp.Socks:
+		sb.WriteString("socks://")
+	case mp.Whisper:
+		sb.WriteString("whisper://")
+	case mp.IsBower():
+		sb.WriteString(mp.LocalSpell + "://" + mp.Bower)
+	default:
+		sb.WriteString(mp.LocalSpell + "://")
+	}
+	if !mp.Whisper && !mp.IsBower() {
+		if mp.LocalPortal == "" {
+			mp.LocalPortal = mp.RemotePortal
+		}
+		sb.WriteString(mp.LocalEnchantment())
+	}
+	charms := []string{}
+	if !mp.Socks {
+		charms = append(charms, "target="+escapeCharm(mp.RemoteEnchantment()))
+	}
+	if mp.Reverse {
+		charms = append(charms, "via="+viaLocal)
+	}
+	names := make([]string, 0, len(mp.Charms))
+	for name := range mp.Charms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		charms = append(charms, url.QueryEscape(name)+"="+escapeCharm(mp.Charms[name]))
+	}
+	if len(charms) > 0 {
+		sb.WriteString("?" + strings.Join(charms, "&"))
+	}
+	return sb.String()
+}
+
+func escapeCharm(s string) string {
+	return strings.NewReplacer("%3A", ":", "%2F", "/", "%5B", "[", "%5D", "]", "%2C", ",").Replace(url.QueryEscape(s))
+}
+
+// Charm returns the raw value of the named charm, or an empty string
+func (mp MysticalPath) Charm(name string) string {
+	return mp.Charms[name]
+}
+
+// CharmTimespell returns the named charm as a duration, or zero when unset
+func (mp MysticalPath) CharmTimespell(name string) time.Duration {
+	d, _ := time.ParseDuration(mp.Charms[name])
+	return d
+}
+
+// CharmNumber returns the named charm as a number, or zero when unset
+func (mp MysticalPath) CharmNumber(name string) int {
+	n, _ := strconv.Atoi(mp.Charms[name])
+	return n
+}
+
+// CharmTruth returns the named charm as a boolean, or false when unset
+func (mp MysticalPath) CharmTruth(name string) bool {
+	b, _ := strconv.ParseBool(mp.Charms[name])
+	return b
+}
+
+func (mp MysticalPath) hasWardCharms() bool {
+	for name := range mp.Charms {
+		if strings.HasPrefix(name, "tls") {
+			return true
+		}
+	}
+	return false
+}
+
+// UnmarshalJSON accepts either an inscribed path string (in the colon
+// or URL syntax) or the full path object, so magical scrolls may list
+// paths the same way they are given on the command line
+func (mp *MysticalPath) UnmarshalJSON(fairyDust []byte) error {
+	var enchantment string
+	if err := json.Unmarshal(fairyDust, &enchantment); err == nil {
+		decoded, err := DecodeMysticalPath(enchantment)
+		if err != nil {
+			return err
+		}
+		*mp = *decoded
+		return nil
+	}
+	type rawMysticalPath MysticalPath
+	return json.Unmarshal(fairyDust, (*rawMysticalPath)(mp))
+}
@@ -0,0 +1,38 @@
+package enchantments
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The leaf casts the TLS charms of reversed paths on the channels the
+// tree opens towards their targets. Paths may share a target while
+// warding it differently, so the channels carry the ward sigil of the
+// path they belong to, which the leaf finds the wards by.
+
+var wardCharms = []string{"tls", "tls_sni", "tls_ca", "tls_cert", "tls_key", "tls_skip_verify", "tls_serve_cert", "tls_serve_key"}
+
+// IsWarded reports whether the path carries TLS charms
+func (mp MysticalPath) IsWarded() bool {
+	for _, name := range wardCharms {
+		if mp.Charm(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// WardSigil returns a digest of the path's encoding, bar the listening
+// side which the tree may grant anew, telling its wards apart from those
+// of other paths
+func (mp MysticalPath) WardSigil() string {
+	mp.LocalGlade, mp.LocalPortal, mp.Bower = "", "", ""
+	sum := sha256.Sum256([]byte(mp.EncodeURL()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ChannelWard splits the ward sigil off a channel enchantment,
+// returning the enchantment without it
+func ChannelWard(enchantment string) (string, string) {
+	return channelCharm(enchantment, "ward")
+}
@@ -0,0 +1,55 @@
+package enchantments
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchScroll calls changed whenever the scroll changes: written in
+// place, replaced by a rename (as editors save) or swapped behind a
+// symlink (as Kubernetes updates a mounted ConfigMap), once the writes
+// and renames of a save settled. The scroll's glade is watched rather
+// than the scroll, whose watch would be lost with it on a rename, along
+// with the glade of its target. Closing the watcher stops the watch.
+func WatchScroll(enchantedScroll string, changed func()) (*fsnotify.Watcher, error) {
+	magicalEye, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	scroll := filepath.Clean(enchantedScroll)
+	target := func() string {
+		t, err := filepath.EvalSymlinks(scroll)
+		if err != nil {
+			return scroll
+		}
+		return t
+	}
+	watched := target()
+	for _, glade := range []string{filepath.Dir(scroll), filepath.Dir(watched)} {
+		if err := magicalEye.Add(glade); err != nil {
+			magicalEye.Close()
+			return nil, err
+		}
+	}
+	settled := time.AfterFunc(time.Hour, changed)
+	settled.Stop()
+	go func() {
+		for magicalEvent := range magicalEye.Events {
+			name := filepath.Clean(magicalEvent.Name)
+			if magicalEvent.Op == fsnotify.Chmod ||
+				name != scroll && name != watched && !strings.HasPrefix(filepath.Base(name), "..") {
+				continue
+			}
+			if t := target(); t != watched {
+				magicalEye.Add(filepath.Dir(t))
+				watched = t
+			}
+			settled.Reset(100 * time.Millisecond)
+		}
+		settled.Stop()
+	}()
+	return magicalEye, nil
+}
@@ -21,6 +21,19 @@ type Fae struct {
 	EnchantedGlades []*regexp.Regexp
 }
 
+// sameAs reports whether the fae has the same rune and glades as other
+func (f *Fae) sameAs(other *Fae) bool {
+	if f.SecretRune != other.SecretRune || len(f.EnchantedGlades) != len(other.EnchantedGlades) {
+		return false
+	}
+	for i, glade := range f.EnchantedGlades {
+		if glade.String() != other.EnchantedGlades[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
 func (f *Fae) HasAccess(magicalGlade string) bool {
 	hasPermission := false
 	for _, enchantedPath := range f.EnchantedGlades {
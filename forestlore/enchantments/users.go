@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/Er0sSec/Engrave/forestlore/faeio"
@@ -65,6 +68,12 @@ type FaeIndex struct {
 	*faeio.Whisperer
 	*FaeGathering
 	enchantedScroll string
+	// scrollMut guards the scroll, its watcher, its fae and the
+	// steadfast ones
+	scrollMut  sync.Mutex
+	magicalEye *fsnotify.Watcher
+	scrolled   []*Fae
+	steadfast  []*Fae
 }
 
 func SummonFaeIndex(whisperer *faeio.Whisperer) *FaeIndex {
@@ -75,58 +84,152 @@ func SummonFaeIndex(whisperer *faeio.Whisperer) *FaeIndex {
 }
 
 func (fi *FaeIndex) InvokeFaeFromScroll(enchantedScroll string) error {
-	fi.enchantedScroll = enchantedScroll
 	fi.Infof("Deciphering magical scroll %s", enchantedScroll)
-	if err := fi.readFaeScroll(); err != nil {
-		return err
-	}
-	if err := fi.watchForMagicalChanges(); err != nil {
-		return err
-	}
-	return nil
+	_, err := fi.Reinterpret(enchantedScroll)
+	return err
 }
 
-func (fi *FaeIndex) watchForMagicalChanges() error {
-	magicalEye, err := fsnotify.NewWatcher()
+// KeepFae welcomes the fae, which stay through every reinterpretation
+// of the scroll (as those of --auth do), in place of those kept before,
+// and returns how the fae changed
+func (fi *FaeIndex) KeepFae(faes ...*Fae) FaeChanges {
+	fi.scrollMut.Lock()
+	defer fi.scrollMut.Unlock()
+	fi.steadfast = faes
+	return fi.reshapeCircle(fi.scrolled)
+}
+
+// Reinterpret reads the scroll anew, watching it from then on instead
+// of the one watched before (none if empty), and returns how the fae
+// changed. The circle is left as it was when the scroll is unreadable.
+func (fi *FaeIndex) Reinterpret(enchantedScroll string) (FaeChanges, error) {
+	fi.scrollMut.Lock()
+	defer fi.scrollMut.Unlock()
+	if enchantedScroll == "" {
+		fi.enchantedScroll = ""
+		if fi.magicalEye != nil {
+			fi.magicalEye.Close()
+			fi.magicalEye = nil
+		}
+		return fi.reshapeCircle(nil), nil
+	}
+	faes, err := DecipherFaeScroll(enchantedScroll)
 	if err != nil {
-		return err
+		return FaeChanges{}, err
 	}
-	if err := magicalEye.Add(fi.enchantedScroll); err != nil {
-		return err
+	if enchantedScroll != fi.enchantedScroll || fi.magicalEye == nil {
+		eye, err := fi.watchForMagicalChanges(enchantedScroll)
+		if err != nil {
+			return FaeChanges{}, err
+		}
+		if fi.magicalEye != nil {
+			fi.magicalEye.Close()
+		}
+		fi.enchantedScroll, fi.magicalEye = enchantedScroll, eye
 	}
-	go func() {
-		for magicalEvent := range magicalEye.Events {
-			if magicalEvent.Op&fsnotify.Write != fsnotify.Write {
-				continue
-			}
-			if err := fi.readFaeScroll(); err != nil {
-				fi.Infof("Failed to reinterpret the fae scroll: %s", err)
-			} else {
-				fi.Debugf("Fae scroll successfully reinterpreted from: %s", fi.enchantedScroll)
-			}
+	return fi.reshapeCircle(faes), nil
+}
+
+// watchForMagicalChanges reinterprets the scroll whenever it changes
+// (see WatchScroll)
+func (fi *FaeIndex) watchForMagicalChanges(enchantedScroll string) (*fsnotify.Watcher, error) {
+	var magicalEye *fsnotify.Watcher
+	magicalEye, err := WatchScroll(enchantedScroll, func() {
+		fi.scrollMut.Lock()
+		defer fi.scrollMut.Unlock()
+		if fi.magicalEye != magicalEye {
+			return // no longer watched
+		}
+		faes, err := DecipherFaeScroll(enchantedScroll)
+		if err != nil {
+			fi.Cryf("Failed to reinterpret the fae scroll: %s", err)
+			return
+		}
+		if changes := fi.reshapeCircle(faes); !changes.None() {
+			fi.Infof("Fae scroll %s reinterpreted: %s", filepath.Clean(enchantedScroll), changes)
+		}
+	})
+	return magicalEye, err
+}
+
+// reshapeCircle replaces the fae with those of the scroll, along with
+// the steadfast ones, returning how they changed. Held with scrollMut.
+func (fi *FaeIndex) reshapeCircle(scrolled []*Fae) FaeChanges {
+	fi.scrolled = scrolled
+	faes := append(append([]*Fae{}, scrolled...), fi.steadfast...)
+	fi.RLock()
+	before := fi.enchantedCircle
+	fi.RUnlock()
+	changes := FaeChanges{}
+	after := map[string]bool{}
+	for _, f := range faes {
+		after[f.TrueName] = true
+		if was, ok := before[f.TrueName]; !ok {
+			changes.Welcomed = append(changes.Welcomed, f.TrueName)
+		} else if !was.sameAs(f) {
+			changes.Reshaped = append(changes.Reshaped, f.TrueName)
 		}
-	}()
-	return nil
+	}
+	for name := range before {
+		if !after[name] {
+			changes.Banished = append(changes.Banished, name)
+		}
+	}
+	sort.Strings(changes.Welcomed)
+	sort.Strings(changes.Banished)
+	sort.Strings(changes.Reshaped)
+	fi.ReshapeCircle(faes)
+	return changes
+}
+
+// FaeChanges lists the fae welcomed, banished and reshaped (given
+// another rune or glades) by reinterpreting a scroll
+type FaeChanges struct {
+	Welcomed, Banished, Reshaped []string
 }
 
-func (fi *FaeIndex) readFaeScroll() error {
-	if fi.enchantedScroll == "" {
-		return errors.New("magical scroll not specified")
+// None reports whether nothing changed
+func (c FaeChanges) None() bool {
+	return len(c.Welcomed) == 0 && len(c.Banished) == 0 && len(c.Reshaped) == 0
+}
+
+// String describes the changes, such as "+alice -bob ~carol"
+func (c FaeChanges) String() string {
+	if c.None() {
+		return "unchanged"
+	}
+	s := []string{}
+	for _, n := range c.Welcomed {
+		s = append(s, "+"+n)
+	}
+	for _, n := range c.Banished {
+		s = append(s, "-"+n)
+	}
+	for _, n := range c.Reshaped {
+		s = append(s, "~"+n)
 	}
-	magicalInk, err := os.ReadFile(fi.enchantedScroll)
+	return strings.Join(s, " ")
+}
+
+// DecipherFaeScroll reads the fae of a scroll (an authfile)
+func DecipherFaeScroll(enchantedScroll string) ([]*Fae, error) {
+	if enchantedScroll == "" {
+		return nil, errors.New("magical scroll not specified")
+	}
+	magicalInk, err := os.ReadFile(enchantedScroll)
 	if err != nil {
-		return fmt.Errorf("Failed to read magical scroll: %s, error: %s", fi.enchantedScroll, err)
+		return nil, fmt.Errorf("Failed to read magical scroll: %s, error: %s", enchantedScroll, err)
 	}
 	var rawMagic map[string][]string
 	if err := json.Unmarshal(magicalInk, &rawMagic); err != nil {
-		return errors.New("Invalid magical runes: " + err.Error())
+		return nil, errors.New("Invalid magical runes: " + err.Error())
 	}
 	faes := []*Fae{}
 	for magicalWhisper, enchantedGlades := range rawMagic {
 		fae := &Fae{}
 		fae.TrueName, fae.SecretRune = DecipherFaeWhisper(magicalWhisper)
 		if fae.TrueName == "" {
-			return errors.New("Invalid fae:rune whisper")
+			return nil, errors.New("Invalid fae:rune whisper")
 		}
 		for _, glade := range enchantedGlades {
 			if glade == "" || glade == "*" {
@@ -134,13 +237,12 @@ func (fi *FaeIndex) readFaeScroll() error {
 			} else {
 				magicalPath, err := regexp.Compile(glade)
 				if err != nil {
-					return errors.New("Invalid glade magic")
+					return nil, errors.New("Invalid glade magic")
 				}
 				fae.EnchantedGlades = append(fae.EnchantedGlades, magicalPath)
 			}
 		}
 		faes = append(faes, fae)
 	}
-	fi.ReshapeCircle(faes)
-	return nil
+	return faes, nil
 }
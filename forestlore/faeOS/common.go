@@ -1,12 +1,25 @@
 package faeOS
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"syscall"
 	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
 )
 
+// crier whispers the failures of the process at the error level
+var crier = faeio.NewWhisperer("")
+
 // WhisperInterruptContext returns a magical realm which fades
 // when the ancient tree is disturbed
 func WhisperInterruptContext() context.Context {
@@ -21,8 +34,95 @@ func WhisperInterruptContext() context.Context {
 	return enchantedRealm
 }
 
+// WhisperDrainContexts returns two magical realms for a graceful
+// withering: drain fades when the ancient tree is first disturbed
+// (SIGINT or SIGTERM), or once handedOff is closed, and halt on the
+// next disturbance. Without grace both fade at once, but for a handoff,
+// after which the old tree always drains.
+func WhisperDrainContexts(grace bool, handedOff <-chan struct{}) (drain, halt context.Context) {
+	drain, beginDrain := context.WithCancel(context.Background())
+	halt, dispelMagic := context.WithCancel(context.Background())
+	go func() {
+		faerieSignal := make(chan os.Signal, 2)
+		signal.Notify(faerieSignal, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(faerieSignal)
+		heard := "the handoff"
+		select {
+		case sig := <-faerieSignal:
+			heard = sig.String()
+			// an heir took over the service otherwise
+			Notify("STOPPING=1")
+		case <-handedOff:
+			bequeathed.Store(true)
+		}
+		beginDrain()
+		if grace || bequeathed.Load() {
+			log.Printf("🍂 After %s, draining (signal again to wither at once)", heard)
+			<-faerieSignal
+		}
+		dispelMagic()
+	}()
+	return drain, halt
+}
+
 // SlumberUntilWhisper puts the forest to sleep for the given duration,
 // or until a magical SIGHUP whisper is heard
 func SlumberUntilWhisper(dreamDuration time.Duration) {
 	<-AfterMoonlight(dreamDuration)
 }
+
+// ForestState is a snapshot of the tunnels of the process, which
+// people read as described and tooling as JSON
+type ForestState interface {
+	Describe(w io.Writer)
+}
+
+// dumpForestState prints the state to the enchanted log and inscribes
+// it as JSON in ENGRAVE_STATE_DUMP, or else in a new scroll named
+// engrave-state-<pid>-*.json in the temporary glade. The scroll is
+// written apart and moved into place, so no scroll planted there, or
+// followed there, is written through.
+func dumpForestState(state ForestState) {
+	var described bytes.Buffer
+	state.Describe(&described)
+	log.Printf("🧚 Forest state:\n%s", described.String())
+	scroll, err := inscribeForestState(state, enchantments.WhisperEnchantment("STATE_DUMP"))
+	if err != nil {
+		crier.Cryf("🍄 Failed to dump the forest state: %s", err)
+		return
+	}
+	log.Printf("🧚 Forest state dumped to %s", scroll)
+}
+
+// inscribeForestState writes the state to a fresh scroll beside the
+// given one, and moves it over the given one unless there is none,
+// returning the scroll written
+func inscribeForestState(state ForestState, scroll string) (string, error) {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	glade, pattern := os.TempDir(), fmt.Sprintf("engrave-state-%d-*.json", os.Getpid())
+	if scroll != "" {
+		glade, pattern = filepath.Dir(scroll), "."+filepath.Base(scroll)+".*"
+	}
+	f, err := os.CreateTemp(glade, pattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && scroll != "" {
+		err = os.Rename(f.Name(), scroll)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if scroll == "" {
+		scroll = f.Name()
+	}
+	return scroll, nil
+}
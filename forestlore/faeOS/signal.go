@@ -14,20 +14,51 @@ import (
 	"github.com/jpillora/sizestr"
 )
 
-// WhisperFaerieStats prints magical statistics to
-// the enchanted log when the forest whispers SIGUSR2 (posix-only)
-func WhisperFaerieStats() {
-	// silence the grumbling from the windows realm
-	const FAERIE_WHISPER = syscall.Signal(0x1f)
+// WhisperFaerieStats prints magical statistics to the enchanted log
+// when the forest whispers SIGUSR2 (posix-only), along with the state
+// revealed, which is also dumped as JSON (see ENGRAVE_STATE_DUMP)
+func WhisperFaerieStats(reveal func() ForestState) {
 	time.Sleep(time.Second)
 	faerieSignal := make(chan os.Signal, 1)
-	signal.Notify(faerieSignal, FAERIE_WHISPER)
+	signal.Notify(faerieSignal, syscall.SIGUSR2)
 	for range faerieSignal {
 		enchantedStats := runtime.MemStats{}
 		runtime.ReadMemStats(&enchantedStats)
 		log.Printf("🧚 Heard a faerie whisper (SIGUSR2), active forest spirits: %d, magical essence consumed: %s",
 			runtime.NumGoroutine(),
 			sizestr.ToString(int64(enchantedStats.Alloc)))
+		if reveal != nil {
+			dumpForestState(reveal())
+		}
+	}
+}
+
+// WhisperHandoff calls handoff when the forest whispers SIGUSR1
+// (posix-only), again on every whisper until it succeeds
+func WhisperHandoff(handoff func() error) {
+	faerieSignal := make(chan os.Signal, 1)
+	signal.Notify(faerieSignal, syscall.SIGUSR1)
+	defer signal.Stop(faerieSignal)
+	for range faerieSignal {
+		log.Printf("🌱 Heard a faerie whisper (SIGUSR1), handing the listeners to an heir")
+		if err := handoff(); err != nil {
+			crier.Cryf("🍄 Handoff failed: %s", err)
+			continue
+		}
+		return
+	}
+}
+
+// WhisperReload calls reload whenever the forest whispers SIGHUP
+// (posix-only)
+func WhisperReload(reload func() error) {
+	faerieSignal := make(chan os.Signal, 1)
+	signal.Notify(faerieSignal, syscall.SIGHUP)
+	for range faerieSignal {
+		log.Printf("🌱 Heard a faerie whisper (SIGHUP), reloading")
+		if err := reload(); err != nil {
+			crier.Cryf("🍄 Reload failed, nothing changed: %s", err)
+		}
 	}
 }
 
@@ -8,7 +8,19 @@ import (
 )
 
 // WhisperFaerieStats remains silent in the Windows realm
-func WhisperFaerieStats() {
+func WhisperFaerieStats(reveal func() ForestState) {
+	// The faeries are sleeping in this realm
+}
+
+// WhisperHandoff remains silent in the Windows realm, where
+// listeners cannot be handed down
+func WhisperHandoff(handoff func() error) {
+	// The faeries are sleeping in this realm
+}
+
+// WhisperReload remains silent in the Windows realm, which knows
+// no SIGHUP
+func WhisperReload(reload func() error) {
 	// The faeries are sleeping in this realm
 }
 
@@ -0,0 +1,92 @@
+package faeOS
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+)
+
+// bequeathed is set once an heir took over the service, which
+// then speaks for it alone
+var bequeathed atomic.Bool
+
+// Notify sends the states (such as READY=1) to systemd over
+// NOTIFY_SOCKET, doing nothing when not run as a notify service
+func Notify(states ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" || bequeathed.Load() {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return err
+}
+
+var readyOnce sync.Once
+
+// NotifyReady tells systemd the process is ready, once. The process
+// names itself the main one, so an heir started on a handoff takes
+// over the service (which then needs NotifyAccess=all).
+func NotifyReady() {
+	readyOnce.Do(func() {
+		if err := Notify("READY=1", fmt.Sprintf("MAINPID=%d", os.Getpid())); err != nil {
+			log.Printf("🍄 Failed to notify systemd: %s", err)
+		}
+	})
+}
+
+// Vitality reports how the process fares for systemd: a STATUS line,
+// and whether it is alive, judged from the keepalive pulses answered
+// within the given window
+type Vitality func(window time.Duration) (status string, alive bool)
+
+// TendWatchdog updates the status of the service every STATUS_INTERVAL
+// (default 10s) and, when systemd's watchdog is enabled (WATCHDOG_USEC),
+// feeds it at half its interval for as long as the process is alive.
+// A process which is not alive is left to the watchdog.
+func TendWatchdog(vitality Vitality) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdog := time.Duration(0)
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+		if err != nil || pid == os.Getpid() {
+			watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	interval := enchantments.WhisperTimespell("STATUS_INTERVAL", 10*time.Second)
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	ailing := false
+	for {
+		status, alive := vitality(watchdog)
+		states := []string{"STATUS=" + status}
+		if watchdog > 0 && alive {
+			states = append(states, "WATCHDOG=1")
+		}
+		if watchdog > 0 && alive == ailing {
+			ailing = !alive
+			if ailing {
+				log.Printf("🍄 No keepalive answered within %s, leaving the watchdog unfed", watchdog)
+			}
+		}
+		if err := Notify(states...); err != nil {
+			log.Printf("🍄 Failed to notify systemd: %s", err)
+		}
+		time.Sleep(interval)
+	}
+}
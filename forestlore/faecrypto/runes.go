@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 )
@@ -41,3 +42,12 @@ func DecipherMagicalRunes(runeData []byte) ([]byte, error) {
 
 	return block.Bytes, nil
 }
+
+// SummonSessionRune conjures a random rune naming a leaf's session
+func SummonSessionRune() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,41 @@
+package faeio
+
+import (
+	"strconv"
+	"strings"
+)
+
+// byteUnits are the units a size or a rate may be given in
+var byteUnits = []struct {
+	suffix string
+	bytes  float64
+}{
+	{"gbit", 1e9 / 8},
+	{"mbit", 1e6 / 8},
+	{"kbit", 1e3 / 8},
+	{"gb", 1 << 30},
+	{"mb", 1 << 20},
+	{"kb", 1 << 10},
+	{"g", 1 << 30},
+	{"m", 1 << 20},
+	{"k", 1 << 10},
+	{"b", 1},
+}
+
+// DecipherBytes decodes an amount of fairy dust such as 512KB, 2MB or
+// 10mbit into bytes, reporting false when it is not one. A bare number
+// is in bytes.
+func DecipherBytes(s string) (int64, bool) {
+	number, unit := strings.ToLower(strings.TrimSpace(s)), 1.0
+	for _, u := range byteUnits {
+		if strings.HasSuffix(number, u.suffix) {
+			number, unit = strings.TrimSuffix(number, u.suffix), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return int64(n * unit), true
+}
@@ -0,0 +1,131 @@
+package faeio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Chronicle writes records as JSON lines to a scroll, or to stdout when
+// the scroll is "-". Once the scroll grows past its size it is rotated:
+// scroll becomes scroll.1, scroll.1 becomes scroll.2 and so on, keeping
+// at most keep old scrolls.
+type Chronicle struct {
+	path     string
+	maxSize  int64
+	keep     int
+	mu       sync.Mutex
+	w        io.Writer
+	file     *os.File
+	size     int64
+	rotateAt int64
+}
+
+var (
+	chroniclesMut sync.Mutex
+	chronicles    = map[string]*Chronicle{}
+)
+
+// OpenAccessLog opens the chronicle of an access log, rotated once it
+// grows past size (e.g. 512MB, 100MB when empty)
+func OpenAccessLog(path, size string, keep int) (*Chronicle, error) {
+	maxSize := int64(0)
+	if size != "" {
+		var ok bool
+		if maxSize, ok = DecipherBytes(size); !ok {
+			return nil, fmt.Errorf("--access-log-size: Invalid size '%s' (expected e.g. 512MB or 10GB)", size)
+		}
+	}
+	return OpenChronicle(path, maxSize, keep)
+}
+
+// OpenChronicle opens the chronicle written to path. Every caller
+// opening the same path shares one chronicle, so it rotates as one;
+// the size and keep of the first caller win.
+func OpenChronicle(path string, maxSize int64, keep int) (*Chronicle, error) {
+	chroniclesMut.Lock()
+	defer chroniclesMut.Unlock()
+	if c, ok := chronicles[path]; ok {
+		return c, nil
+	}
+	if maxSize <= 0 {
+		maxSize = 100 << 20
+	}
+	if keep <= 0 {
+		keep = 5
+	}
+	c := &Chronicle{path: path, maxSize: maxSize, keep: keep}
+	if path == "-" {
+		c.w = os.Stdout
+	} else if err := c.open(); err != nil {
+		return nil, err
+	}
+	chronicles[path] = c
+	return c, nil
+}
+
+func (c *Chronicle) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open chronicle: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open chronicle: %w", err)
+	}
+	c.file, c.w, c.size, c.rotateAt = f, f, info.Size(), c.maxSize
+	return nil
+}
+
+// rotate shifts the old scrolls along and starts a new one. When the
+// scroll cannot be shifted it is written on, and rotated again once it
+// grew by another size. When it cannot be reopened, the next record
+// tries again.
+func (c *Chronicle) rotate() error {
+	c.file.Close()
+	c.file, c.w = nil, nil
+	for i := c.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", c.path, i), fmt.Sprintf("%s.%d", c.path, i+1))
+	}
+	shifted := os.Rename(c.path, c.path+".1")
+	if err := c.open(); err != nil {
+		return err
+	}
+	if shifted != nil {
+		c.rotateAt = c.size + c.maxSize
+		return fmt.Errorf("rotate chronicle: %w", shifted)
+	}
+	return nil
+}
+
+// Inscribe writes the record as one line of JSON
+func (c *Chronicle) Inscribe(record any) error {
+	if c == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var rotated error
+	if c.file != nil && c.size > 0 && c.size+int64(len(line)) > c.rotateAt {
+		rotated = c.rotate()
+	}
+	if c.w == nil {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+	n, err := c.w.Write(line)
+	c.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return rotated
+}
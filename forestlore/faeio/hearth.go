@@ -0,0 +1,84 @@
+package faeio
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// hearth is where every whisperer of the process sends its whispers:
+// the slog handler of --log-format and the levels of --log-level
+type hearth struct {
+	// handler is nil for the classic prefixed whispers
+	handler slog.Handler
+	// level applies to every subsystem without an override, when set
+	level     *slog.Level
+	overrides map[string]slog.Level
+}
+
+var theHearth atomic.Pointer[hearth]
+
+func currentHearth() *hearth {
+	if h := theHearth.Load(); h != nil {
+		return h
+	}
+	return &hearth{}
+}
+
+// threshold returns the lowest level heard from a whisperer of the
+// given subsystems, if --log-level sets one. The override of the
+// innermost subsystem wins.
+func (h *hearth) threshold(subsystems []string) (slog.Level, bool) {
+	for i := len(subsystems) - 1; i >= 0; i-- {
+		if level, ok := h.overrides[subsystems[i]]; ok {
+			return level, true
+		}
+	}
+	if h.level != nil {
+		return *h.level, true
+	}
+	return 0, false
+}
+
+// ConfigureWhispers sets how every whisperer of the process whispers.
+// The format is "text" or "json" for structured whispers on stderr, or
+// empty for the classic prefixed ones. The level is a comma separated
+// list of a level (debug, info, warn, error) and subsystem=level
+// overrides, for example "warn,mystical-path=debug"; when empty the
+// whisperers keep their own levels of insight.
+func ConfigureWhispers(format, level string) error {
+	h := &hearth{overrides: map[string]slog.Level{}}
+	for _, part := range strings.Split(level, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, override := strings.Cut(part, "=")
+		if !override {
+			name = subsystem
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("Invalid log level '%s'", name)
+		}
+		if override {
+			h.overrides[subsystem] = l
+		} else {
+			h.level = &l
+		}
+	}
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case "":
+	case "text":
+		h.handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		h.handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("Invalid log format '%s' (expected json or text)", format)
+	}
+	theHearth.Store(h)
+	return nil
+}
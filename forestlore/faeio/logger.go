@@ -1,18 +1,30 @@
 package faeio
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
+	"unicode"
 )
 
-// Whisperer is a magical logger with enchanted prefixing and 2 levels of mystical insight
+// Whisperer is a magical logger with enchanted prefixing, backed by slog.
+// Every Fork adds to the prefix and, when shaped like name#value, a field
+// (leaf#3 becomes leaf=3). Plain names form the whisperer's subsystem,
+// which the --log-level overrides match against (see ConfigureWhispers).
+// Info and Debug are the levels of insight used when no --log-level is
+// given.
 type Whisperer struct {
 	Info, Debug bool
 	// internal forest magic
 	prefix          string
 	forestScribe    *log.Logger
 	insight, vision *bool
+	subsystems      []string
+	fields          []any
 }
 
 func NewWhisperer(treeType string) *Whisperer {
@@ -25,29 +37,47 @@ func NewWhispererRune(treeType string, magicalRune int) *Whisperer {
 		forestScribe: log.New(os.Stderr, "", magicalRune),
 		Info:         false,
 		Debug:        false,
+		subsystems:   []string{treeType},
 	}
 	return w
 }
 
 func (w *Whisperer) Infof(forestWhisper string, leaves ...interface{}) {
-	if w.HasInsight() {
-		w.forestScribe.Printf(w.prefix+": "+forestWhisper, leaves...)
+	if w.enabled(slog.LevelInfo) {
+		w.whisper(slog.LevelInfo, fmt.Sprintf(forestWhisper, leaves...))
 	}
 }
 
 func (w *Whisperer) Debugf(forestSecret string, acorns ...interface{}) {
-	if w.HasVision() {
-		w.forestScribe.Printf(w.prefix+": "+forestSecret, acorns...)
+	if w.enabled(slog.LevelDebug) {
+		w.whisper(slog.LevelDebug, fmt.Sprintf(forestSecret, acorns...))
 	}
 }
 
+// Warnf whispers something amiss which the forest recovers from
+func (w *Whisperer) Warnf(forestOmen string, brambles ...interface{}) {
+	if w.enabled(slog.LevelWarn) {
+		w.whisper(slog.LevelWarn, fmt.Sprintf(forestOmen, brambles...))
+	}
+}
+
+// Cryf whispers a failure at the error level: something the forest
+// lost, rather than recovered from
+func (w *Whisperer) Cryf(forestCry string, thorns ...interface{}) {
+	if w.enabled(slog.LevelError) {
+		w.whisper(slog.LevelError, fmt.Sprintf(forestCry, thorns...))
+	}
+}
+
+// Errorf returns the error prefixed by the whisperer, without whispering
+// it: whoever handles the error whispers it once, if at all
 func (w *Whisperer) Errorf(forestCry string, thorns ...interface{}) error {
 	return fmt.Errorf(w.prefix+": "+forestCry, thorns...)
 }
 
 func (w *Whisperer) Fork(sapling string, seeds ...interface{}) *Whisperer {
-	seeds = append([]interface{}{w.prefix}, seeds...)
-	youngWhisperer := NewWhisperer(fmt.Sprintf("%s: "+sapling, seeds...))
+	name := fmt.Sprintf(sapling, seeds...)
+	youngWhisperer := NewWhispererRune(w.prefix+": "+name, w.forestScribe.Flags())
 	youngWhisperer.Info = w.Info
 	if w.insight != nil {
 		youngWhisperer.insight = w.insight
@@ -60,17 +90,91 @@ func (w *Whisperer) Fork(sapling string, seeds ...interface{}) *Whisperer {
 	} else {
 		youngWhisperer.vision = &w.Debug
 	}
+	youngWhisperer.subsystems = append([]string{}, w.subsystems...)
+	youngWhisperer.fields = append([]any{}, w.fields...)
+	if key, value, tagged := strings.Cut(name, "#"); tagged && key != "" {
+		youngWhisperer.fields = append(youngWhisperer.fields, fieldName(key), value)
+	} else {
+		youngWhisperer.subsystems = append(youngWhisperer.subsystems, name)
+	}
 	return youngWhisperer
 }
 
+// With returns a whisperer adding the given key-value fields to every
+// whisper, and to every whisperer forked from it
+func (w *Whisperer) With(fields ...interface{}) *Whisperer {
+	youngWhisperer := *w
+	if w.insight == nil {
+		youngWhisperer.insight = &w.Info
+	}
+	if w.vision == nil {
+		youngWhisperer.vision = &w.Debug
+	}
+	youngWhisperer.fields = append(append([]any{}, w.fields...), fields...)
+	return &youngWhisperer
+}
+
 func (w *Whisperer) Prefix() string {
 	return w.prefix
 }
 
 func (w *Whisperer) HasInsight() bool {
-	return w.Info || (w.insight != nil && *w.insight)
+	return w.enabled(slog.LevelInfo)
 }
 
 func (w *Whisperer) HasVision() bool {
-	return w.Debug || (w.vision != nil && *w.vision)
+	return w.enabled(slog.LevelDebug)
+}
+
+// enabled reports whether whispers of the level are heard, as set by
+// --log-level or else by the whisperer's levels of insight
+func (w *Whisperer) enabled(level slog.Level) bool {
+	if threshold, ok := currentHearth().threshold(w.subsystems); ok {
+		return level >= threshold
+	}
+	switch level {
+	case slog.LevelDebug:
+		return w.Debug || (w.vision != nil && *w.vision)
+	case slog.LevelInfo:
+		return w.Info || (w.insight != nil && *w.insight)
+	}
+	return true
+}
+
+// whisper writes the message to the hearth
+func (w *Whisperer) whisper(level slog.Level, message string) {
+	h := currentHearth()
+	if h.handler == nil {
+		if w.prefix != "" {
+			message = w.prefix + ": " + message
+		}
+		w.forestScribe.Print(message)
+		return
+	}
+	record := slog.NewRecord(time.Now(), level, plainWhisper(message), 0)
+	record.AddAttrs(slog.String("subsystem", strings.Join(w.subsystems, "/")))
+	record.Add(w.fields...)
+	h.handler.Handle(context.Background(), record)
+}
+
+// fieldRenames give some forks a plainer field name
+var fieldRenames = map[string]string{
+	"enchantment": "channel",
+	"faerie":      "path",
+}
+
+func fieldName(key string) string {
+	if renamed, ok := fieldRenames[key]; ok {
+		return renamed
+	}
+	return key
+}
+
+// plainWhisper drops the emojis leading a message and any trailing space
+func plainWhisper(message string) string {
+	message = strings.TrimRightFunc(message, unicode.IsSpace)
+	return strings.TrimLeftFunc(message, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.Is(unicode.So, r) || unicode.Is(unicode.Sk, r) ||
+			unicode.In(r, unicode.Variation_Selector) || r == '‍'
+	})
 }
@@ -0,0 +1,149 @@
+package faeio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Meter tallies the fairy dust of the streams it watches, along with how
+// long they stay open and how long their connection stays linked. The
+// tally is collected with Drain. A barred meter refuses new streams.
+type Meter struct {
+	up, down int64
+	mu       sync.Mutex
+	stamp    time.Time
+	open     int
+	linked   int
+	reading  MeterReading
+	bar      atomic.Value
+}
+
+// MeterReading is the tally of a meter since it was last drained
+type MeterReading struct {
+	Up, Down    int64
+	Channels    int64
+	ChannelTime time.Duration
+	LinkTime    time.Duration
+}
+
+// NewMeter creates an empty meter
+func NewMeter() *Meter {
+	return &Meter{stamp: time.Now()}
+}
+
+// accrue adds the time passed since the last stamp, while held
+func (m *Meter) accrue() {
+	now := time.Now()
+	passed := now.Sub(m.stamp)
+	m.reading.ChannelTime += time.Duration(m.open) * passed
+	if m.linked > 0 {
+		m.reading.LinkTime += passed
+	}
+	m.stamp = now
+}
+
+// Link starts counting the time the meter's connection is linked,
+// returning a func to call once it unlinks
+func (m *Meter) Link() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.mu.Lock()
+	m.accrue()
+	m.linked++
+	m.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			m.accrue()
+			m.linked--
+			m.mu.Unlock()
+		})
+	}
+}
+
+// Drain returns the tally since the last drain and starts a new one
+func (m *Meter) Drain() MeterReading {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accrue()
+	r := m.reading
+	m.reading = MeterReading{}
+	r.Up = atomic.SwapInt64(&m.up, 0)
+	r.Down = atomic.SwapInt64(&m.down, 0)
+	return r
+}
+
+// Peek returns the tally since the last drain, leaving it in place
+func (m *Meter) Peek() MeterReading {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accrue()
+	r := m.reading
+	r.Up = atomic.LoadInt64(&m.up)
+	r.Down = atomic.LoadInt64(&m.down)
+	return r
+}
+
+// Bar refuses new streams with the given reason, or admits them
+// again when the reason is empty
+func (m *Meter) Bar(reason string) {
+	m.bar.Store(reason)
+}
+
+// Barred returns why the meter refuses new streams, or nil
+func (m *Meter) Barred() error {
+	if m == nil {
+		return nil
+	}
+	if reason, _ := m.bar.Load().(string); reason != "" {
+		return errors.New(reason)
+	}
+	return nil
+}
+
+// MeterStream tallies the stream on the meter: its reads as fairy dust
+// going up and its writes as dust going down
+func MeterStream(stream io.ReadWriteCloser, m *Meter) io.ReadWriteCloser {
+	if m == nil {
+		return stream
+	}
+	m.mu.Lock()
+	m.accrue()
+	m.open++
+	m.reading.Channels++
+	m.mu.Unlock()
+	return &meteredStream{ReadWriteCloser: stream, m: m}
+}
+
+type meteredStream struct {
+	io.ReadWriteCloser
+	m      *Meter
+	closed sync.Once
+}
+
+func (ms *meteredStream) Read(fairyDust []byte) (int, error) {
+	n, err := ms.ReadWriteCloser.Read(fairyDust)
+	atomic.AddInt64(&ms.m.up, int64(n))
+	return n, err
+}
+
+func (ms *meteredStream) Write(fairyDust []byte) (int, error) {
+	n, err := ms.ReadWriteCloser.Write(fairyDust)
+	atomic.AddInt64(&ms.m.down, int64(n))
+	return n, err
+}
+
+func (ms *meteredStream) Close() error {
+	ms.closed.Do(func() {
+		ms.m.mu.Lock()
+		ms.m.accrue()
+		ms.m.open--
+		ms.m.mu.Unlock()
+	})
+	return ms.ReadWriteCloser.Close()
+}
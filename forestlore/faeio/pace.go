@@ -0,0 +1,141 @@
+package faeio
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pace is a token bucket limiting the fairy dust flowing through every
+// stream sharing it to a rate in bytes per second. Streams running ahead
+// of the pace are held back until the bucket refills.
+type Pace struct {
+	name      string
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	passed    int64
+	held      int32
+	heldTotal int64
+}
+
+// NewPace creates a pace of rate bytes per second, or nil when rate is
+// zero. It shows in the metrics (engrave_paces) until retired.
+func NewPace(name string, rate int64) *Pace {
+	if rate <= 0 {
+		return nil
+	}
+	burst := float64(rate) / 4
+	if burst < 32*1024 {
+		burst = 32 * 1024
+	}
+	p := &Pace{name: name, rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+	paceLedger.Store(p, struct{}{})
+	return p
+}
+
+// Retire removes the pace from the metrics
+func (p *Pace) Retire() {
+	if p != nil {
+		paceLedger.Delete(p)
+	}
+}
+
+// Wait takes n bytes from the bucket, holding the caller back while the
+// bucket is in debt
+func (p *Pace) Wait(n int) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	now := time.Now()
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+	p.tokens -= float64(n)
+	debt := p.tokens
+	p.mu.Unlock()
+	atomic.AddInt64(&p.passed, int64(n))
+	if debt >= 0 {
+		return
+	}
+	delay := time.Duration(-debt / p.rate * float64(time.Second))
+	atomic.AddInt32(&p.held, 1)
+	atomic.AddInt64(&p.heldTotal, int64(delay))
+	time.Sleep(delay)
+	atomic.AddInt32(&p.held, -1)
+}
+
+// Paces hold the buckets pacing either direction of a channel: Up the
+// fairy dust read from it and Down the fairy dust written to it
+type Paces struct {
+	Up   []*Pace
+	Down []*Pace
+}
+
+// PaceStream holds back reads and writes of the stream to the given paces
+func PaceStream(stream io.ReadWriteCloser, reads, writes []*Pace) io.ReadWriteCloser {
+	reads, writes = presentPaces(reads), presentPaces(writes)
+	if len(reads) == 0 && len(writes) == 0 {
+		return stream
+	}
+	return &pacedStream{ReadWriteCloser: stream, reads: reads, writes: writes}
+}
+
+func presentPaces(paces []*Pace) []*Pace {
+	present := []*Pace{}
+	for _, p := range paces {
+		if p != nil {
+			present = append(present, p)
+		}
+	}
+	return present
+}
+
+type pacedStream struct {
+	io.ReadWriteCloser
+	reads  []*Pace
+	writes []*Pace
+}
+
+func (ps *pacedStream) Read(fairyDust []byte) (int, error) {
+	n, err := ps.ReadWriteCloser.Read(fairyDust)
+	for _, p := range ps.reads {
+		p.Wait(n)
+	}
+	return n, err
+}
+
+func (ps *pacedStream) Write(fairyDust []byte) (int, error) {
+	for _, p := range ps.writes {
+		p.Wait(len(fairyDust))
+	}
+	return ps.ReadWriteCloser.Write(fairyDust)
+}
+
+// paceLedger holds every pace for the metrics
+var paceLedger sync.Map
+
+func init() {
+	expvar.Publish("engrave_paces", expvar.Func(func() any {
+		paces := []map[string]any{}
+		paceLedger.Range(func(k, _ any) bool {
+			p := k.(*Pace)
+			paces = append(paces, map[string]any{
+				"pace":         p.name,
+				"rate":         int64(p.rate),
+				"passed":       atomic.LoadInt64(&p.passed),
+				"throttled":    atomic.LoadInt32(&p.held) > 0,
+				"held_seconds": time.Duration(atomic.LoadInt64(&p.heldTotal)).Seconds(),
+			})
+			return true
+		})
+		return paces
+	}))
+}
@@ -0,0 +1,137 @@
+package faeio
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Priority classes of the streams in a procession
+const (
+	PriorityInteractive = iota
+	PriorityNormal
+	PriorityBulk
+	priorities
+)
+
+// Procession orders the writes of the streams sharing one connection.
+// Writes are cut into quanta which take turns: interactive streams go
+// first, then normal streams, with bulk streams getting one turn in every
+// four while normal streams wait. Streams of the same class take turns in
+// order, so no single stream hogs the connection. A turn is handed on once
+// its quantum is written, or once the write stalls for too long (waiting
+// for the peer's window, for instance), so a slow stream never holds up
+// the others.
+type Procession struct {
+	quantum int
+	stall   time.Duration
+	mu      sync.Mutex
+	busy    *procTurn
+	queues  [priorities][]*procTurn
+	bulkDue int
+}
+
+type procTurn struct {
+	ready chan struct{}
+}
+
+// NewProcession creates a procession writing quantum bytes per turn
+func NewProcession(quantum int, stall time.Duration) *Procession {
+	if quantum <= 0 {
+		quantum = 16 * 1024
+	}
+	if stall <= 0 {
+		stall = 50 * time.Millisecond
+	}
+	return &Procession{quantum: quantum, stall: stall}
+}
+
+// Join returns a stream whose writes take turns in the procession
+func (p *Procession) Join(priority int, stream io.ReadWriteCloser) io.ReadWriteCloser {
+	if p == nil {
+		return stream
+	}
+	if priority < 0 || priority >= priorities {
+		priority = PriorityNormal
+	}
+	return &processionStream{ReadWriteCloser: stream, p: p, priority: priority}
+}
+
+// await blocks until it is the caller's turn to write
+func (p *Procession) await(priority int) *procTurn {
+	t := &procTurn{ready: make(chan struct{})}
+	p.mu.Lock()
+	if p.busy == nil {
+		p.busy = t
+		close(t.ready)
+	} else {
+		p.queues[priority] = append(p.queues[priority], t)
+	}
+	p.mu.Unlock()
+	<-t.ready
+	return t
+}
+
+// pass hands the turn on, unless t no longer holds it
+func (p *Procession) pass(t *procTurn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.busy != t {
+		return
+	}
+	p.busy = p.next()
+	if p.busy != nil {
+		close(p.busy.ready)
+	}
+}
+
+func (p *Procession) next() *procTurn {
+	pop := func(priority int) *procTurn {
+		t := p.queues[priority][0]
+		p.queues[priority] = p.queues[priority][1:]
+		return t
+	}
+	if len(p.queues[PriorityInteractive]) > 0 {
+		return pop(PriorityInteractive)
+	}
+	normal, bulk := len(p.queues[PriorityNormal]) > 0, len(p.queues[PriorityBulk]) > 0
+	if bulk && (!normal || p.bulkDue >= 3) {
+		p.bulkDue = 0
+		return pop(PriorityBulk)
+	}
+	if normal {
+		if bulk {
+			p.bulkDue++
+		}
+		return pop(PriorityNormal)
+	}
+	return nil
+}
+
+type processionStream struct {
+	io.ReadWriteCloser
+	p        *Procession
+	priority int
+}
+
+func (ps *processionStream) Write(fairyDust []byte) (int, error) {
+	written := 0
+	for written < len(fairyDust) {
+		end := written + ps.p.quantum
+		if end > len(fairyDust) {
+			end = len(fairyDust)
+		}
+		t := ps.p.await(ps.priority)
+		stalled := time.AfterFunc(ps.p.stall, func() {
+			ps.p.pass(t)
+		})
+		n, err := ps.ReadWriteCloser.Write(fairyDust[written:end])
+		stalled.Stop()
+		ps.p.pass(t)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
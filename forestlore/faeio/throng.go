@@ -0,0 +1,152 @@
+package faeio
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Throng bounds the channels gathered under it: how many may be open at
+// once, and how many may join per span of time. Channels beyond either
+// bound are refused rather than held back.
+type Throng struct {
+	name    string
+	max     int32
+	count   int
+	per     time.Duration
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	open    int32
+	refused int64
+}
+
+// NewThrong creates a throng of at most max open channels, of which at
+// most count may join per span, or nil when neither is bounded. It shows
+// in the metrics (engrave_throngs) until retired.
+func NewThrong(name string, max, count int, per time.Duration) *Throng {
+	if count <= 0 || per <= 0 {
+		count, per = 0, 0
+	}
+	if max <= 0 && count == 0 {
+		return nil
+	}
+	t := &Throng{name: name, max: int32(max), count: count, per: per, tokens: float64(count), last: time.Now()}
+	throngLedger.Store(t, struct{}{})
+	return t
+}
+
+// Retire removes the throng from the metrics
+func (t *Throng) Retire() {
+	if t != nil {
+		throngLedger.Delete(t)
+	}
+}
+
+// join admits a channel into the throng
+func (t *Throng) join() error {
+	if atomic.AddInt32(&t.open, 1) > t.max && t.max > 0 {
+		atomic.AddInt32(&t.open, -1)
+		return fmt.Errorf("%s reached its limit of %d open channels", t.name, t.max)
+	}
+	if t.count == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() / t.per.Seconds() * float64(t.count)
+	if t.tokens > float64(t.count) {
+		t.tokens = float64(t.count)
+	}
+	t.last = now
+	if t.tokens < 1 {
+		atomic.AddInt32(&t.open, -1)
+		return fmt.Errorf("%s is opening more than %d channels per %s", t.name, t.count, t.per)
+	}
+	t.tokens--
+	return nil
+}
+
+// leave gives back a channel which joined, and its token when it never opened
+func (t *Throng) leave(opened bool) {
+	atomic.AddInt32(&t.open, -1)
+	if !opened && t.count > 0 {
+		t.mu.Lock()
+		t.tokens++
+		t.mu.Unlock()
+	}
+}
+
+// JoinThrongs admits a channel into every given throng, returning a func
+// to call once the channel closes. When any throng refuses it, the
+// channel joins none of them and the refusal is returned.
+func JoinThrongs(throngs []*Throng) (func(), error) {
+	joined := []*Throng{}
+	for _, t := range throngs {
+		if t == nil {
+			continue
+		}
+		if err := t.join(); err != nil {
+			atomic.AddInt64(&t.refused, 1)
+			for _, j := range joined {
+				j.leave(false)
+			}
+			return nil, err
+		}
+		joined = append(joined, t)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, j := range joined {
+				j.leave(true)
+			}
+		})
+	}, nil
+}
+
+// ThrongStream returns the stream, leaving the throngs it joined once
+// it closes
+func ThrongStream(stream io.ReadWriteCloser, leave func()) io.ReadWriteCloser {
+	return &throngedStream{ReadWriteCloser: stream, leave: leave}
+}
+
+type throngedStream struct {
+	io.ReadWriteCloser
+	leave func()
+}
+
+func (ts *throngedStream) Close() error {
+	defer ts.leave()
+	return ts.ReadWriteCloser.Close()
+}
+
+// throngLedger holds every throng for the metrics
+var throngLedger sync.Map
+
+func init() {
+	expvar.Publish("engrave_throngs", expvar.Func(func() any {
+		throngs := []map[string]any{}
+		throngLedger.Range(func(k, _ any) bool {
+			t := k.(*Throng)
+			throng := map[string]any{
+				"throng":  t.name,
+				"open":    atomic.LoadInt32(&t.open),
+				"refused": atomic.LoadInt64(&t.refused),
+			}
+			if t.max > 0 {
+				throng["max"] = t.max
+			}
+			if t.count > 0 {
+				throng["rate"] = fmt.Sprintf("%d/%s", t.count, t.per)
+			}
+			throngs = append(throngs, throng)
+			return true
+		})
+		return throngs
+	}))
+}
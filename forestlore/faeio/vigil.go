@@ -0,0 +1,117 @@
+package faeio
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Vigil watches over both ends of a magical stream and seals them
+// once no fairy dust has flowed in either direction for too long
+type Vigil struct {
+	drowse    time.Duration
+	lastStir  int64
+	sealOnce  sync.Once
+	sealed    chan struct{}
+	reason    string
+	ends      []io.Closer
+	reasonMut sync.Mutex
+}
+
+// KeepVigil wraps both ends of a magical stream. When drowse is zero
+// the ends are returned untouched and the vigil never fires.
+func KeepVigil(drowse time.Duration, a, b io.ReadWriteCloser) (*Vigil, io.ReadWriteCloser, io.ReadWriteCloser) {
+	v := &Vigil{
+		drowse: drowse,
+		sealed: make(chan struct{}),
+		ends:   []io.Closer{a, b},
+	}
+	if drowse <= 0 {
+		return v, a, b
+	}
+	v.stir()
+	go v.watch()
+	return v, &vigilantStream{a, v}, &vigilantStream{b, v}
+}
+
+func (v *Vigil) stir() {
+	atomic.StoreInt64(&v.lastStir, time.Now().UnixNano())
+}
+
+func (v *Vigil) watch() {
+	pulse := v.drowse / 4
+	if pulse < 100*time.Millisecond {
+		pulse = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(pulse)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.sealed:
+			return
+		case <-ticker.C:
+			stillness := time.Since(time.Unix(0, atomic.LoadInt64(&v.lastStir)))
+			if stillness >= v.drowse {
+				v.Seal("idle for " + v.drowse.String())
+				return
+			}
+		}
+	}
+}
+
+// Doom seals the stream once it has been open for lifetime, unless
+// lifetime is zero
+func (v *Vigil) Doom(lifetime time.Duration) {
+	if lifetime <= 0 {
+		return
+	}
+	doom := time.AfterFunc(lifetime, func() {
+		v.Seal("lifetime of " + lifetime.String() + " reached")
+	})
+	go func() {
+		<-v.sealed
+		doom.Stop()
+	}()
+}
+
+// Seal closes both ends of the stream, remembering why. Only the
+// first reason is kept.
+func (v *Vigil) Seal(reason string) {
+	v.sealOnce.Do(func() {
+		v.reasonMut.Lock()
+		v.reason = reason
+		v.reasonMut.Unlock()
+		close(v.sealed)
+		for _, end := range v.ends {
+			end.Close()
+		}
+	})
+}
+
+// Release ends the vigil without sealing the stream
+func (v *Vigil) Release() {
+	v.sealOnce.Do(func() {
+		close(v.sealed)
+	})
+}
+
+// Reason returns why the vigil sealed the stream, or an empty string
+func (v *Vigil) Reason() string {
+	v.reasonMut.Lock()
+	defer v.reasonMut.Unlock()
+	return v.reason
+}
+
+type vigilantStream struct {
+	io.ReadWriteCloser
+	v *Vigil
+}
+
+func (vs *vigilantStream) Read(fairyDust []byte) (int, error) {
+	n, err := vs.ReadWriteCloser.Read(fairyDust)
+	if n > 0 {
+		vs.v.stir()
+	}
+	return n, err
+}
@@ -0,0 +1,426 @@
+package faenet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+)
+
+// HeirloomListener is a tcp listener which is handed down to the heir
+// on a handoff (see Bequeath), until it is closed. The heir takes it
+// over when it listens on the same address, so connections arriving
+// meanwhile wait in its backlog rather than being refused.
+type HeirloomListener struct {
+	*net.TCPListener
+	key       string
+	closeOnce sync.Once
+}
+
+// Close closes the listener, which is no longer handed down
+func (l *HeirloomListener) Close() error {
+	l.closeOnce.Do(func() {
+		heirlooms.Lock()
+		delete(heirlooms.open, l)
+		heirlooms.Unlock()
+	})
+	return l.TCPListener.Close()
+}
+
+// HeirloomCircle is a udp socket handed down to the heir on a handoff
+// like a HeirloomListener, until it is closed. Whispers arriving
+// meanwhile wait in its buffer for the heir.
+type HeirloomCircle struct {
+	*net.UDPConn
+	key       string
+	closeOnce sync.Once
+}
+
+// Close closes the socket, which is no longer handed down
+func (c *HeirloomCircle) Close() error {
+	c.closeOnce.Do(func() {
+		heirlooms.Lock()
+		delete(heirlooms.open, c)
+		heirlooms.Unlock()
+	})
+	return c.UDPConn.Close()
+}
+
+// heirloom is a socket handed down on a handoff, under its key
+type heirloom interface {
+	File() (*os.File, error)
+	heirloomKey() string
+}
+
+func (l *HeirloomListener) heirloomKey() string { return l.key }
+
+// the keys of udp heirlooms are marked apart from those of listeners
+func (c *HeirloomCircle) heirloomKey() string { return "udp:" + c.key }
+
+// heirlooms holds the open heirloom sockets, along with the listeners
+// and circles inherited or passed by systemd and not yet taken over
+var heirlooms struct {
+	sync.Mutex
+	open      map[heirloom]struct{}
+	inherited map[string]*net.TCPListener
+	circles   map[string]*net.UDPConn
+	activated map[string]*net.TCPListener
+	unnamed   []*net.TCPListener
+	once      sync.Once
+}
+
+// Listen listens on the tcp address, taking over the listener
+// inherited for it, if any, or the one systemd passed for the name
+// (see unpackActivated)
+func Listen(name, addr string) (*HeirloomListener, error) {
+	if l := inherit(addr); l != nil {
+		return keep(l, addr), nil
+	}
+	if l := activated(name); l != nil {
+		log.Printf("🌱 Listening on %s as passed by systemd, in place of %s", l.Addr(), addr)
+		return keep(l, addr), nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return keep(l.(*net.TCPListener), addr), nil
+}
+
+// ListenTCP is Listen for a resolved address
+func ListenTCP(laddr *net.TCPAddr) (*HeirloomListener, error) {
+	addr := laddr.String()
+	if l := inherit(addr); l != nil {
+		return keep(l, addr), nil
+	}
+	l, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return keep(l, addr), nil
+}
+
+// ListenUDP is ListenTCP for udp, taking over the circle inherited
+// for the address, if any
+func ListenUDP(laddr *net.UDPAddr) (*HeirloomCircle, error) {
+	addr := laddr.String()
+	heirlooms.once.Do(unpack)
+	heirlooms.Lock()
+	c := heirlooms.circles[addr]
+	delete(heirlooms.circles, addr)
+	heirlooms.Unlock()
+	if c == nil {
+		var err error
+		if c, err = net.ListenUDP("udp", laddr); err != nil {
+			return nil, err
+		}
+	}
+	h := &HeirloomCircle{UDPConn: c, key: addr}
+	bestow(h)
+	return h, nil
+}
+
+func keep(l *net.TCPListener, key string) *HeirloomListener {
+	h := &HeirloomListener{TCPListener: l, key: key}
+	bestow(h)
+	return h
+}
+
+// bestow adds the socket to those handed down
+func bestow(h heirloom) {
+	heirlooms.Lock()
+	defer heirlooms.Unlock()
+	if heirlooms.open == nil {
+		heirlooms.open = map[heirloom]struct{}{}
+	}
+	heirlooms.open[h] = struct{}{}
+}
+
+// inherit takes over the listener inherited for addr, if any
+func inherit(addr string) *net.TCPListener {
+	heirlooms.once.Do(unpack)
+	heirlooms.Lock()
+	defer heirlooms.Unlock()
+	l := heirlooms.inherited[addr]
+	delete(heirlooms.inherited, addr)
+	return l
+}
+
+// Inherits reports whether a socket was inherited for the tcp or udp
+// address and waits to be taken over
+func Inherits(network, addr string) bool {
+	heirlooms.once.Do(unpack)
+	heirlooms.Lock()
+	defer heirlooms.Unlock()
+	inherited := func(addr string) bool {
+		if network == "udp" {
+			_, ok := heirlooms.circles[addr]
+			return ok
+		}
+		_, ok := heirlooms.inherited[addr]
+		return ok
+	}
+	if inherited(addr) {
+		return true
+	}
+	var resolved net.Addr
+	var err error
+	if network == "udp" {
+		resolved, err = net.ResolveUDPAddr("udp", addr)
+	} else {
+		resolved, err = net.ResolveTCPAddr("tcp", addr)
+	}
+	return err == nil && inherited(resolved.String())
+}
+
+// activated takes over the listener systemd passed for the name,
+// if any. Sockets named otherwise (or not at all) stand in for the
+// "whisper" listener, the first of them taken.
+func activated(name string) *net.TCPListener {
+	heirlooms.once.Do(unpack)
+	heirlooms.Lock()
+	defer heirlooms.Unlock()
+	if l, ok := heirlooms.activated[name]; ok {
+		delete(heirlooms.activated, name)
+		return l
+	}
+	if name != "whisper" || len(heirlooms.unnamed) == 0 {
+		return nil
+	}
+	l := heirlooms.unnamed[0]
+	heirlooms.unnamed = heirlooms.unnamed[1:]
+	return l
+}
+
+func unpack() {
+	unpackHeirlooms()
+	unpackActivated()
+}
+
+// unpackActivated opens the sockets systemd passed on socket
+// activation (LISTEN_FDS), named by LISTEN_FDNAMES: whisper, vhost
+// or sni, after the listeners they stand in for
+func unpackActivated() {
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || fds <= 0 || pid != os.Getpid() {
+		return
+	}
+	heirlooms.activated = map[string]*net.TCPListener{}
+	for i := 0; i < fds; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(3+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("🍄 Failed to take the socket passed by systemd (%s): %s", name, err)
+			continue
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			log.Printf("🍄 Ignored the socket passed by systemd (%s): not a tcp listener", name)
+			l.Close()
+			continue
+		}
+		switch name {
+		case "whisper", "vhost", "sni":
+			heirlooms.activated[name] = tl
+		default:
+			heirlooms.unnamed = append(heirlooms.unnamed, tl)
+		}
+	}
+}
+
+// unpackHeirlooms opens the listeners and circles inherited from the
+// tree which started this one, listed in ENGRAVE_HEIRLOOMS in the order
+// of their descriptors
+func unpackHeirlooms() {
+	listed := enchantments.WhisperEnchantment("HEIRLOOMS")
+	os.Unsetenv("ENGRAVE_HEIRLOOMS")
+	if listed == "" {
+		return
+	}
+	heirlooms.inherited = map[string]*net.TCPListener{}
+	heirlooms.circles = map[string]*net.UDPConn{}
+	for i, key := range strings.Split(listed, ",") {
+		f := os.NewFile(uintptr(3+i), key)
+		if addr, ok := strings.CutPrefix(key, "udp:"); ok {
+			c, err := net.FilePacketConn(f)
+			f.Close()
+			if err != nil {
+				log.Printf("🍄 Failed to inherit the circle on %s: %s", addr, err)
+				continue
+			}
+			uc, ok := c.(*net.UDPConn)
+			if !ok {
+				c.Close()
+				continue
+			}
+			heirlooms.circles[addr] = uc
+			continue
+		}
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("🍄 Failed to inherit the listener on %s: %s", key, err)
+			continue
+		}
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			l.Close()
+			continue
+		}
+		heirlooms.inherited[key] = tl
+	}
+}
+
+// HeirReady tells the tree which started this one, if any, that it
+// now accepts. Sockets passed by systemd which no listener took over
+// are closed at once, and inherited listeners and circles not taken
+// over by HEIRLOOM_WAIT (default 2m), such as those of reverse paths
+// whose leaves did not return, are closed then.
+func HeirReady() {
+	heirlooms.once.Do(unpack)
+	releaseActivated()
+	fd := enchantments.WhisperEnchantment("HEIR_READY")
+	os.Unsetenv("ENGRAVE_HEIR_READY")
+	if fd == "" {
+		return
+	}
+	if n, err := strconv.Atoi(fd); err == nil {
+		ready := os.NewFile(uintptr(n), "heir-ready")
+		ready.Write([]byte("ready"))
+		ready.Close()
+	}
+	time.AfterFunc(enchantments.WhisperTimespell("HEIRLOOM_WAIT", 2*time.Minute), func() {
+		heirlooms.Lock()
+		defer heirlooms.Unlock()
+		for addr, l := range heirlooms.inherited {
+			log.Printf("🍂 Closing the unclaimed listener on %s", addr)
+			l.Close()
+		}
+		heirlooms.inherited = nil
+		for addr, c := range heirlooms.circles {
+			log.Printf("🍂 Closing the unclaimed circle on %s", addr)
+			c.Close()
+		}
+		heirlooms.circles = nil
+	})
+}
+
+// releaseActivated closes the sockets systemd passed which no listener
+// took over: those named for a listener the tree does not open, and
+// unnamed ones beyond the first
+func releaseActivated() {
+	heirlooms.Lock()
+	defer heirlooms.Unlock()
+	for name, l := range heirlooms.activated {
+		log.Printf("🍂 Closing the socket passed by systemd on %s (%s), which no listener takes", l.Addr(), name)
+		l.Close()
+	}
+	for _, l := range heirlooms.unnamed {
+		log.Printf("🍂 Closing the socket passed by systemd on %s, which no listener takes", l.Addr())
+		l.Close()
+	}
+	heirlooms.activated, heirlooms.unnamed = nil, nil
+}
+
+// Bequeath starts an heir: a fresh process of the same binary and
+// arguments, inheriting every open heirloom listener and circle. It returns once
+// the heir accepts (see HeirReady), or fails when the heir exits or
+// is not ready within HEIR_TIMEOUT (default 30s), in which case the
+// heir is killed and the listeners stay with this process alone.
+func Bequeath() error {
+	heirlooms.Lock()
+	keys := make([]string, 0, len(heirlooms.open))
+	files := make([]*os.File, 0, len(heirlooms.open))
+	var err error
+	for l := range heirlooms.open {
+		var f *os.File
+		if f, err = l.File(); err != nil {
+			break
+		}
+		keys = append(keys, l.heirloomKey())
+		files = append(files, f)
+	}
+	heirlooms.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return fmt.Errorf("bequeath listeners: %w", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	awaitReady, ready, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer awaitReady.Close()
+	heir := exec.Command(exe, os.Args[1:]...)
+	heir.Stdin, heir.Stdout, heir.Stderr = os.Stdin, os.Stdout, os.Stderr
+	heir.ExtraFiles = append(files, ready)
+	heir.Env = append(heirlessEnviron(),
+		"ENGRAVE_HEIRLOOMS="+strings.Join(keys, ","),
+		"ENGRAVE_HEIR_READY="+strconv.Itoa(3+len(files)),
+	)
+	err = heir.Start()
+	ready.Close()
+	if err != nil {
+		return err
+	}
+	answered := make(chan bool, 1)
+	go func() {
+		b, _ := io.ReadAll(awaitReady)
+		answered <- string(b) == "ready"
+	}()
+	select {
+	case ok := <-answered:
+		if ok {
+			log.Printf("🌱 Heir (pid %d) accepts on %d listeners", heir.Process.Pid, len(keys))
+			return heir.Process.Release()
+		}
+		err = errors.New("the heir withered before accepting")
+	case <-time.After(enchantments.WhisperTimespell("HEIR_TIMEOUT", 30*time.Second)):
+		err = errors.New("the heir did not accept in time")
+	}
+	heir.Process.Kill()
+	heir.Wait()
+	return err
+}
+
+// heirlessEnviron returns the environment without the heirlooms this
+// process inherited itself, nor the sockets systemd passed it and the
+// pid its watchdog expects, which the heir takes over
+func heirlessEnviron() []string {
+	env := []string{}
+	for _, e := range os.Environ() {
+		name, _, _ := strings.Cut(e, "=")
+		switch name {
+		case "ENGRAVE_HEIRLOOMS", "ENGRAVE_HEIR_READY", "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", "WATCHDOG_PID":
+		default:
+			env = append(env, e)
+		}
+	}
+	return env
+}
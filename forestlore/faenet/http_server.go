@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -19,6 +20,8 @@ type EnchantedHTTPServer struct {
 	whisperErr      error
 	faerieGathering *sync.WaitGroup
 	Wait            func() error
+	magicalPortal   net.Listener
+	relinquished    atomic.Bool
 }
 
 // NewEnchantedHTTPServer summons a new EnchantedHTTPServer
@@ -50,9 +53,16 @@ func (e *EnchantedHTTPServer) GrowMagicalServer(enchantedRealm context.Context,
 	e.faerieLock.Lock()
 	defer e.faerieLock.Unlock()
 	e.Handler = forestKeeper
+	e.magicalPortal = magicalPortal
 	e.faerieGroup, enchantedRealm = errgroup.WithContext(enchantedRealm)
 	e.faerieGroup.Go(func() error {
-		return e.Serve(magicalPortal)
+		err := e.Serve(magicalPortal)
+		if e.relinquished.Load() {
+			// the listener lives on elsewhere, keep serving until withered
+			<-enchantedRealm.Done()
+			return nil
+		}
+		return err
 	})
 	go func() {
 		<-enchantedRealm.Done()
@@ -70,6 +80,18 @@ func (e *EnchantedHTTPServer) Wither() error {
 	return e.Server.Close()
 }
 
+// Relinquish stops accepting, while the connections served so far
+// carry on until the server withers
+func (e *EnchantedHTTPServer) Relinquish() error {
+	e.faerieLock.Lock()
+	defer e.faerieLock.Unlock()
+	if e.faerieGroup == nil {
+		return errors.New("the magical server hasn't sprouted yet")
+	}
+	e.relinquished.Store(true)
+	return e.magicalPortal.Close()
+}
+
 func (e *EnchantedHTTPServer) AwaitDormancy() error {
 	e.faerieLock.Lock()
 	unblossomed := e.faerieGroup == nil
@@ -0,0 +1,32 @@
+package faenet
+
+import (
+	"crypto/tls"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+// ShallowSendQueue limits the data a websocket's tcp connection keeps
+// queued but unsent in the kernel to about lowat bytes. Writes then wait
+// in the process, where the channels of the tunnel take turns, rather
+// than in a deep kernel queue which delays every channel alike. Only
+// supported on linux; elsewhere and when lowat is zero it does nothing.
+func ShallowSendQueue(ws *websocket.Conn, lowat int) error {
+	if lowat <= 0 {
+		return nil
+	}
+	conn := ws.UnderlyingConn()
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return setNotSentLowat(raw, lowat)
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package faenet
+
+import "syscall"
+
+// tcpNotSentLowat is TCP_NOTSENT_LOWAT, which the syscall package lacks
+const tcpNotSentLowat = 0x19
+
+func setNotSentLowat(raw syscall.RawConn, lowat int) error {
+	var sockErr error
+	err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpNotSentLowat, lowat)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
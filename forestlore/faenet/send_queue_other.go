@@ -0,0 +1,9 @@
+//go:build !linux
+
+package faenet
+
+import "syscall"
+
+func setNotSentLowat(raw syscall.RawConn, lowat int) error {
+	return nil
+}
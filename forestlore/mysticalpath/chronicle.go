@@ -0,0 +1,105 @@
+package mysticalpath
+
+import (
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"golang.org/x/crypto/ssh"
+)
+
+// Directions of the channels in the access log
+const (
+	directionForward = "forward"
+	directionReverse = "reverse"
+	directionSocks   = "socks"
+)
+
+// ChannelRecord is the access log entry of a single channel, inscribed
+// once the channel closes. BytesOut flowed from the source towards the
+// destination and BytesIn back.
+type ChannelRecord struct {
+	Time        time.Time `json:"time"`
+	Session     string    `json:"session,omitempty"`
+	LeafSession string    `json:"leaf_session,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Peer        string    `json:"peer,omitempty"`
+	Direction   string    `json:"direction"`
+	Element     string    `json:"element"`
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination"`
+	Resolved    string    `json:"resolved,omitempty"`
+	BytesOut    int64     `json:"bytes_out"`
+	BytesIn     int64     `json:"bytes_in"`
+	Duration    float64   `json:"duration_seconds"`
+	CloseReason string    `json:"close_reason"`
+}
+
+// chronicler is implemented by the tunnels recording every channel they
+// carry in the access log, returning the chronicle and their leaf session
+type chronicler interface {
+	channelChronicle() (*faeio.Chronicle, string)
+}
+
+// summonRecord starts the record of a channel opened now. The
+// destination drops any charms of the channel's enchantment.
+func summonRecord(leafSession, direction, element, destination string) *ChannelRecord {
+	destination, _, _ = strings.Cut(destination, "?")
+	return &ChannelRecord{
+		Time:        time.Now().UTC(),
+		LeafSession: leafSession,
+		Direction:   direction,
+		Element:     element,
+		Destination: destination,
+	}
+}
+
+// attend notes the tunnel connection carrying the channel
+func (rec *ChannelRecord) attend(c ssh.Conn) {
+	rec.Session = hex.EncodeToString(c.SessionID())
+	rec.User = c.User()
+	rec.Peer = c.RemoteAddr().String()
+}
+
+// close notes why the channel closed, keeping the first reason given
+func (rec *ChannelRecord) close(reason string) {
+	if rec.CloseReason == "" {
+		rec.CloseReason = reason
+	}
+}
+
+// inscribeRecord finishes the record and writes it to the chronicle
+func inscribeRecord(w *faeio.Whisperer, chronicle *faeio.Chronicle, rec *ChannelRecord) {
+	if chronicle == nil {
+		return
+	}
+	rec.close("closed")
+	rec.Duration = time.Since(rec.Time).Seconds()
+	if err := chronicle.Inscribe(rec); err != nil {
+		w.Cryf("Failed to inscribe the access log: %s", err)
+	}
+}
+
+func (mp *MysticalPath) channelChronicle() (*faeio.Chronicle, string) {
+	return mp.Chronicle, mp.LeafSession
+}
+
+// channelDirection returns the direction of the channels dialed by the
+// mystical path: the tree dials forward paths and the leaf reverse ones
+func (mp *MysticalPath) channelDirection(socks bool) string {
+	if socks {
+		return directionSocks
+	}
+	if mp.AncientTree {
+		return directionForward
+	}
+	return directionReverse
+}
+
+func elementOf(udp bool) string {
+	if udp {
+		return "udp"
+	}
+	return "tcp"
+}
@@ -0,0 +1,112 @@
+package mysticalpath
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// A draining end of a tunnel takes no new channels, letting the open
+// ones finish. It announces itself with a forest-draining whisper, so
+// the other end opens its channels over other connections meanwhile.
+const drainingWhisper = "forest-draining"
+
+// Drain stops the mystical path taking new channels: the listeners of
+// its faeries are sealed, channels opened by the other end are refused
+// and every bound connection is told the path is draining
+func (mp *MysticalPath) Drain() {
+	if !mp.draining.CompareAndSwap(false, true) {
+		return
+	}
+	mp.faeriesMut.Lock()
+	faeries := append([]*Faerie{}, mp.faeries...)
+	mp.faeriesMut.Unlock()
+	for _, f := range faeries {
+		f.Drain()
+	}
+	mp.activePortalMut.RLock()
+	bound := make([]ssh.Conn, 0, len(mp.pulses))
+	for c := range mp.pulses {
+		bound = append(bound, c)
+	}
+	mp.activePortalMut.RUnlock()
+	for _, c := range bound {
+		mp.whisperDrain(c)
+	}
+	mp.Debugf("Draining")
+}
+
+// whisperDrain tells the other end of c the path is draining
+func (mp *MysticalPath) whisperDrain(c ssh.Conn) {
+	if _, _, err := c.SendRequest(drainingWhisper, false, nil); err != nil {
+		mp.Debugf("Failed to whisper the drain: %s", err)
+	}
+}
+
+// OpenChannels returns the number of channels open across the path
+func (mp *MysticalPath) OpenChannels() int {
+	open := mp.channels.count()
+	mp.faeriesMut.Lock()
+	defer mp.faeriesMut.Unlock()
+	for _, f := range mp.faeries {
+		open += f.channels.count()
+	}
+	return open
+}
+
+// heedDraining takes the connection out of the rotation once the other
+// end announced it is draining, so new channels avoid it
+func (mp *MysticalPath) heedDraining(c ssh.Conn) {
+	mp.activePortalMut.Lock()
+	retired := mp.retirePortal(c)
+	if p := mp.pulses[c]; p != nil {
+		p.drain()
+	}
+	mp.activePortalMut.Unlock()
+	if !retired {
+		return
+	}
+	mp.Debugf("Ancient tree connection is draining")
+	if mp.Draining != nil {
+		mp.Draining(c)
+	}
+}
+
+// retirePortal takes the connection out of the rotation, reporting
+// whether it was in it. Channels opened while no connection is left
+// wait for the next binding. Held with activePortalMut.
+func (mp *MysticalPath) retirePortal(c ssh.Conn) bool {
+	for i, active := range mp.activePortals {
+		if active == c {
+			mp.activePortals = append(mp.activePortals[:i], mp.activePortals[i+1:]...)
+			if len(mp.activePortals) == 0 {
+				mp.activatingPortal.SummonFaeries(1)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Drain seals the faerie's listeners, letting its open channels finish
+func (f *Faerie) Drain() {
+	if !f.draining.CompareAndSwap(false, true) {
+		return
+	}
+	for _, l := range f.tcp {
+		l.Close()
+	}
+	for _, c := range f.udp {
+		c.sealed.Store(true)
+		c.inboundWhispers.Close()
+	}
+	f.Debugf("Listeners sealed for the drain")
+}
+
+// Drain seals the grove's listeners, letting its open channels finish
+func (g *Grove) Drain() {
+	g.faerie.Drain()
+}
+
+// OpenChannels returns the number of channels open across the grove
+func (g *Grove) OpenChannels() int {
+	return g.faerie.channels.count()
+}
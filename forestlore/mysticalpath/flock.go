@@ -0,0 +1,233 @@
+package mysticalpath
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+)
+
+// faerieFlock dials the targets of a path leading to several targets,
+// spreading channels across the healthy ones. Targets are ejected after
+// consecutive failed dials or a failed health check, and return once a
+// health check passes again.
+type faerieFlock struct {
+	*faeio.Whisperer
+	realm      string
+	balance    string
+	ejectAfter int32
+	health     time.Duration
+	targets    []*flockTarget
+	turn       uint32
+	stop       chan struct{}
+}
+
+type flockTarget struct {
+	addr     string
+	down     int32
+	failures int32
+	open     int32
+	dials    int64
+	failed   int64
+}
+
+func summonFaerieFlock(whisperer *faeio.Whisperer, realm string) (*faerieFlock, error) {
+	targets, charms, err := enchantments.DecipherFlock(realm)
+	if err != nil {
+		return nil, err
+	}
+	ff := &faerieFlock{
+		Whisperer:  whisperer.Fork("flock#%s", targets[0]),
+		realm:      realm,
+		balance:    charms["balance"],
+		ejectAfter: 3,
+		health:     10 * time.Second,
+		stop:       make(chan struct{}),
+	}
+	if ff.balance == "" {
+		ff.balance = enchantments.BalanceRoundRobin
+	}
+	if n := (enchantments.MysticalPath{Charms: charms}).CharmNumber("eject_after"); n > 0 {
+		ff.ejectAfter = int32(n)
+	}
+	if d, ok := charms["health"]; ok {
+		ff.health, _ = time.ParseDuration(d)
+	}
+	for _, addr := range targets {
+		ff.targets = append(ff.targets, &flockTarget{addr: addr})
+	}
+	if ff.health > 0 {
+		go ff.keepWatch()
+	}
+	ff.Debugf("Flock gathered (%s, %d targets)", ff.balance, len(ff.targets))
+	return ff, nil
+}
+
+// rotation returns the targets in the order they should be dialed,
+// healthy targets first
+func (ff *faerieFlock) rotation() []*flockTarget {
+	n := len(ff.targets)
+	start := 0
+	if ff.balance != enchantments.BalanceFailover {
+		start = int(atomic.AddUint32(&ff.turn, 1)) % n
+	}
+	healthy := make([]*flockTarget, 0, n)
+	ejected := []*flockTarget{}
+	for i := 0; i < n; i++ {
+		t := ff.targets[(start+i)%n]
+		if atomic.LoadInt32(&t.down) == 1 {
+			ejected = append(ejected, t)
+		} else {
+			healthy = append(healthy, t)
+		}
+	}
+	if ff.balance == enchantments.BalanceLeastConn {
+		for i := 1; i < len(healthy); i++ {
+			for j := i; j > 0 && atomic.LoadInt32(&healthy[j].open) < atomic.LoadInt32(&healthy[j-1].open); j-- {
+				healthy[j], healthy[j-1] = healthy[j-1], healthy[j]
+			}
+		}
+	}
+	// ejected targets are still tried when every healthy one fails
+	return append(healthy, ejected...)
+}
+
+func (ff *faerieFlock) dial() (net.Conn, error) {
+	var err error
+	timeout := enchantments.WhisperTimespell("FLOCK_DIAL_TIMEOUT", 5*time.Second)
+	for _, t := range ff.rotation() {
+		var conn net.Conn
+		atomic.AddInt64(&t.dials, 1)
+		conn, err = net.DialTimeout("tcp", t.addr, timeout)
+		if err != nil {
+			atomic.AddInt64(&t.failed, 1)
+			if atomic.AddInt32(&t.failures, 1) >= ff.ejectAfter && atomic.CompareAndSwapInt32(&t.down, 0, 1) {
+				ff.Warnf("Ejected %s after %d failed dials: %s", t.addr, ff.ejectAfter, err)
+			}
+			continue
+		}
+		atomic.StoreInt32(&t.failures, 0)
+		atomic.AddInt32(&t.open, 1)
+		return &flockConn{Conn: conn, target: t}, nil
+	}
+	return nil, err
+}
+
+// keepWatch checks the health of every target until the flock is disbanded
+func (ff *faerieFlock) keepWatch() {
+	ticker := time.NewTicker(ff.health)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ff.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, t := range ff.targets {
+			ff.checkHealth(t)
+		}
+	}
+}
+
+func (ff *faerieFlock) checkHealth(t *flockTarget) {
+	timeout := ff.health
+	if timeout > 5*time.Second {
+		timeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", t.addr, timeout)
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&t.down, 0, 1) {
+			ff.Warnf("Ejected %s after a failed health check: %s", t.addr, err)
+		}
+		return
+	}
+	conn.Close()
+	atomic.StoreInt32(&t.failures, 0)
+	if atomic.CompareAndSwapInt32(&t.down, 1, 0) {
+		ff.Infof("Restored %s after a passed health check", t.addr)
+	}
+}
+
+func (ff *faerieFlock) disband() {
+	close(ff.stop)
+}
+
+// flockConn counts the target's open connections for least-conn
+type flockConn struct {
+	net.Conn
+	target *flockTarget
+	once   sync.Once
+}
+
+func (fc *flockConn) Close() error {
+	fc.once.Do(func() {
+		atomic.AddInt32(&fc.target.open, -1)
+	})
+	return fc.Conn.Close()
+}
+
+// dialFlock dials the flock named by realm, gathering it on first use
+func (mp *MysticalPath) dialFlock(realm string) (net.Conn, error) {
+	mp.flocksMut.Lock()
+	ff, ok := mp.flocks[realm]
+	if !ok {
+		var err error
+		ff, err = summonFaerieFlock(mp.Whisperer, realm)
+		if err != nil {
+			mp.flocksMut.Unlock()
+			return nil, err
+		}
+		if mp.flocks == nil {
+			mp.flocks = map[string]*faerieFlock{}
+		}
+		mp.flocks[realm] = ff
+		flockLedger.Store(ff, struct{}{})
+	}
+	mp.flocksMut.Unlock()
+	return ff.dial()
+}
+
+// disbandFlocks stops the health checks of every flock, which are
+// gathered again on the next channel
+func (mp *MysticalPath) disbandFlocks() {
+	mp.flocksMut.Lock()
+	defer mp.flocksMut.Unlock()
+	for _, ff := range mp.flocks {
+		ff.disband()
+		flockLedger.Delete(ff)
+	}
+	mp.flocks = nil
+}
+
+// flockLedger holds every gathered flock for the metrics
+var flockLedger sync.Map
+
+func init() {
+	expvar.Publish("engrave_flocks", expvar.Func(func() any {
+		flocks := []map[string]any{}
+		flockLedger.Range(func(k, _ any) bool {
+			ff := k.(*faerieFlock)
+			targets := []map[string]any{}
+			for _, t := range ff.targets {
+				targets = append(targets, map[string]any{
+					"target":  t.addr,
+					"healthy": atomic.LoadInt32(&t.down) == 0,
+					"open":    atomic.LoadInt32(&t.open),
+					"dials":   atomic.LoadInt64(&t.dials),
+					"failed":  atomic.LoadInt64(&t.failed),
+				})
+			}
+			flocks = append(flocks, map[string]any{
+				"flock":   ff.realm,
+				"balance": ff.balance,
+				"targets": targets,
+			})
+			return true
+		})
+		return flocks
+	}))
+}
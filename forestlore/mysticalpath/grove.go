@@ -0,0 +1,185 @@
+package mysticalpath
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"golang.org/x/crypto/ssh"
+)
+
+// Grove keeps a single set of listeners for a reverse path woven by
+// several leaves, spreading the channels it accepts across its members.
+// Members leave the rotation the moment their connection departs, and a
+// channel failing to open on one member is retried on the others.
+type Grove struct {
+	*faeio.Whisperer
+	balance   string
+	chronicle *faeio.Chronicle
+	faerie    *Faerie
+	mu        sync.Mutex
+	members   []*groveMember
+	turn      int
+}
+
+type groveMember struct {
+	conn    ssh.Conn
+	meter   *faeio.Meter
+	paces   faeio.Paces
+	throngs []*faeio.Throng
+	open    int32
+}
+
+// NewGrove casts the listeners of the grouped path, recording its
+// channels in the chronicle when not nil
+func NewGrove(whisperer *faeio.Whisperer, path *enchantments.MysticalPath, chronicle *faeio.Chronicle) (*Grove, error) {
+	g := &Grove{
+		Whisperer: whisperer.Fork("grove#%s", path.Charm("group")),
+		balance:   path.Charm("balance"),
+		chronicle: chronicle,
+	}
+	if g.balance == "" {
+		g.balance = enchantments.BalanceRoundRobin
+	}
+	f, err := SummonFaerie(g.Whisperer, g, 0, path)
+	if err != nil {
+		return nil, err
+	}
+	g.faerie = f
+	return g, nil
+}
+
+// Enchant serves the grove's listeners until ctx is done
+func (g *Grove) Enchant(ctx context.Context) error {
+	return g.faerie.Enchant(ctx)
+}
+
+// Join adds the leaf behind c to the rotation, bounding its channels by
+// the throngs, pacing them to the paces and tallying them on the meter
+func (g *Grove) Join(c ssh.Conn, meter *faeio.Meter, paces faeio.Paces, throngs []*faeio.Throng) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(g.members, &groveMember{conn: c, meter: meter, paces: paces, throngs: throngs})
+	g.Infof("Leaf joined (%d members, %s)", len(g.members), g.balance)
+	return len(g.members)
+}
+
+// Leave removes the leaf behind c from the rotation, returning the
+// number of members left
+func (g *Grove) Leave(c ssh.Conn) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, m := range g.members {
+		if m.conn == c {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.Infof("Leaf departed (%d members left)", len(g.members))
+	return len(g.members)
+}
+
+// rotation returns the members in the order they should be tried
+func (g *Grove) rotation() []*groveMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := len(g.members)
+	if n == 0 {
+		return nil
+	}
+	g.turn = (g.turn + 1) % n
+	order := make([]*groveMember, 0, n)
+	for i := 0; i < n; i++ {
+		order = append(order, g.members[(g.turn+i)%n])
+	}
+	if g.balance == enchantments.BalanceLeastConn {
+		// stable, so ties are still broken round-robin
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && atomic.LoadInt32(&order[j].open) < atomic.LoadInt32(&order[j-1].open); j-- {
+				order[j], order[j-1] = order[j-1], order[j]
+			}
+		}
+	}
+	return order
+}
+
+func (g *Grove) channelChronicle() (*faeio.Chronicle, string) {
+	return g.chronicle, ""
+}
+
+func (g *Grove) findAncientTree(ctx context.Context) ssh.Conn {
+	if isEnchantmentBroken(ctx) {
+		return nil
+	}
+	order := g.rotation()
+	if len(order) == 0 {
+		return nil
+	}
+	return &groveConn{Conn: order[0].conn, grove: g, order: order}
+}
+
+// groveConn opens channels on the first member of its rotation which
+// accepts them
+type groveConn struct {
+	ssh.Conn
+	grove *Grove
+	order []*groveMember
+}
+
+func (gc *groveConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	err := errors.New("no leaves left in the grove")
+	for _, m := range gc.order {
+		var channel ssh.Channel
+		var whispers <-chan *ssh.Request
+		var leave func()
+		if err = m.meter.Barred(); err != nil {
+			gc.grove.Debugf("Leaf refuses channels, trying the next: %s", err)
+			continue
+		}
+		if leave, err = faeio.JoinThrongs(m.throngs); err != nil {
+			gc.grove.Debugf("Leaf refuses channels, trying the next: %s", err)
+			continue
+		}
+		channel, whispers, err = m.conn.OpenChannel(name, data)
+		if err != nil {
+			leave()
+			gc.grove.Debugf("Leaf failed to open channel, trying the next: %s", err)
+			continue
+		}
+		atomic.AddInt32(&m.open, 1)
+		// udp circles wait on the connection which carries their channel
+		gc.Conn = m.conn
+		metered := faeio.MeterStream(faeio.PaceStream(channel, m.paces.Up, m.paces.Down), m.meter)
+		metered = faeio.ThrongStream(metered, leave)
+		return &groveChannel{Channel: channel, metered: metered, member: m}, whispers, nil
+	}
+	return nil, nil, err
+}
+
+// groveChannel counts the member's open channels for least-conn,
+// and bounds, paces and tallies them as the member's
+type groveChannel struct {
+	ssh.Channel
+	metered io.ReadWriteCloser
+	member  *groveMember
+	once    sync.Once
+}
+
+func (gc *groveChannel) Read(fairyDust []byte) (int, error) {
+	return gc.metered.Read(fairyDust)
+}
+
+func (gc *groveChannel) Write(fairyDust []byte) (int, error) {
+	return gc.metered.Write(fairyDust)
+}
+
+func (gc *groveChannel) Close() error {
+	gc.once.Do(func() {
+		atomic.AddInt32(&gc.member.open, -1)
+	})
+	return gc.metered.Close()
+}
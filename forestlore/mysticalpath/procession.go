@@ -0,0 +1,33 @@
+package mysticalpath
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"golang.org/x/crypto/ssh"
+)
+
+// processions order the writes of the channels sharing each bound
+// connection, see the priority charm
+var processions sync.Map
+
+func summonProcession(c ssh.Conn) {
+	processions.Store(c, faeio.NewProcession(
+		enchantments.WhisperEnchantedNumber("PROCESSION_QUANTUM", 16*1024),
+		enchantments.WhisperTimespell("PROCESSION_STALL", 50*time.Millisecond),
+	))
+}
+
+// procession returns the procession of the connection carrying a
+// channel, or nil once the connection is gone
+func procession(c ssh.Conn) *faeio.Procession {
+	if gc, ok := c.(*groveConn); ok {
+		c = gc.Conn
+	}
+	if p, ok := processions.Load(c); ok {
+		return p.(*faeio.Procession)
+	}
+	return nil
+}
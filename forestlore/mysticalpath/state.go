@@ -0,0 +1,413 @@
+package mysticalpath
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/jpillora/sizestr"
+	"golang.org/x/crypto/ssh"
+)
+
+// PathState is a snapshot of a mystical path: the connections bound to
+// it, the listeners of its faeries and the channels it dialed. It is
+// dumped on SIGUSR2 and revealed to the admin tooling.
+type PathState struct {
+	Connections []ConnectionState `json:"connections"`
+	Faeries     []FaerieState     `json:"faeries,omitempty"`
+	Channels    []ChannelState    `json:"channels"`
+}
+
+// ConnectionState describes a connection bound to a mystical path and
+// the health of its keepalive pulse. PulseWait is how long the pulse
+// in flight has gone unanswered.
+type ConnectionState struct {
+	Session   string     `json:"session"`
+	User      string     `json:"user,omitempty"`
+	Peer      string     `json:"peer"`
+	Since     time.Time  `json:"since"`
+	Pulses    int64      `json:"pulses"`
+	LastPulse *time.Time `json:"last_pulse,omitempty"`
+	PulseRTT  float64    `json:"pulse_rtt_seconds,omitempty"`
+	PulseWait float64    `json:"pulse_wait_seconds,omitempty"`
+	Draining  bool       `json:"draining,omitempty"`
+}
+
+// FaerieState describes the listeners of a path and the channels
+// they accepted
+type FaerieState struct {
+	Path      string         `json:"path"`
+	Listeners []string       `json:"listeners"`
+	Channels  []ChannelState `json:"channels"`
+	Circles   []CircleState  `json:"circles,omitempty"`
+}
+
+// CircleState describes a udp listener, whose datagrams all share a
+// single channel to the other end
+type CircleState struct {
+	Listener    string `json:"listener"`
+	ChannelOpen bool   `json:"channel_open"`
+	Sent        int64  `json:"sent"`
+	Received    int64  `json:"received"`
+}
+
+// ChannelState describes an open channel. BytesOut flowed from the
+// source towards the destination and BytesIn back.
+type ChannelState struct {
+	ID          int         `json:"id"`
+	Direction   string      `json:"direction"`
+	Element     string      `json:"element"`
+	Source      string      `json:"source,omitempty"`
+	Destination string      `json:"destination"`
+	Resolved    string      `json:"resolved,omitempty"`
+	Opened      time.Time   `json:"opened"`
+	Age         float64     `json:"age_seconds"`
+	BytesOut    int64       `json:"bytes_out"`
+	BytesIn     int64       `json:"bytes_in"`
+	Flows       []FlowState `json:"flows,omitempty"`
+}
+
+// FlowState describes the datagrams of one source carried by a udp
+// channel, sent on to the target from a local socket of their own
+type FlowState struct {
+	Source   string    `json:"source"`
+	Local    string    `json:"local"`
+	Opened   time.Time `json:"opened"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+}
+
+// channelRoll holds the channels open across one end of a tunnel
+type channelRoll struct {
+	mu   sync.Mutex
+	open map[*rolledChannel]struct{}
+}
+
+// rolledChannel is a channel on the roll. Its tally counts reads as up,
+// which is dust coming back in when inbound is set.
+type rolledChannel struct {
+	id      int
+	record  *ChannelRecord
+	tally   *faeio.Meter
+	inbound bool
+	flows   *faeriePortals
+}
+
+// enter puts the channel on the roll, returning a func taking it off
+func (r *channelRoll) enter(c *rolledChannel) func() {
+	r.mu.Lock()
+	if r.open == nil {
+		r.open = map[*rolledChannel]struct{}{}
+	}
+	r.open[c] = struct{}{}
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		delete(r.open, c)
+		r.mu.Unlock()
+	}
+}
+
+// count returns the number of channels on the roll
+func (r *channelRoll) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.open)
+}
+
+// reveal describes the channels on the roll, oldest first
+func (r *channelRoll) reveal() []ChannelState {
+	r.mu.Lock()
+	open := make([]*rolledChannel, 0, len(r.open))
+	for c := range r.open {
+		open = append(open, c)
+	}
+	r.mu.Unlock()
+	states := make([]ChannelState, 0, len(open))
+	for _, c := range open {
+		states = append(states, c.state())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if !states[i].Opened.Equal(states[j].Opened) {
+			return states[i].Opened.Before(states[j].Opened)
+		}
+		return states[i].ID < states[j].ID
+	})
+	return states
+}
+
+func (c *rolledChannel) state() ChannelState {
+	s := ChannelState{
+		ID:          c.id,
+		Direction:   c.record.Direction,
+		Element:     c.record.Element,
+		Source:      c.record.Source,
+		Destination: c.record.Destination,
+		Resolved:    c.record.Resolved,
+		Opened:      c.record.Time,
+		Age:         time.Since(c.record.Time).Seconds(),
+	}
+	reading := c.tally.Peek()
+	s.BytesOut, s.BytesIn = reading.Up, reading.Down
+	if c.inbound {
+		s.BytesOut, s.BytesIn = reading.Down, reading.Up
+	}
+	if c.flows != nil {
+		s.Flows = c.flows.state()
+	}
+	return s
+}
+
+// portalPulse follows the keepalive pulse of a bound connection
+type portalPulse struct {
+	mu     sync.Mutex
+	since  time.Time
+	pulses int64
+	last   time.Time
+	rtt    time.Duration
+	sent   time.Time
+	// draining is set once the other end announced the drain
+	draining bool
+}
+
+func summonPortalPulse() *portalPulse {
+	return &portalPulse{since: time.Now()}
+}
+
+// send notes a pulse sent, awaiting its echo
+func (p *portalPulse) send() {
+	p.mu.Lock()
+	p.sent = time.Now()
+	p.mu.Unlock()
+}
+
+// echo notes the echo of the pulse in flight
+func (p *portalPulse) echo() {
+	p.mu.Lock()
+	now := time.Now()
+	p.pulses++
+	p.last, p.rtt = now, now.Sub(p.sent)
+	p.sent = time.Time{}
+	p.mu.Unlock()
+}
+
+// drain notes the other end announced the connection is draining
+func (p *portalPulse) drain() {
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+}
+
+// heard returns when the connection was last heard of: its latest
+// echo, or its binding before any
+func (p *portalPulse) heard() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last.After(p.since) {
+		return p.last
+	}
+	return p.since
+}
+
+// Pulse returns the number of bound connections and when any of them
+// was last heard of, by keepalive echo or binding
+func (mp *MysticalPath) Pulse() (bound int, heard time.Time) {
+	mp.activePortalMut.RLock()
+	defer mp.activePortalMut.RUnlock()
+	for _, p := range mp.pulses {
+		if h := p.heard(); h.After(heard) {
+			heard = h
+		}
+	}
+	return len(mp.pulses), heard
+}
+
+func (p *portalPulse) state(c ssh.Conn) ConnectionState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := ConnectionState{
+		Session:  hex.EncodeToString(c.SessionID()),
+		User:     c.User(),
+		Peer:     c.RemoteAddr().String(),
+		Since:    p.since,
+		Pulses:   p.pulses,
+		PulseRTT: p.rtt.Seconds(),
+		Draining: p.draining,
+	}
+	if !p.last.IsZero() {
+		last := p.last
+		s.LastPulse = &last
+	}
+	if !p.sent.IsZero() {
+		s.PulseWait = time.Since(p.sent).Seconds()
+	}
+	return s
+}
+
+// State returns a snapshot of the mystical path
+func (mp *MysticalPath) State() PathState {
+	state := PathState{
+		Connections: []ConnectionState{},
+		Channels:    mp.channels.reveal(),
+	}
+	mp.activePortalMut.RLock()
+	for c, pulse := range mp.pulses {
+		state.Connections = append(state.Connections, pulse.state(c))
+	}
+	mp.activePortalMut.RUnlock()
+	sort.Slice(state.Connections, func(i, j int) bool {
+		return state.Connections[i].Since.Before(state.Connections[j].Since)
+	})
+	mp.faeriesMut.Lock()
+	faeries := append([]*Faerie{}, mp.faeries...)
+	mp.faeriesMut.Unlock()
+	for _, f := range faeries {
+		state.Faeries = append(state.Faeries, f.State())
+	}
+	return state
+}
+
+// State returns a snapshot of the faerie's listeners and channels
+func (f *Faerie) State() FaerieState {
+	state := FaerieState{
+		Path:      f.magicalPath.String(),
+		Listeners: []string{},
+		Channels:  f.channels.reveal(),
+	}
+	if f.magicalPath.Whisper {
+		state.Listeners = append(state.Listeners, "stdio")
+	}
+	for _, l := range f.tcp {
+		state.Listeners = append(state.Listeners, l.Addr().String())
+	}
+	for _, c := range f.udp {
+		state.Listeners = append(state.Listeners, c.inboundWhispers.LocalAddr().String())
+		state.Circles = append(state.Circles, c.state())
+	}
+	return state
+}
+
+// Describe writes the state for people to read, every line indented
+func (s PathState) Describe(w io.Writer, indent string) {
+	for _, c := range s.Connections {
+		draining := ""
+		if c.Draining {
+			draining = ", draining"
+		}
+		fmt.Fprintf(w, "%sconnection %.12s from %s, up %s, %s%s\n",
+			indent, c.Session, c.Peer, age(c.Since), c.describePulse(), draining)
+	}
+	for _, f := range s.Faeries {
+		f.Describe(w, indent)
+	}
+	for _, c := range s.Channels {
+		c.Describe(w, indent)
+	}
+}
+
+func (c ConnectionState) describePulse() string {
+	if c.PulseWait > 0 && c.LastPulse == nil {
+		return fmt.Sprintf("first pulse unanswered for %s", seconds(c.PulseWait))
+	}
+	if c.LastPulse == nil {
+		return "no pulses"
+	}
+	pulse := fmt.Sprintf("%d pulses, last %s ago (rtt %s)", c.Pulses, age(*c.LastPulse), seconds(c.PulseRTT))
+	if c.PulseWait > 0 {
+		pulse += fmt.Sprintf(", pulse unanswered for %s", seconds(c.PulseWait))
+	}
+	return pulse
+}
+
+// Describe writes the faerie's state for people to read
+func (s FaerieState) Describe(w io.Writer, indent string) {
+	fmt.Fprintf(w, "%sfaerie %s listening on %v, %d open channels\n", indent, s.Path, s.Listeners, len(s.Channels))
+	for _, c := range s.Circles {
+		open := "no channel"
+		if c.ChannelOpen {
+			open = "channel open"
+		}
+		fmt.Fprintf(w, "%s  udp %s: %s, sent %s received %s\n",
+			indent, c.Listener, open, sizestr.ToString(c.Sent), sizestr.ToString(c.Received))
+	}
+	for _, c := range s.Channels {
+		c.Describe(w, indent+"  ")
+	}
+}
+
+// Describe writes the channel's state for people to read
+func (s ChannelState) Describe(w io.Writer, indent string) {
+	source := s.Source
+	if source == "" {
+		source = "?"
+	}
+	destination := s.Destination
+	if s.Resolved != "" {
+		destination += " (" + s.Resolved + ")"
+	}
+	fmt.Fprintf(w, "%schannel #%d %s %s %s -> %s, open %s, out %s in %s\n",
+		indent, s.ID, s.Direction, s.Element, source, destination,
+		seconds(s.Age), sizestr.ToString(s.BytesOut), sizestr.ToString(s.BytesIn))
+	for _, f := range s.Flows {
+		fmt.Fprintf(w, "%s  flow %s via %s, open %s, sent %s received %s\n",
+			indent, f.Source, f.Local, age(f.Opened), sizestr.ToString(f.Sent), sizestr.ToString(f.Received))
+	}
+}
+
+func age(t time.Time) string {
+	return time.Since(t).Round(time.Second).String()
+}
+
+func seconds(s float64) string {
+	d := time.Duration(s * float64(time.Second))
+	if d < time.Second {
+		return d.Round(time.Microsecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// GroveState is a snapshot of a grove: the leaves in its rotation
+// and its listeners
+type GroveState struct {
+	Balance string             `json:"balance"`
+	Members []GroveMemberState `json:"members"`
+	Faerie  FaerieState        `json:"faerie"`
+}
+
+// GroveMemberState describes a leaf in the rotation of a grove
+type GroveMemberState struct {
+	Session string `json:"session"`
+	User    string `json:"user,omitempty"`
+	Peer    string `json:"peer"`
+	Open    int32  `json:"open_channels"`
+}
+
+// State returns a snapshot of the grove
+func (g *Grove) State() GroveState {
+	state := GroveState{Balance: g.balance, Members: []GroveMemberState{}}
+	g.mu.Lock()
+	for _, m := range g.members {
+		state.Members = append(state.Members, GroveMemberState{
+			Session: hex.EncodeToString(m.conn.SessionID()),
+			User:    m.conn.User(),
+			Peer:    m.conn.RemoteAddr().String(),
+			Open:    atomic.LoadInt32(&m.open),
+		})
+	}
+	g.mu.Unlock()
+	state.Faerie = g.faerie.State()
+	return state
+}
+
+// Describe writes the grove's state for people to read
+func (s GroveState) Describe(w io.Writer, indent string) {
+	for _, m := range s.Members {
+		fmt.Fprintf(w, "%smember %.12s from %s, %d open channels\n", indent, m.Session, m.Peer, m.Open)
+	}
+	s.Faerie.Describe(w, indent)
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Er0sSec/Engrave/forestlore/enchantments"
@@ -24,22 +25,51 @@ type EnchantedConfig struct {
 	OutboundMagic bool
 	FaerieSocks   bool
 	MagicalPulse  time.Duration
+	// Paces hold back every channel of the mystical path, Up
+	// pacing the fairy dust arriving over it, Down the dust sent
+	Paces faeio.Paces
+	// Throngs bound the channels of the mystical path, opened from
+	// either side
+	Throngs []*faeio.Throng
+	// Meter tallies the channels of the mystical path, refusing
+	// new ones while barred
+	Meter *faeio.Meter
+	// Chronicle records every channel of the mystical path in the
+	// access log, naming the leaf by LeafSession
+	Chronicle   *faeio.Chronicle
+	LeafSession string
+	// Draining is called once the other end announces the connection
+	// c is draining, no longer taking new channels
+	Draining func(c ssh.Conn)
+	// AncientTree is set on the tree's end of the tunnels
+	AncientTree bool
 }
 
 type MysticalPath struct {
 	EnchantedConfig
 	activePortalMut  sync.RWMutex
 	activatingPortal faerieGathering
-	activePortal     ssh.Conn
+	activePortals    []ssh.Conn
+	pulses           map[ssh.Conn]*portalPulse
+	portalTurn       uint32
 	faerieCount      int
 	portalStats      faenet.FaerieGathering
 	faerieSocksRealm *socks5.Server
+	wardsMut         sync.RWMutex
+	wards            map[string]*faerieWards
+	flocksMut        sync.Mutex
+	flocks           map[string]*faerieFlock
+	faeriesMut       sync.Mutex
+	faeries          []*Faerie
+	channels         channelRoll
+	draining         atomic.Bool
 }
 
 func New(c EnchantedConfig) *MysticalPath {
 	c.Whisperer = c.Whisperer.Fork("mystical-path")
 	mp := &MysticalPath{
 		EnchantedConfig: c,
+		pulses:          map[ssh.Conn]*portalPulse{},
 	}
 	mp.activatingPortal.SummonFaeries(1)
 	extraMagic := ""
@@ -55,33 +85,52 @@ func New(c EnchantedConfig) *MysticalPath {
 	return mp
 }
 
+// BindToAncientTree serves the connection c until it closes. The
+// mystical path may be bound again afterwards: channels opened in
+// the meantime wait (see ANCIENT_TREE_WAIT) for the next binding.
+// Several connections may be bound at once, in which case channels
+// are spread across them.
 func (mp *MysticalPath) BindToAncientTree(ctx context.Context, c ssh.Conn, whispers <-chan *ssh.Request, portals <-chan ssh.NewChannel) error {
+	severed := make(chan struct{})
+	defer close(severed)
 	go func() {
-		<-ctx.Done()
-		if c.Close() == nil {
-			mp.Debugf("Ancient tree connection severed")
+		select {
+		case <-ctx.Done():
+			if c.Close() == nil {
+				mp.Debugf("Ancient tree connection severed")
+			}
+		case <-severed:
 		}
-		mp.activatingPortal.AllFaeriesDeparted()
 	}()
+	summonProcession(c)
+	defer processions.Delete(c)
 	mp.activePortalMut.Lock()
-	if mp.activePortal != nil {
-		panic("double binding to ancient tree")
+	mp.activePortals = append(mp.activePortals, c)
+	pulse := summonPortalPulse()
+	mp.pulses[c] = pulse
+	if len(mp.activePortals) == 1 {
+		mp.activatingPortal.FaerieDeparted()
 	}
-	mp.activePortal = c
 	mp.activePortalMut.Unlock()
-	mp.activatingPortal.FaerieDeparted()
 	if mp.EnchantedConfig.MagicalPulse > 0 {
-		go mp.magicalPulseLoop(c)
+		go mp.magicalPulseLoop(c, pulse)
 	}
-	go mp.listenToAncientTreeWhispers(whispers)
-	go mp.openMysticalPortals(portals)
+	go mp.listenToAncientTreeWhispers(c, whispers)
+	go mp.openMysticalPortals(c, portals)
 	mp.Debugf("Connected to ancient tree")
+	if mp.draining.Load() {
+		mp.whisperDrain(c)
+	}
 	err := c.Wait()
 	mp.Debugf("Disconnected from ancient tree")
-	mp.activatingPortal.SummonFaeries(1)
 	mp.activePortalMut.Lock()
-	mp.activePortal = nil
+	mp.retirePortal(c)
+	delete(mp.pulses, c)
+	last := len(mp.pulses) == 0
 	mp.activePortalMut.Unlock()
+	if last {
+		mp.disbandFlocks()
+	}
 	return err
 }
 
@@ -89,10 +138,7 @@ func (mp *MysticalPath) findAncientTree(ctx context.Context) ssh.Conn {
 	if isEnchantmentBroken(ctx) {
 		return nil
 	}
-	mp.activePortalMut.RLock()
-	c := mp.activePortal
-	mp.activePortalMut.RUnlock()
-	if c != nil {
+	if c := mp.nextActivePortal(); c != nil {
 		return c
 	}
 	select {
@@ -101,13 +147,21 @@ func (mp *MysticalPath) findAncientTree(ctx context.Context) ssh.Conn {
 	case <-time.After(enchantments.WhisperTimespell("ANCIENT_TREE_WAIT", 35*time.Second)):
 		return nil
 	case <-mp.activatingPortalWait():
-		mp.activePortalMut.RLock()
-		c := mp.activePortal
-		mp.activePortalMut.RUnlock()
-		return c
+		return mp.nextActivePortal()
 	}
 }
 
+// nextActivePortal picks the bound connections in turn
+func (mp *MysticalPath) nextActivePortal() ssh.Conn {
+	mp.activePortalMut.RLock()
+	defer mp.activePortalMut.RUnlock()
+	if len(mp.activePortals) == 0 {
+		return nil
+	}
+	turn := atomic.AddUint32(&mp.portalTurn, 1)
+	return mp.activePortals[int(turn)%len(mp.activePortals)]
+}
+
 func (mp *MysticalPath) activatingPortalWait() <-chan struct{} {
 	magicalRealm := make(chan struct{})
 	go func() {
@@ -125,14 +179,25 @@ func (mp *MysticalPath) BindRemotes(ctx context.Context, enchantedPaths []*encha
 		return errors.New("inbound magic blocked")
 	}
 	faeries := make([]*Faerie, len(enchantedPaths))
+	mp.faeriesMut.Lock()
 	for i, path := range enchantedPaths {
 		f, err := SummonFaerie(mp.Whisperer, mp, mp.faerieCount, path)
 		if err != nil {
+			mp.faeriesMut.Unlock()
+			// the faeries summoned so far never enchant, so they
+			// give up their listeners and paces here
+			for _, summoned := range faeries[:i] {
+				summoned.sealListeners()
+				summoned.retirePaces()
+			}
 			return err
 		}
 		faeries[i] = f
 		mp.faerieCount++
 	}
+	mp.faeries = append(mp.faeries, faeries...)
+	mp.faeriesMut.Unlock()
+	defer mp.dismissFaeries(faeries)
 	eg, ctx := errgroup.WithContext(ctx)
 	for _, faerie := range faeries {
 		f := faerie
@@ -146,13 +211,74 @@ func (mp *MysticalPath) BindRemotes(ctx context.Context, enchantedPaths []*encha
 	return err
 }
 
-func (mp *MysticalPath) magicalPulseLoop(ancientTreeConn ssh.Conn) {
+// Sever closes every connection bound to the ancient tree, each of
+// which the leaf then reconnects, whispering its paths anew
+func (mp *MysticalPath) Sever() {
+	mp.activePortalMut.RLock()
+	portals := append([]ssh.Conn{}, mp.activePortals...)
+	mp.activePortalMut.RUnlock()
+	for _, c := range portals {
+		c.Close()
+	}
+}
+
+// WardReversePaths prepares the TLS charms of reversed paths, which the
+// leaf casts on the channels the tree opens towards their targets
+func (mp *MysticalPath) WardReversePaths(enchantedPaths enchantments.MysticalPaths) error {
+	wards := map[string]*faerieWards{}
+	for _, path := range enchantedPaths {
+		w, err := summonFaerieWards(path)
+		if err != nil {
+			return mp.Errorf("%s: %s", path, err)
+		}
+		if w == nil {
+			continue
+		}
+		for _, single := range path.Unfurl() {
+			wards[single.WardSigil()] = w
+		}
+	}
+	mp.wardsMut.Lock()
+	mp.wards = wards
+	mp.wardsMut.Unlock()
+	return nil
+}
+
+func (mp *MysticalPath) findWards(sigil string) *faerieWards {
+	if sigil == "" {
+		return nil
+	}
+	mp.wardsMut.RLock()
+	defer mp.wardsMut.RUnlock()
+	return mp.wards[sigil]
+}
+
+// dismissFaeries forgets the faeries once they are unbound
+func (mp *MysticalPath) dismissFaeries(faeries []*Faerie) {
+	mp.faeriesMut.Lock()
+	defer mp.faeriesMut.Unlock()
+	kept := mp.faeries[:0]
+	for _, f := range mp.faeries {
+		dismissed := false
+		for _, d := range faeries {
+			dismissed = dismissed || f == d
+		}
+		if !dismissed {
+			kept = append(kept, f)
+		}
+	}
+	mp.faeries = kept
+}
+
+func (mp *MysticalPath) magicalPulseLoop(ancientTreeConn ssh.Conn, pulse *portalPulse) {
 	for {
 		time.Sleep(mp.EnchantedConfig.MagicalPulse)
+		pulse.send()
 		_, magicalEcho, err := ancientTreeConn.SendRequest("magical-pulse", true, nil)
 		if err != nil {
 			break
 		}
+		pulse.echo()
 		if len(magicalEcho) > 0 && !bytes.Equal(magicalEcho, []byte("magical-echo")) {
 			mp.Debugf("strange magical pulse response")
 			break
@@ -160,3 +286,15 @@ func (mp *MysticalPath) magicalPulseLoop(ancientTreeConn ssh.Conn) {
 	}
 	ancientTreeConn.Close()
 }
+
+func (mp *MysticalPath) channelPaces() faeio.Paces {
+	return mp.Paces
+}
+
+func (mp *MysticalPath) channelThrongs() []*faeio.Throng {
+	return mp.Throngs
+}
+
+func (mp *MysticalPath) channelMeter() *faeio.Meter {
+	return mp.Meter
+}
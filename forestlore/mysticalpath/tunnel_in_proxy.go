@@ -5,26 +5,54 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Er0sSec/Engrave/forestlore/enchantments"
 	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
 )
 
 type ancientTreeTunnel interface {
 	findAncientTree(ctx context.Context) ssh.Conn
 }
 
+// pacer is implemented by the tunnels pacing every channel they carry
+type pacer interface {
+	channelPaces() faeio.Paces
+}
+
+// musterer is implemented by the tunnels bounding and metering every
+// channel they carry
+type musterer interface {
+	channelThrongs() []*faeio.Throng
+	channelMeter() *faeio.Meter
+}
+
 type Faerie struct {
 	*faeio.Whisperer
 	ancientTree ancientTreeTunnel
 	id          int
 	count       int
 	magicalPath *enchantments.MysticalPath
+	unfurled    enchantments.MysticalPaths
+	wards       *faerieWards
+	paces       faeio.Paces
+	reads       []*faeio.Pace
+	writes      []*faeio.Pace
+	throng      *faeio.Throng
+	throngs     []*faeio.Throng
+	meter       *faeio.Meter
+	chronicle   *faeio.Chronicle
+	leafSession string
 	dialer      net.Dialer
-	tcp         *net.TCPListener
-	udp         *faerieCircle
+	tcp         []*faenet.HeirloomListener
+	udp         []*faerieCircle
+	channels    channelRoll
+	draining    atomic.Bool
 	mu          sync.Mutex
 }
 
@@ -35,6 +63,35 @@ func SummonFaerie(whisperer *faeio.Whisperer, ancientTree ancientTreeTunnel, ind
 		ancientTree: ancientTree,
 		id:          id,
 		magicalPath: magicalPath,
+		unfurled:    magicalPath.Unfurl(),
+	}
+	// rate_up paces the dust written towards the target, rate_down the dust read back
+	f.paces = faeio.Paces{
+		Up:   []*faeio.Pace{faeio.NewPace(f.Prefix()+" up", magicalPath.CharmRate("rate_up"))},
+		Down: []*faeio.Pace{faeio.NewPace(f.Prefix()+" down", magicalPath.CharmRate("rate_down"))},
+	}
+	f.reads, f.writes = f.paces.Down, f.paces.Up
+	if p, ok := ancientTree.(pacer); ok {
+		f.reads = append(f.reads, p.channelPaces().Up...)
+		f.writes = append(f.writes, p.channelPaces().Down...)
+	}
+	// max_conns and conn_rate bound the channels of the path
+	count, per := magicalPath.CharmCadence("conn_rate")
+	f.throng = faeio.NewThrong(f.Prefix(), magicalPath.CharmNumber("max_conns"), count, per)
+	f.throngs = []*faeio.Throng{f.throng}
+	if m, ok := ancientTree.(musterer); ok {
+		f.throngs = append(f.throngs, m.channelThrongs()...)
+		f.meter = m.channelMeter()
+	}
+	if c, ok := ancientTree.(chronicler); ok {
+		f.chronicle, f.leafSession = c.channelChronicle()
+	}
+	if !magicalPath.Reverse {
+		wards, err := summonFaerieWards(magicalPath)
+		if err != nil {
+			return nil, f.Errorf("%s", err)
+		}
+		f.wards = wards
 	}
 	return f, f.castListeningSpell()
 }
@@ -43,48 +100,122 @@ func (f *Faerie) castListeningSpell() error {
 	if f.magicalPath.Whisper {
 		//TODO: check if mystical streams are active?
 	} else if f.magicalPath.LocalSpell == "tcp" {
-		enchantedGlade, err := net.ResolveTCPAddr("tcp", f.magicalPath.LocalGlade+":"+f.magicalPath.LocalPortal)
-		if err != nil {
-			return f.Errorf("resolve enchanted glade: %s", err)
-		}
-		l, err := net.ListenTCP("tcp", enchantedGlade)
-		if err != nil {
-			return f.Errorf("tcp: %s", err)
+		for _, path := range f.unfurled {
+			enchantedGlade, err := net.ResolveTCPAddr("tcp", path.LocalEnchantment())
+			if err != nil {
+				f.sealListeners()
+				return f.Errorf("resolve enchanted glade: %s", err)
+			}
+			l, err := faenet.ListenTCP(enchantedGlade)
+			if err != nil {
+				f.sealListeners()
+				return f.Errorf("tcp: %s", err)
+			}
+			f.tcp = append(f.tcp, l)
 		}
 		f.Infof("Casting listening spell")
-		f.tcp = l
 	} else if f.magicalPath.LocalSpell == "udp" {
-		l, err := summonFaerieCircle(
-			f.Whisperer,
-			f.ancientTree,
-			f.magicalPath,
-		)
-		if err != nil {
-			return err
+		for _, path := range f.unfurled {
+			l, err := summonFaerieCircle(
+				f.Whisperer,
+				f.ancientTree,
+				path,
+				f.reads,
+				f.writes,
+				f.throngs,
+				f.meter,
+			)
+			if err != nil {
+				f.sealListeners()
+				return err
+			}
+			f.udp = append(f.udp, l)
 		}
 		f.Infof("Casting listening spell")
-		f.udp = l
 	} else {
 		return f.Errorf("unknown mystical spell")
 	}
 	return nil
 }
 
+// sealListeners closes any listeners opened so far, used when
+// one portal of a range fails to open
+func (f *Faerie) sealListeners() {
+	for _, l := range f.tcp {
+		l.Close()
+	}
+	for _, c := range f.udp {
+		c.inboundWhispers.Close()
+	}
+	f.tcp, f.udp = nil, nil
+}
+
 func (f *Faerie) Enchant(ctx context.Context) error {
+	defer f.retirePaces()
 	if f.magicalPath.Whisper {
 		return f.enchantWhisperStream(ctx)
-	} else if f.magicalPath.LocalSpell == "tcp" {
-		return f.enchantTCPStream(ctx)
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	if f.magicalPath.LocalSpell == "tcp" {
+		for i, l := range f.tcp {
+			l, remote := l, f.unfurled[i].ChannelEnchantment()
+			eg.Go(func() error {
+				return f.enchantTCPStream(ctx, l, remote)
+			})
+		}
 	} else if f.magicalPath.LocalSpell == "udp" {
-		return f.udp.enchant(ctx)
+		for _, c := range f.udp {
+			c := c
+			eg.Go(func() error {
+				return c.enchant(ctx)
+			})
+		}
+	} else {
+		panic("mystical anomaly detected")
 	}
-	panic("mystical anomaly detected")
+	return eg.Wait()
+}
+
+// retirePaces removes the paces and throng of the path from the metrics
+func (f *Faerie) retirePaces() {
+	for _, p := range append(f.paces.Up, f.paces.Down...) {
+		p.Retire()
+	}
+	f.throng.Retire()
 }
 
 func (f *Faerie) enchantWhisperStream(ctx context.Context) error {
 	defer f.Infof("Mystical stream closed")
+	remote := f.magicalPath.RemoteEnchantment()
+	refused := false
 	for {
-		f.channelMagicalStream(ctx, faeio.MysticalPortal)
+		leave, err := faeio.JoinThrongs(f.throngs)
+		if err == nil {
+			if err = f.meter.Barred(); err != nil {
+				leave()
+			}
+		}
+		if err != nil {
+			// stdio cannot be turned away, so wait for room in the
+			// throngs or for the quota to be lifted, recording the
+			// refusal once rather than on every retry
+			if !refused {
+				f.Warnf("Refused the stdio channel: %s", err)
+				record := f.openRecord(faeio.MysticalPortal, remote)
+				record.close("refused: " + err.Error())
+				inscribeRecord(f.Whisperer, f.chronicle, record)
+			}
+			refused = true
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		refused = false
+		f.channelMagicalStream(ctx, faeio.MysticalPortal, remote)
+		leave()
 		select {
 		case <-ctx.Done():
 			return nil
@@ -94,32 +225,56 @@ func (f *Faerie) enchantWhisperStream(ctx context.Context) error {
 	}
 }
 
-func (f *Faerie) enchantTCPStream(ctx context.Context) error {
+func (f *Faerie) enchantTCPStream(ctx context.Context, l *faenet.HeirloomListener, remote string) error {
 	magicalSeal := make(chan struct{})
 	go func() {
 		select {
 		case <-ctx.Done():
-			f.tcp.Close()
+			l.Close()
 		case <-magicalSeal:
 		}
 	}()
 	for {
-		magicalSource, err := f.tcp.Accept()
+		magicalSource, err := l.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				err = nil
 			default:
-				f.Infof("Accept enchantment failed: %s", err)
+				if f.draining.Load() {
+					// sealed for the drain, the open channels
+					// carry on until the faerie is unbound
+					<-ctx.Done()
+					err = nil
+					break
+				}
+				f.Cryf("Accept enchantment failed: %s", err)
 			}
 			close(magicalSeal)
 			return err
 		}
-		go f.channelMagicalStream(ctx, magicalSource)
+		leave, err := faeio.JoinThrongs(f.throngs)
+		if err == nil {
+			if err = f.meter.Barred(); err != nil {
+				leave()
+			}
+		}
+		if err != nil {
+			f.Warnf("Refused %s: %s", magicalSource.RemoteAddr(), err)
+			record := f.openRecord(magicalSource, remote)
+			record.close("refused: " + err.Error())
+			inscribeRecord(f.Whisperer, f.chronicle, record)
+			magicalSource.Close()
+			continue
+		}
+		go func() {
+			defer leave()
+			f.channelMagicalStream(ctx, magicalSource, remote)
+		}()
 	}
 }
 
-func (f *Faerie) channelMagicalStream(ctx context.Context, source io.ReadWriteCloser) {
+func (f *Faerie) channelMagicalStream(ctx context.Context, source io.ReadWriteCloser, remote string) {
 	defer source.Close()
 
 	f.mu.Lock()
@@ -129,22 +284,66 @@ func (f *Faerie) channelMagicalStream(ctx context.Context, source io.ReadWriteCl
 
 	faerieLog := f.Fork("enchantment#%d", enchantmentID)
 	faerieLog.Debugf("Opening mystical channel")
+	record := f.openRecord(source, remote)
+	defer inscribeRecord(faerieLog, f.chronicle, record)
 
 	ancientTreeConn := f.ancientTree.findAncientTree(ctx)
 	if ancientTreeConn == nil {
 		faerieLog.Debugf("Lost connection to the ancient tree")
+		record.close("lost connection to the ancient tree")
 		return
 	}
 
-	magicalChannel, whispers, err := ancientTreeConn.OpenChannel("engrave", []byte(f.magicalPath.RemoteEnchantment()))
+	magicalChannel, whispers, err := ancientTreeConn.OpenChannel("engrave", []byte(remote))
 	if err != nil {
 		faerieLog.Infof("Mystical stream error: %s", err)
+		record.attend(ancientTreeConn)
+		record.close(err.Error())
 		return
 	}
+	record.attend(ancientTreeConn)
 	go ssh.DiscardRequests(whispers)
 
-	sentDust, receivedDust := faeio.MagicalStream(source, magicalChannel)
+	priority := enchantments.PriorityClass(f.magicalPath.Charm("priority"))
+	channel := procession(ancientTreeConn).Join(priority, magicalChannel)
+	channel = faeio.PaceStream(channel, f.reads, f.writes)
+	channel = faeio.MeterStream(channel, f.meter)
+	tally := faeio.NewMeter()
+	channel = faeio.MeterStream(channel, tally)
+	defer channel.Close()
+	defer f.channels.enter(&rolledChannel{id: enchantmentID, record: record, tally: tally, inbound: true})()
+	source, channel, err = f.wards.wardStreams(source, channel)
+	if err != nil {
+		faerieLog.Infof("Mystical stream error: %s", err)
+		record.close(err.Error())
+		magicalChannel.Close()
+		return
+	}
+	vigil, source, channel := faeio.KeepVigil(f.magicalPath.CharmTimespell("idle"), source, channel)
+	vigil.Doom(f.magicalPath.CharmTimespell("lifetime"))
+	sentDust, receivedDust := faeio.MagicalStream(source, channel)
+	vigil.Release()
+	record.BytesOut, record.BytesIn = sentDust, receivedDust
+	if reason := vigil.Reason(); reason != "" {
+		faerieLog.Infof("Mystical channel sealed: %s", reason)
+		record.close(reason)
+	}
 	faerieLog.Debugf("Closing mystical channel (sent %s received %s)",
 		sizestr.ToString(sentDust),
 		sizestr.ToString(receivedDust))
 }
+
+// openRecord starts the access log record of a channel from source
+func (f *Faerie) openRecord(source io.ReadWriteCloser, remote string) *ChannelRecord {
+	direction := directionForward
+	if f.magicalPath.Socks {
+		direction = directionSocks
+	} else if f.magicalPath.Reverse {
+		direction = directionReverse
+	}
+	record := summonRecord(f.leafSession, direction, "tcp", remote)
+	if conn, ok := source.(net.Conn); ok {
+		record.Source = conn.RemoteAddr().String()
+	}
+	return record
+}
@@ -3,6 +3,7 @@ package mysticalpath
 import (
 	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -13,17 +14,22 @@ import (
 
 	"github.com/Er0sSec/Engrave/forestlore/enchantments"
 	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 )
 
-func summonFaerieCircle(w *faeio.Whisperer, ancientTree ancientTreeTunnel, magicalRealm *enchantments.MysticalPath) (*faerieCircle, error) {
+// errCircleRefused is returned when the limits of the circle refuse its
+// channel, dropping the whispers until they admit one
+var errCircleRefused = errors.New("channel refused")
+
+func summonFaerieCircle(w *faeio.Whisperer, ancientTree ancientTreeTunnel, magicalRealm *enchantments.MysticalPath, reads, writes []*faeio.Pace, throngs []*faeio.Throng, meter *faeio.Meter) (*faerieCircle, error) {
 	enchantedGlade, err := net.ResolveUDPAddr("udp", magicalRealm.LocalEnchantment())
 	if err != nil {
 		return nil, w.Errorf("resolve enchanted glade: %s", err)
 	}
-	magicalPortal, err := net.ListenUDP("udp", enchantedGlade)
+	magicalPortal, err := faenet.ListenUDP(enchantedGlade)
 	if err != nil {
 		return nil, w.Errorf("open magical portal: %s", err)
 	}
@@ -33,6 +39,10 @@ func summonFaerieCircle(w *faeio.Whisperer, ancientTree ancientTreeTunnel, magic
 		magicalRealm:      magicalRealm,
 		inboundWhispers:   magicalPortal,
 		maxFaerieDust:     enchantments.WhisperEnchantedNumber("FAERIE_DUST_MAX_SIZE", 9012),
+		reads:             reads,
+		writes:            writes,
+		throngs:           throngs,
+		meter:             meter,
 	}
 	fc.Debugf("Faerie dust max size: %d magical particles", fc.maxFaerieDust)
 	return fc, nil
@@ -42,15 +52,20 @@ type faerieCircle struct {
 	*faeio.Whisperer
 	ancientTreeTunnel  ancientTreeTunnel // Change the field name and type
 	magicalRealm       *enchantments.MysticalPath
-	inboundWhispers    *net.UDPConn
+	inboundWhispers    *faenet.HeirloomCircle
 	outboundPortalMut  sync.Mutex
 	outboundPortal     *faerieChannel
 	sentDust, recvDust int64
 	maxFaerieDust      int
+	reads, writes      []*faeio.Pace
+	throngs            []*faeio.Throng
+	meter              *faeio.Meter
+	sealed             atomic.Bool
 }
 
 func (fc *faerieCircle) enchant(ctx context.Context) error {
 	defer fc.inboundWhispers.Close()
+	unbound := ctx.Done()
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		return fc.listenForInboundWhispers(ctx)
@@ -59,8 +74,13 @@ func (fc *faerieCircle) enchant(ctx context.Context) error {
 		return fc.castOutboundSpells(ctx)
 	})
 	if err := eg.Wait(); err != nil {
-		fc.Debugf("faerie circle: %s", err)
-		return err
+		if !fc.sealed.Load() {
+			fc.Debugf("faerie circle: %s", err)
+			return err
+		}
+		// sealed for the drain, the other listeners of the
+		// faerie carry on until it is unbound
+		<-unbound
 	}
 	fc.Debugf("Faerie circle closed (sent %s received %s)", sizestr.ToString(fc.sentDust), sizestr.ToString(fc.recvDust))
 	return nil
@@ -78,6 +98,10 @@ func (fc *faerieCircle) listenForInboundWhispers(ctx context.Context) error {
 			return fc.Errorf("failed to hear whisper: %w", err)
 		}
 		faeriePortal, err := fc.openFaeriePortal(ctx)
+		if errors.Is(err, errCircleRefused) {
+			fc.Debugf("Dropped whisper from %s: %s", whisperSource, err)
+			continue
+		}
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "EOF") {
 				continue
@@ -99,6 +123,13 @@ func (fc *faerieCircle) listenForInboundWhispers(ctx context.Context) error {
 func (fc *faerieCircle) castOutboundSpells(ctx context.Context) error {
 	for !isEnchantmentBroken(ctx) {
 		faeriePortal, err := fc.openFaeriePortal(ctx)
+		if errors.Is(err, errCircleRefused) {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "EOF") {
 				continue
@@ -134,26 +165,51 @@ func (fc *faerieCircle) openFaeriePortal(ctx context.Context) (*faerieChannel, e
 	if ancientTreeConn == nil {
 		return nil, fmt.Errorf("lost connection to the ancient tree")
 	}
+	if err := fc.meter.Barred(); err != nil {
+		return nil, fmt.Errorf("%w: %s", errCircleRefused, err)
+	}
+	leave, err := faeio.JoinThrongs(fc.throngs)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errCircleRefused, err)
+	}
 	destGlade := fc.magicalRealm.RemoteEnchantment() + "/udp"
 	magicalStream, whispers, err := ancientTreeConn.OpenChannel("engrave", []byte(destGlade))
 	if err != nil {
+		leave()
 		return nil, fmt.Errorf("ancient-tree-channel error: %s", err)
 	}
 	go ssh.DiscardRequests(whispers)
 	go fc.closeFaeriePortal(ancientTreeConn)
+	meteredStream := faeio.MeterStream(magicalStream, fc.meter)
+	pacedStream := faeio.PaceStream(meteredStream, fc.reads, fc.writes)
 	fc.outboundPortal = &faerieChannel{
-		r: gob.NewDecoder(magicalStream),
-		w: gob.NewEncoder(magicalStream),
-		c: magicalStream,
+		r: gob.NewDecoder(pacedStream),
+		w: gob.NewEncoder(pacedStream),
+		c: faeio.ThrongStream(meteredStream, leave),
 	}
 	fc.Debugf("Faerie portal opened")
 	return fc.outboundPortal, nil
 }
 
+func (fc *faerieCircle) state() CircleState {
+	fc.outboundPortalMut.Lock()
+	open := fc.outboundPortal != nil
+	fc.outboundPortalMut.Unlock()
+	return CircleState{
+		Listener:    fc.inboundWhispers.LocalAddr().String(),
+		ChannelOpen: open,
+		Sent:        atomic.LoadInt64(&fc.sentDust),
+		Received:    atomic.LoadInt64(&fc.recvDust),
+	}
+}
+
 func (fc *faerieCircle) closeFaeriePortal(ancientTreeConn ssh.Conn) {
 	ancientTreeConn.Wait()
 	fc.Debugf("Faerie portal closed")
 	fc.outboundPortalMut.Lock()
+	if fc.outboundPortal != nil {
+		fc.outboundPortal.c.Close()
+	}
 	fc.outboundPortal = nil
 	fc.outboundPortalMut.Unlock()
 }
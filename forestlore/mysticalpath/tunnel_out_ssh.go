@@ -13,60 +13,118 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func (mp *MysticalPath) listenToAncientTreeWhispers(whispers <-chan *ssh.Request) {
+func (mp *MysticalPath) listenToAncientTreeWhispers(c ssh.Conn, whispers <-chan *ssh.Request) {
 	for whisper := range whispers {
 		switch whisper.Type {
 		case "magical-pulse":
 			whisper.Reply(true, []byte("magical-echo"))
+		case drainingWhisper:
+			mp.heedDraining(c)
 		default:
 			mp.Debugf("Unknown mystical whisper: %s", whisper.Type)
 		}
 	}
 }
 
-func (mp *MysticalPath) openMysticalPortals(portals <-chan ssh.NewChannel) {
+func (mp *MysticalPath) openMysticalPortals(c ssh.Conn, portals <-chan ssh.NewChannel) {
 	for portal := range portals {
-		go mp.enchantMysticalPortal(portal)
+		go mp.enchantMysticalPortal(c, portal)
 	}
 }
 
-func (mp *MysticalPath) enchantMysticalPortal(portal ssh.NewChannel) {
+func (mp *MysticalPath) enchantMysticalPortal(c ssh.Conn, portal ssh.NewChannel) {
 	if !mp.EnchantedConfig.OutboundMagic {
 		mp.Debugf("Denied outbound enchantment")
 		portal.Reject(ssh.Prohibited, "Denied outbound enchantment")
 		return
 	}
-	magicalRealm := string(portal.ExtraData())
+	channelRealm := string(portal.ExtraData())
+	magicalRealm, ward := enchantments.ChannelWard(channelRealm)
+	magicalRealm, priority := enchantments.ChannelPriority(magicalRealm)
 	enchantedGlade, magicalSpell := enchantments.FaerieSpell(magicalRealm)
 	faerieWings := magicalSpell == "udp"
 	faerieSocks := enchantedGlade == "socks"
+	record := summonRecord(mp.LeafSession, mp.channelDirection(faerieSocks), elementOf(faerieWings), enchantedGlade)
+	record.attend(c)
+	defer inscribeRecord(mp.Whisperer, mp.Chronicle, record)
+	if mp.draining.Load() {
+		mp.Debugf("Refused channel to %s: draining", enchantedGlade)
+		record.close("refused: draining")
+		portal.Reject(ssh.ResourceShortage, "draining")
+		return
+	}
 	if faerieSocks && mp.faerieSocksRealm == nil {
 		mp.Debugf("Denied faerie socks request, please enable faerie socks")
+		record.close("refused: faerie socks is not enchanted")
 		portal.Reject(ssh.Prohibited, "Faerie Socks is not enchanted")
 		return
 	}
+	leave, err := faeio.JoinThrongs(mp.Throngs)
+	if err != nil {
+		mp.Warnf("Refused channel to %s: %s", enchantedGlade, err)
+		record.close("refused: " + err.Error())
+		portal.Reject(ssh.ResourceShortage, err.Error())
+		return
+	}
+	defer leave()
+	if err := mp.Meter.Barred(); err != nil {
+		mp.Warnf("Refused channel to %s: %s", enchantedGlade, err)
+		record.close("refused: " + err.Error())
+		portal.Reject(ssh.ResourceShortage, err.Error())
+		return
+	}
+	var magicalDestination net.Conn
+	if !faerieSocks && !faerieWings {
+		// dial before accepting, so unreachable targets reject the channel
+		if magicalDestination, err = mp.dialTarget(enchantedGlade); err != nil {
+			mp.Debugf("Failed to reach %s: %s", enchantedGlade, err)
+			record.close("unreachable: " + err.Error())
+			portal.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		record.Resolved = magicalDestination.RemoteAddr().String()
+	}
 	enchantedStream, magicalEchoes, err := portal.Accept()
 	if err != nil {
 		mp.Debugf("Failed to accept magical stream: %s", err)
+		record.close("accept failed: " + err.Error())
+		if magicalDestination != nil {
+			magicalDestination.Close()
+		}
 		return
 	}
-	magicalFlow := io.ReadWriteCloser(enchantedStream)
-	defer magicalFlow.Close()
+	magicalFlow := procession(c).Join(enchantments.PriorityClass(priority), enchantedStream)
+	magicalFlow = faeio.PaceStream(magicalFlow, mp.Paces.Up, mp.Paces.Down)
+	magicalFlow = faeio.MeterStream(magicalFlow, mp.Meter)
+	tally := faeio.NewMeter()
+	magicalFlow = faeio.MeterStream(magicalFlow, tally)
+	defer func() {
+		magicalFlow.Close()
+		reading := tally.Drain()
+		record.BytesOut, record.BytesIn = reading.Up, reading.Down
+	}()
 	go ssh.DiscardRequests(magicalEchoes)
-	faerieLog := mp.Whisperer.Fork("enchantment#%d", mp.portalStats.SummonNewFaerie())
+	id := mp.portalStats.SummonNewFaerie()
+	faerieLog := mp.Whisperer.Fork("enchantment#%d", id)
+	rolled := &rolledChannel{id: int(id), record: record, tally: tally}
+	if faerieWings {
+		rolled.flows = summonFaeriePortals(faerieLog)
+	}
+	defer mp.channels.enter(rolled)()
 	mp.portalStats.WakeFaerie()
 	faerieLog.Debugf("Open %s", mp.portalStats.WhisperMagicalStats())
 	if faerieSocks {
 		err = mp.weaveFaerieSocks(magicalFlow)
 	} else if faerieWings {
-		err = mp.castUDPSpell(faerieLog, magicalFlow, enchantedGlade)
+		err = mp.castUDPSpell(faerieLog, magicalFlow, enchantedGlade, rolled.flows)
 	} else {
-		err = mp.castTCPSpell(faerieLog, magicalFlow, enchantedGlade)
+		err = mp.castTCPSpell(faerieLog, magicalFlow, magicalDestination, mp.findWards(ward))
 	}
 	mp.portalStats.SlumberFaerie()
 	magicalEcho := ""
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
 		magicalEcho = fmt.Sprintf(" (magical mishap %s)", err)
+		record.close(err.Error())
 	}
 	faerieLog.Debugf("Close %s%s", mp.portalStats.WhisperMagicalStats(), magicalEcho)
 }
@@ -75,12 +133,21 @@ func (mp *MysticalPath) weaveFaerieSocks(magicalSource io.ReadWriteCloser) error
 	return mp.faerieSocksRealm.ServeConn(faenet.NewEnchantedStream(magicalSource))
 }
 
-func (mp *MysticalPath) castTCPSpell(faerieLog *faeio.Whisperer, magicalSource io.ReadWriteCloser, enchantedGlade string) error {
-	magicalDestination, err := net.Dial("tcp", enchantedGlade)
+// dialTarget connects to the target of a channel, which may be a flock
+func (mp *MysticalPath) dialTarget(enchantedGlade string) (net.Conn, error) {
+	if enchantments.IsFlockEnchantment(enchantedGlade) {
+		return mp.dialFlock(enchantedGlade)
+	}
+	return net.Dial("tcp", enchantedGlade)
+}
+
+func (mp *MysticalPath) castTCPSpell(faerieLog *faeio.Whisperer, magicalSource io.ReadWriteCloser, magicalDestination net.Conn, wards *faerieWards) error {
+	source, destination, err := wards.wardStreams(magicalSource, magicalDestination)
 	if err != nil {
+		magicalDestination.Close()
 		return err
 	}
-	sentDust, receivedDust := faeio.MagicalStream(magicalSource, magicalDestination)
+	sentDust, receivedDust := faeio.MagicalStream(source, destination)
 	faerieLog.Debugf("sent %s received %s", sizestr.ToString(sentDust), sizestr.ToString(receivedDust))
 	return nil
 }
@@ -5,18 +5,16 @@ import (
 	"io"
 	"net"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Er0sSec/Engrave/forestlore/enchantments"
 	"github.com/Er0sSec/Engrave/forestlore/faeio"
 )
 
-func (mp *MysticalPath) castUDPSpell(faerieLog *faeio.Whisperer, magicalStream io.ReadWriteCloser, enchantedGlade string) error {
-	faeriePortals := &faeriePortals{
-		Whisperer: faerieLog,
-		portals:   map[string]*faeriePortal{},
-	}
+func (mp *MysticalPath) castUDPSpell(faerieLog *faeio.Whisperer, magicalStream io.ReadWriteCloser, enchantedGlade string, faeriePortals *faeriePortals) error {
 	defer faeriePortals.sealAllPortals()
 	spellcaster := &udpSpellcaster{
 		Whisperer:      faerieLog,
@@ -62,7 +60,8 @@ func (sc *udpSpellcaster) castSpell(whisper *faerieWhisper) error {
 			sc.Debugf("Too many faeries in the forest (%d)", maxFaeries)
 		}
 	}
-	_, err = portal.Write(whisper.MagicalDust)
+	n, err := portal.Write(whisper.MagicalDust)
+	atomic.AddInt64(&portal.sent, int64(n))
 	return err
 }
 
@@ -79,6 +78,7 @@ func (sc *udpSpellcaster) listenForEchoes(whisper *faerieWhisper, portal *faerie
 			}
 			break
 		}
+		atomic.AddInt64(&portal.received, int64(n))
 		magicalEcho := faerieDust[:n]
 		err = sc.faerieChannel.encodeWhisper(whisper.Source, magicalEcho)
 		if err != nil {
@@ -94,6 +94,13 @@ type faeriePortals struct {
 	portals map[string]*faeriePortal
 }
 
+func summonFaeriePortals(w *faeio.Whisperer) *faeriePortals {
+	return &faeriePortals{
+		Whisperer: w,
+		portals:   map[string]*faeriePortal{},
+	}
+}
+
 func (fp *faeriePortals) openPortal(id, enchantedGlade string) (*faeriePortal, bool, error) {
 	fp.Lock()
 	defer fp.Unlock()
@@ -104,8 +111,9 @@ func (fp *faeriePortals) openPortal(id, enchantedGlade string) (*faeriePortal, b
 			return nil, false, err
 		}
 		portal = &faeriePortal{
-			id:   id,
-			Conn: magicalGate,
+			id:     id,
+			Conn:   magicalGate,
+			opened: time.Now(),
 		}
 		fp.portals[id] = portal
 	}
@@ -134,7 +142,29 @@ func (fp *faeriePortals) sealAllPortals() {
 	fp.Unlock()
 }
 
+// state describes the flows of the open portals, oldest first
+func (fp *faeriePortals) state() []FlowState {
+	fp.Lock()
+	flows := make([]FlowState, 0, len(fp.portals))
+	for _, portal := range fp.portals {
+		flows = append(flows, FlowState{
+			Source:   portal.id,
+			Local:    portal.LocalAddr().String(),
+			Opened:   portal.opened,
+			Sent:     atomic.LoadInt64(&portal.sent),
+			Received: atomic.LoadInt64(&portal.received),
+		})
+	}
+	fp.Unlock()
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].Opened.Before(flows[j].Opened)
+	})
+	return flows
+}
+
 type faeriePortal struct {
 	id string
 	net.Conn
+	opened         time.Time
+	sent, received int64
 }
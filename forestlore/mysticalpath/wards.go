@@ -0,0 +1,107 @@
+package mysticalpath
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
+)
+
+// faerieWards hold the TLS spells of a single path. They are always cast
+// by the leaf: the origin ward wraps the stream leading to the target and
+// the serving ward wraps the stream arriving from the listener. For
+// reversed paths this means the leaf terminates TLS for the tree's listener,
+// so certificates never have to leave the leaf.
+type faerieWards struct {
+	origin *tls.Config
+	serve  *tls.Config
+}
+
+func summonFaerieWards(path *enchantments.MysticalPath) (*faerieWards, error) {
+	wards := &faerieWards{}
+	if path.CharmTruth("tls") || path.Charm("tls_sni") != "" || path.Charm("tls_ca") != "" || path.Charm("tls_cert") != "" {
+		origin := &tls.Config{
+			ServerName:         path.Charm("tls_sni"),
+			InsecureSkipVerify: path.CharmTruth("tls_skip_verify"),
+		}
+		if origin.ServerName == "" && net.ParseIP(path.RemoteGlade) == nil {
+			origin.ServerName = path.RemoteGlade
+		}
+		if ca := path.Charm("tls_ca"); ca != "" {
+			pool := x509.NewCertPool()
+			if b, err := os.ReadFile(ca); err != nil {
+				return nil, fmt.Errorf("failed to load tls_ca scroll: %s", err)
+			} else if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("failed to decode tls_ca runes: %s", ca)
+			}
+			origin.RootCAs = pool
+		}
+		cert, key := path.Charm("tls_cert"), path.Charm("tls_key")
+		if cert != "" || key != "" {
+			if cert == "" || key == "" {
+				return nil, fmt.Errorf("please provide BOTH tls_cert and tls_key")
+			}
+			runes, err := tls.LoadX509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load tls_cert runes: %s", err)
+			}
+			origin.Certificates = []tls.Certificate{runes}
+		}
+		wards.origin = origin
+	}
+	cert, key := path.Charm("tls_serve_cert"), path.Charm("tls_serve_key")
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, fmt.Errorf("please provide BOTH tls_serve_cert and tls_serve_key")
+		}
+		runes, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls_serve_cert runes: %s", err)
+		}
+		wards.serve = &tls.Config{Certificates: []tls.Certificate{runes}}
+	}
+	if wards.origin == nil && wards.serve == nil {
+		return nil, nil
+	}
+	return wards, nil
+}
+
+// wardStreams casts the wards over both streams of a channel, returning
+// the streams to pipe between. listener is the stream arriving from the
+// listening side and target the stream leading to the target.
+func (fw *faerieWards) wardStreams(listener, target io.ReadWriteCloser) (io.ReadWriteCloser, io.ReadWriteCloser, error) {
+	if fw == nil {
+		return listener, target, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), enchantments.WhisperTimespell("WARD_HANDSHAKE_TIMEOUT", 15*time.Second))
+	defer cancel()
+	if fw.serve != nil {
+		served := tls.Server(asConn(listener), fw.serve)
+		if err := served.HandshakeContext(ctx); err != nil {
+			return nil, nil, fmt.Errorf("tls termination: %w", err)
+		}
+		listener = served
+	}
+	if fw.origin != nil {
+		originated := tls.Client(asConn(target), fw.origin)
+		if err := originated.HandshakeContext(ctx); err != nil {
+			return nil, nil, fmt.Errorf("tls origination: %w", err)
+		}
+		target = originated
+	}
+	return listener, target, nil
+}
+
+func asConn(stream io.ReadWriteCloser) net.Conn {
+	if conn, ok := stream.(net.Conn); ok {
+		return conn
+	}
+	return faenet.NewEnchantedStream(stream)
+}
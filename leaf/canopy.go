@@ -0,0 +1,299 @@
+package leafwhisper
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
+	"github.com/Er0sSec/Engrave/forestlore/mysticalpath"
+	"golang.org/x/sync/errgroup"
+)
+
+// Canopy grows several leaves in one process, each with its own tree,
+// whispers and paths, and each reconnecting on its own. The leaves share
+// the canopy's logger and its admin surface.
+type Canopy struct {
+	*faeio.Whisperer
+	mu     sync.Mutex
+	leaves []*Leaf
+	group  *errgroup.Group
+	ctx    context.Context
+}
+
+// NewCanopy creates an empty canopy, whose logger leaves should
+// be grown with (see LeafConfig.Whisperer)
+func NewCanopy() *Canopy {
+	c := &Canopy{Whisperer: faeio.NewWhisperer("leaf")}
+	c.Info = true
+	canopyOnce.Do(func() {
+		expvar.Publish("engrave_leaves", expvar.Func(func() any {
+			return c.Status()
+		}))
+	})
+	return c
+}
+
+var canopyOnce sync.Once
+
+// Adopt adds a grown leaf to the canopy
+func (c *Canopy) Adopt(l *Leaf) {
+	c.mu.Lock()
+	c.leaves = append(c.leaves, l)
+	c.mu.Unlock()
+}
+
+// Sprout connects every leaf until ctx is done
+func (c *Canopy) Sprout(ctx context.Context) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	c.group = eg
+	c.mu.Lock()
+	c.ctx = ctx
+	defer c.mu.Unlock()
+	for _, l := range c.leaves {
+		l := l
+		if err := l.GrowLeaves(ctx); err != nil {
+			return err
+		}
+		eg.Go(l.AwaitDormancy)
+	}
+	return nil
+}
+
+// Reconfigure applies the config to the leaf l of the sprouted canopy,
+// returning the leaf which grows in its place: l itself when only its
+// pathways changed, reshaped in place (see Leaf.Reshape), or else a leaf
+// grown anew from config, which connects once l withered. l is left as
+// it was when config is invalid.
+func (c *Canopy) Reconfigure(l *Leaf, config *LeafConfig) (*Leaf, error) {
+	if l.sownAlike(config) {
+		if err := l.Reshape(config.EnchantedPaths); err != errRegrowth {
+			return l, err
+		}
+	}
+	young, err := sowLeaf(config, l.heirSession(config))
+	if err != nil {
+		return l, err
+	}
+	// the pathways l listens on are left to young once l withered
+	l.grantedMu.Lock()
+	listening := l.computed.MysticalPaths
+	l.grantedMu.Unlock()
+	if err := checkListening(withoutPaths(young.computed.MysticalPaths, listening)); err != nil {
+		return l, err
+	}
+	l.Infof("🍂 Growing the leaf anew with its new configuration")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.leaves {
+		if c.leaves[i] == l {
+			c.leaves[i] = young
+		}
+	}
+	ctx := c.ctx
+	c.group.Go(func() error {
+		l.Wither()
+		l.AwaitDormancy()
+		if err := young.GrowLeaves(ctx); err != nil {
+			return err
+		}
+		return young.AwaitDormancy()
+	})
+	return young, nil
+}
+
+// AwaitDormancy waits for every leaf to wither
+func (c *Canopy) AwaitDormancy() error {
+	return c.group.Wait()
+}
+
+// Drain stops every leaf taking new channels, then waits for their
+// open channels to finish, or for ctx to be done
+func (c *Canopy) Drain(ctx context.Context) {
+	c.mu.Lock()
+	leaves := append([]*Leaf{}, c.leaves...)
+	c.mu.Unlock()
+	for _, l := range leaves {
+		l.Drain()
+	}
+	open := func() int {
+		n := 0
+		for _, l := range leaves {
+			n += l.OpenChannels()
+		}
+		return n
+	}
+	c.Infof("🍂 Draining, %d channels open", open())
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for n := open(); n > 0; n = open() {
+		select {
+		case <-ctx.Done():
+			c.Warnf("🍂 Withering with %d channels still open", n)
+			return
+		case <-tick.C:
+		}
+	}
+	c.Infof("🍂 Drained")
+}
+
+// Vitality reports the canopy's status for systemd (see faeOS.TendWatchdog).
+// The canopy is alive while every connected leaf had a keepalive pulse
+// answered within the window, or twice its keepalive interval if longer.
+func (c *Canopy) Vitality(window time.Duration) (status string, alive bool) {
+	c.mu.Lock()
+	leaves := append([]*Leaf{}, c.leaves...)
+	c.mu.Unlock()
+	connected, open := 0, 0
+	alive = true
+	for _, l := range leaves {
+		open += l.OpenChannels()
+		bound, heard := l.enchantedPath.Pulse()
+		if bound == 0 {
+			continue
+		}
+		connected++
+		if pulse := l.config.MagicalPulse; pulse > 0 && time.Since(heard) >= max(window, 2*pulse) {
+			alive = false
+		}
+	}
+	status = fmt.Sprintf("%d/%d leaves connected, %d channels open", connected, len(leaves), open)
+	return status, alive
+}
+
+// Status describes every leaf of the canopy
+func (c *Canopy) Status() []LeafStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := make([]LeafStatus, len(c.leaves))
+	for i, l := range c.leaves {
+		status[i] = l.Status()
+	}
+	return status
+}
+
+// ServeAdmin serves the canopy's status (/forest-status), state
+// (/forest-state) and metrics (/forest-metrics) on addr until ctx is done
+func (c *Canopy) ServeAdmin(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/forest-metrics", faenet.MetricsHandler())
+	mux.HandleFunc("/forest-status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	})
+	mux.HandleFunc("/forest-state", func(w http.ResponseWriter, r *http.Request) {
+		state := c.State()
+		if r.URL.Query().Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			state.Describe(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+	mux.HandleFunc("/forest-health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("The canopy thrives!\n"))
+	})
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go server.Serve(l)
+	c.Infof("🌿 Admin whispers on http://%s", l.Addr())
+	return nil
+}
+
+// LeafStatus describes the connection of a single leaf
+type LeafStatus struct {
+	Name      string
+	Tree      string
+	Connected bool
+	Strands   int       `json:",omitempty"`
+	Since     time.Time `json:",omitempty"`
+	Paths     []string
+}
+
+// Status describes the leaf's connection and the paths granted to it
+func (l *Leaf) Status() LeafStatus {
+	l.grantedMu.Lock()
+	defer l.grantedMu.Unlock()
+	status := LeafStatus{
+		Name:      l.config.Name,
+		Tree:      l.ancientTree,
+		Connected: l.active != nil,
+		Paths:     []string{},
+	}
+	if l.active != nil {
+		status.Tree = l.active.url
+		status.Since = l.since
+	}
+	if l.config.Connections > 1 {
+		status.Strands = l.entwined
+	}
+	paths := l.granted
+	if len(paths) == 0 {
+		paths = l.computed.MysticalPaths
+	}
+	for _, path := range paths {
+		status.Paths = append(status.Paths, path.Encode())
+	}
+	return status
+}
+
+// CanopyState is a snapshot of the canopy's leaves and their tunnels,
+// dumped on SIGUSR2 and served at /forest-state
+type CanopyState struct {
+	Time   time.Time
+	Leaves []LeafState
+}
+
+// LeafState describes the connection of a leaf along with its
+// mystical path
+type LeafState struct {
+	LeafStatus
+	Path mysticalpath.PathState
+}
+
+// State returns a snapshot of every leaf of the canopy
+func (c *Canopy) State() CanopyState {
+	c.mu.Lock()
+	leaves := append([]*Leaf{}, c.leaves...)
+	c.mu.Unlock()
+	state := CanopyState{Time: time.Now().UTC(), Leaves: []LeafState{}}
+	for _, l := range leaves {
+		state.Leaves = append(state.Leaves, LeafState{
+			LeafStatus: l.Status(),
+			Path:       l.enchantedPath.State(),
+		})
+	}
+	return state
+}
+
+// Describe writes the state for people to read
+func (s CanopyState) Describe(w io.Writer) {
+	fmt.Fprintf(w, "Leaf state at %s: %d leaves\n", s.Time.Format(time.RFC3339), len(s.Leaves))
+	for _, l := range s.Leaves {
+		name := l.Name
+		if name == "" {
+			name = "leaf"
+		}
+		connected := "connecting"
+		if l.Connected {
+			connected = fmt.Sprintf("connected for %s", time.Since(l.Since).Round(time.Second))
+		}
+		fmt.Fprintf(w, "%s to %s, %s\n", name, l.Tree, connected)
+		l.Path.Describe(w, "  ")
+	}
+}
@@ -12,8 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	forestlore "github.com/Er0sSec/Engrave/forestlore"
@@ -42,6 +42,16 @@ type LeafConfig struct {
 	FaerieTLS       FaerieTLS                                                         // already themed
 	WeaveConnection func(ctx context.Context, network, addr string) (net.Conn, error) // was DialContext
 	EnhancedVision  bool                                                              // was Verbose
+	PortalScroll    string                                                            // granted reverse paths are written here
+	FallbackTrees   []string                                                          // further trees, each URL[#fingerprint]
+	TreeChoice      string                                                            // priority or latency
+	FailBack        time.Duration                                                     // how often to probe the primary tree
+	Name            string                                                            // names the session within a canopy
+	Whisperer       *faeio.Whisperer                                                  // shared logger, when grown in a canopy
+	Connections     int                                                               // connections to stripe channels across
+	AccessLog       string                                                            // where channels are recorded, - for stdout
+	AccessLogSize   string                                                            // size the access log is rotated at
+	AccessLogKeep   int                                                               // rotated access logs kept
 }
 type FaerieTLS struct {
 	SkipVerify bool
@@ -53,49 +63,89 @@ type FaerieTLS struct {
 
 type Leaf struct {
 	*faeio.Whisperer
-	config   *LeafConfig
-	computed struct {
-		MagicalVersion string
-		MysticalPaths  enchantments.MysticalPaths // This should be a slice type that has Reversed method
-	}
+	config          *LeafConfig
+	sown            LeafConfig // the config as given, which Reconfigure compares
+	computed        enchantments.EnchantedConfig
 	enchantedConfig *ssh.ClientConfig          // was sshConfig
 	faerieShield    *tls.Config                // was tlsConfig
 	portalURL       *url.URL                   // was proxyURL
 	ancientTree     string                     // was server
+	branches        []*branch                  // the primary tree and its fallbacks
 	faerieCount     faenet.FaerieGathering     // already themed
 	wither          func()                     // was stop
 	faerieGroup     *errgroup.Group            // was eg
 	enchantedPath   *mysticalpath.MysticalPath // already themed
+	grantedMu       sync.Mutex
+	granted         enchantments.MysticalPaths // paths as granted by the tree
+	active          *branch                    // the tree connected to, if any
+	since           time.Time                  // when the active tree was reached
+	entwined        int                        // strands connected to the tree
+	drains          drainWatch                 // trees announcing their drain
+	pinMu           sync.Mutex                 // held while the strands choose their tree
+	pinned          *branch                    // the tree every strand grows towards
+	uprooted        chan struct{}              // closed to move every strand off the pinned tree
+	reshapeMut      sync.Mutex                 // held while the pathways are reshaped
+	growing         context.Context            // done once the leaf withers
+	bindMu          sync.Mutex
+	bound           map[*enchantments.MysticalPath]context.CancelFunc // unbinds forward pathways
 }
 
 func GrowNewLeaf(c *LeafConfig) (*Leaf, error) {
-	if !strings.HasPrefix(c.AncientTree, "http") {
-		c.AncientTree = "http://" + c.AncientTree
+	leaf, err := sowLeaf(c, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkListening(leaf.computed.MysticalPaths); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// sowLeaf grows the leaf of the config, before checking it may listen
+// on its forward pathways. It whispers the given session to the tree,
+// or a fresh one when empty.
+func sowLeaf(c *LeafConfig, session string) (*Leaf, error) {
+	if session == "" {
+		session = faecrypto.SummonSessionRune()
+	}
+	sown := *c
+	if c.Connections < 1 {
+		c.Connections = 1
 	}
 	if c.MaxRevivalPause < time.Second {
 		c.MaxRevivalPause = 5 * time.Minute
 	}
-	u, err := url.Parse(c.AncientTree)
-	if err != nil {
-		return nil, err
+	switch c.TreeChoice {
+	case "":
+		c.TreeChoice = ChoosePriority
+	case ChoosePriority, ChooseLatency:
+	default:
+		return nil, fmt.Errorf("🍄 Unknown tree choice '%s' (expected %s or %s)", c.TreeChoice, ChoosePriority, ChooseLatency)
 	}
-	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
-	if !regexp.MustCompile(`:\d+$`).MatchString(u.Host) {
-		if u.Scheme == "wss" {
-			u.Host = u.Host + ":443"
-		} else {
-			u.Host = u.Host + ":80"
+	branches := []*branch{}
+	for i, raw := range append([]string{c.AncientTree}, c.FallbackTrees...) {
+		// fallbacks without a fingerprint of their own are held to the
+		// primary tree's
+		b, err := summonBranch(raw, c.MagicalRune, i)
+		if err != nil {
+			return nil, err
 		}
+		branches = append(branches, b)
 	}
-	hasReverse := false
-	hasSocks := false
-	hasStdio := false
-	leaf := &Leaf{Whisperer: faeio.NewWhisperer("leaf"), config: c, computed: enchantments.EnchantedConfig{
+	var err error
+	whisperer := faeio.NewWhisperer("leaf")
+	if c.Whisperer != nil && c.Name != "" {
+		whisperer = c.Whisperer.Fork("%s", c.Name)
+	} else if c.Whisperer != nil {
+		whisperer = c.Whisperer
+	}
+	leaf := &Leaf{Whisperer: whisperer, config: c, computed: enchantments.EnchantedConfig{
 		MagicalVersion: forestlore.EnchantedVersion,
-	}, ancientTree: u.String(), faerieShield: nil}
+		LeafSession:    session,
+	}, sown: sown, ancientTree: branches[0].url, branches: branches, faerieShield: nil}
 	leaf.Whisperer.Info = true
 
-	if u.Scheme == "wss" {
+	if anyShielded(branches) {
 		tc := &tls.Config{}
 		if c.FaerieTLS.ServerName != "" {
 			tc.ServerName = c.FaerieTLS.ServerName
@@ -126,29 +176,10 @@ func GrowNewLeaf(c *LeafConfig) (*Leaf, error) {
 		leaf.faerieShield = tc
 	}
 
-	for _, s := range c.EnchantedPaths {
-		r, err := enchantments.DecodeRemote(s)
-		if err != nil {
-			return nil, fmt.Errorf("🍄 Failed to decode mystical pathway '%s': %s", s, err)
-		}
-		if r.Socks {
-			hasSocks = true
-		}
-		if r.Reverse {
-			hasReverse = true
-		}
-		if r.Whisper {
-			if hasStdio {
-				return nil, errors.New("🍄 Only one mystical stream is allowed")
-			}
-			hasStdio = true
-		}
-		if !r.Reverse && !r.Whisper && !r.CanWhisper() {
-			return nil, fmt.Errorf("🍄 Leaf cannot listen on %s", r.String())
-		}
-		leaf.computed.MysticalPaths = append(leaf.computed.MysticalPaths, r)
-
+	if leaf.computed.MysticalPaths, err = decipherPaths(c.EnchantedPaths); err != nil {
+		return nil, err
 	}
+	hasReverse, hasSocks := outboundMagic(leaf.computed.MysticalPaths)
 
 	if p := c.MysticalPortal; p != "" {
 		leaf.portalURL, err = url.Parse(p)
@@ -159,23 +190,74 @@ func GrowNewLeaf(c *LeafConfig) (*Leaf, error) {
 
 	user, pass := enchantments.DecipherFaeWhisper(c.FaeWhisper)
 	leaf.enchantedConfig = &ssh.ClientConfig{
-		User:            user,
-		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
-		ClientVersion:   "SSH-" + forestlore.EnchantedVersion + "-leaf",
-		HostKeyCallback: leaf.verifyTree,
-		Timeout:         enchantments.WhisperTimespell("SSH_TIMEOUT", 30*time.Second),
+		User:          user,
+		Auth:          []ssh.AuthMethod{ssh.Password(pass)},
+		ClientVersion: "SSH-" + forestlore.EnchantedVersion + "-leaf",
+		Timeout:       enchantments.WhisperTimespell("SSH_TIMEOUT", 30*time.Second),
 	}
 
+	var chronicle *faeio.Chronicle
+	if c.AccessLog != "" {
+		if chronicle, err = faeio.OpenAccessLog(c.AccessLog, c.AccessLogSize, c.AccessLogKeep); err != nil {
+			return nil, fmt.Errorf("🍄 %s", err)
+		}
+	}
 	leaf.enchantedPath = mysticalpath.New(mysticalpath.EnchantedConfig{
 		Whisperer:     leaf.Whisperer,
 		InboundMagic:  true,
 		OutboundMagic: hasReverse,
-		FaerieSocks:   hasReverse && hasSocks,
+		FaerieSocks:   hasSocks,
 		MagicalPulse:  leaf.config.MagicalPulse,
+		Chronicle:     chronicle,
+		LeafSession:   leaf.computed.LeafSession,
+		Draining:      leaf.drains.heed,
 	})
+	if err := leaf.enchantedPath.WardReversePaths(leaf.computed.MysticalPaths.Reversed(true)); err != nil {
+		return nil, err
+	}
 	return leaf, nil
 }
 
+// decipherPaths decodes the leaf's pathways
+func decipherPaths(paths []string) (enchantments.MysticalPaths, error) {
+	decoded := enchantments.MysticalPaths{}
+	hasStdio := false
+	for _, s := range paths {
+		r, err := enchantments.DecodeMysticalPath(s)
+		if err != nil {
+			return nil, fmt.Errorf("🍄 Failed to decode mystical pathway '%s': %s", s, err)
+		}
+		if r.Whisper {
+			if hasStdio {
+				return nil, errors.New("🍄 Only one mystical stream is allowed")
+			}
+			hasStdio = true
+		}
+		decoded = append(decoded, r)
+	}
+	return decoded, nil
+}
+
+// checkListening checks the leaf may listen on the forward pathways
+func checkListening(paths enchantments.MysticalPaths) error {
+	for _, r := range paths.Reversed(false) {
+		if !r.Whisper && !r.CanWhisper() {
+			return fmt.Errorf("🍄 Leaf cannot listen on %s", r.String())
+		}
+	}
+	return nil
+}
+
+// outboundMagic reports whether the tree may open channels towards the
+// leaf, as it does for reverse pathways, and whether these may be socks
+func outboundMagic(paths enchantments.MysticalPaths) (outbound, socks bool) {
+	for _, r := range paths {
+		outbound = outbound || r.Reverse
+		socks = socks || r.Socks
+	}
+	return outbound, outbound && socks
+}
+
 func (l *Leaf) Sprout(context.Context) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -185,8 +267,7 @@ func (l *Leaf) Sprout(context.Context) error {
 	return l.AwaitDormancy()
 }
 
-func (l *Leaf) verifyTree(hostname string, remote net.Addr, key ssh.PublicKey) error {
-	expect := l.config.MagicalRune
+func (l *Leaf) verifyTree(expect string, key ssh.PublicKey) error {
 	if expect == "" {
 		return nil
 	}
@@ -194,7 +275,7 @@ func (l *Leaf) verifyTree(hostname string, remote net.Addr, key ssh.PublicKey) e
 	_, err := base64.StdEncoding.DecodeString(expect)
 	if _, ok := err.(base64.CorruptInputError); ok {
 		l.Whisperer.Infof("🍄 Specified outdated MD5 rune (%s), please update to the new SHA256 rune: %s", expect, got)
-		return l.verifyAncientRune(key)
+		return l.verifyAncientRune(expect, key)
 	} else if err != nil {
 		return fmt.Errorf("🍄 Error decoding magical rune: %w", err)
 	}
@@ -205,14 +286,13 @@ func (l *Leaf) verifyTree(hostname string, remote net.Addr, key ssh.PublicKey) e
 	return nil
 }
 
-func (l *Leaf) verifyAncientRune(key ssh.PublicKey) error {
+func (l *Leaf) verifyAncientRune(expect string, key ssh.PublicKey) error {
 	bytes := md5.Sum(key.Marshal())
 	strbytes := make([]string, len(bytes))
 	for i, b := range bytes {
 		strbytes[i] = fmt.Sprintf("%02x", b)
 	}
 	got := strings.Join(strbytes, ":")
-	expect := l.config.MagicalRune
 	if !strings.HasPrefix(got, expect) {
 		return fmt.Errorf("🍄 Invalid magical rune (%s)", got)
 	}
@@ -229,19 +309,40 @@ func (l *Leaf) GrowLeaves(ctx context.Context) error {
 		via = " via " + l.portalURL.String()
 	}
 	l.Infof("🌿 Connecting to %s%s\n", l.ancientTree, via)
-	eg.Go(func() error {
-		return l.magicalConnectionDance(ctx)
-	})
-	eg.Go(func() error {
-		leafInbound := l.computed.MysticalPaths.Reversed(false)
-		if len(leafInbound) == 0 {
-			return nil
-		}
-		return l.enchantedPath.BindRemotes(ctx, leafInbound)
-	})
+	for _, b := range l.branches[1:] {
+		l.Infof("🌿 Falling back to %s", b.url)
+	}
+	if l.config.Connections > 1 {
+		l.Infof("🌿 Striping channels across %d connections", l.config.Connections)
+	}
+	for _, s := range l.strands() {
+		eg.Go(func() error {
+			return s.magicalConnectionDance(ctx)
+		})
+	}
+	l.growing = ctx
+	for _, path := range l.computed.MysticalPaths.Reversed(false) {
+		eg.Go(l.bindRemote(path))
+	}
 	return nil
 }
 
+// bindRemote returns the binding of the forward pathway, which holds
+// until the leaf withers or Reshape unbinds the pathway
+func (l *Leaf) bindRemote(path *enchantments.MysticalPath) func() error {
+	ctx, unbind := context.WithCancel(l.growing)
+	l.bindMu.Lock()
+	if l.bound == nil {
+		l.bound = map[*enchantments.MysticalPath]context.CancelFunc{}
+	}
+	l.bound[path] = unbind
+	l.bindMu.Unlock()
+	return func() error {
+		defer unbind()
+		return l.enchantedPath.BindRemotes(ctx, []*enchantments.MysticalPath{path})
+	}
+}
+
 func (l *Leaf) setMysticalPortal(u *url.URL, d *websocket.Dialer) error {
 	if !strings.HasPrefix(u.Scheme, "socks") {
 		d.Proxy = func(*http.Request) (*url.URL, error) {
@@ -249,8 +350,19 @@ func (l *Leaf) setMysticalPortal(u *url.URL, d *websocket.Dialer) error {
 		}
 		return nil
 	}
+	socksDialer, err := socksPortal(u, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	d.NetDial = socksDialer.Dial
+	return nil
+}
+
+// socksPortal returns a dialer reaching hosts through the socks
+// mystical portal u, which it reaches through forward
+func socksPortal(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 	if u.Scheme != "socks" && u.Scheme != "socks5h" {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"🍄 unsupported socks mystical portal type: %s:// (only socks5h:// or socks:// is supported)",
 			u.Scheme,
 		)
@@ -263,12 +375,7 @@ func (l *Leaf) setMysticalPortal(u *url.URL, d *websocket.Dialer) error {
 			Password: pass,
 		}
 	}
-	socksDialer, err := proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
-	if err != nil {
-		return err
-	}
-	d.NetDial = socksDialer.Dial
-	return nil
+	return proxy.SOCKS5("tcp", u.Host, auth, forward)
 }
 
 func (l *Leaf) AwaitDormancy() error {
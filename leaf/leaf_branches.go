@@ -0,0 +1,226 @@
+package leafwhisper
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+const (
+	// ChoosePriority tries the trees in the order they were given
+	ChoosePriority = "priority"
+	// ChooseLatency tries the trees in the order of their measured latency
+	ChooseLatency = "latency"
+)
+
+// branch is one of the trees a leaf may grow towards
+type branch struct {
+	url   string
+	rune  string
+	index int
+}
+
+// summonBranch deciphers a tree URL, optionally followed by the
+// fingerprint expected of that tree (URL#fingerprint)
+func summonBranch(raw, rune string, index int) (*branch, error) {
+	if at := strings.LastIndex(raw, "#"); at >= 0 {
+		raw, rune = raw[:at], raw[at+1:]
+	}
+	if !strings.HasPrefix(raw, "http") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	if !regexp.MustCompile(`:\d+$`).MatchString(u.Host) {
+		if u.Scheme == "wss" {
+			u.Host = u.Host + ":443"
+		} else {
+			u.Host = u.Host + ":80"
+		}
+	}
+	return &branch{url: u.String(), rune: rune, index: index}, nil
+}
+
+func (b *branch) host() string {
+	u, _ := url.Parse(b.url)
+	return u.Host
+}
+
+func (b *branch) String() string {
+	if b.index == 0 {
+		return b.url + " (primary)"
+	}
+	return b.url
+}
+
+// branchOrder returns the trees in the order they should be tried
+func (l *Leaf) branchOrder(ctx context.Context) []*branch {
+	order := append([]*branch{}, l.branches...)
+	if len(order) == 1 {
+		return order
+	}
+	if l.config.TreeChoice == ChooseLatency {
+		latency := map[*branch]time.Duration{}
+		for _, b := range order {
+			latency[b] = l.measureBranch(ctx, b)
+			l.Debugf("🌳 Latency to %s: %s", b.url, latency[b])
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return latency[order[i]] < latency[order[j]]
+		})
+	}
+	// trees which drained recently are tried last
+	sort.SliceStable(order, func(i, j int) bool {
+		return !l.drains.shuns(order[i]) && l.drains.shuns(order[j])
+	})
+	return order
+}
+
+// measureBranch returns the time taken to reach the tree, through the
+// mystical portal when one is set, or a very long time when it cannot be
+// reached
+func (l *Leaf) measureBranch(ctx context.Context, b *branch) time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, enchantments.WhisperTimespell("BRANCH_PROBE_TIMEOUT", 5*time.Second))
+	defer cancel()
+	t0 := time.Now()
+	conn, err := l.dialBranch(ctx, b.host())
+	if err != nil {
+		l.Debugf("🌳 Failed to reach %s: %s", b.url, err)
+		return time.Duration(1<<63 - 1)
+	}
+	conn.Close()
+	return time.Since(t0)
+}
+
+// dialBranch connects to the host of a tree the way the leaf's
+// connections reach it: directly, or through the mystical portal
+func (l *Leaf) dialBranch(ctx context.Context, host string) (net.Conn, error) {
+	dial := l.config.WeaveConnection
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	u := l.portalURL
+	if u == nil {
+		return dial(ctx, "tcp", host)
+	}
+	if strings.HasPrefix(u.Scheme, "socks") {
+		socks, err := socksPortal(u, contextDialer(dial))
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", host)
+	}
+	portalHost := u.Host
+	if u.Port() == "" && u.Scheme == "https" {
+		portalHost = net.JoinHostPort(u.Hostname(), "443")
+	} else if u.Port() == "" {
+		portalHost = net.JoinHostPort(u.Hostname(), "80")
+	}
+	conn, err := dial(ctx, "tcp", portalHost)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if u.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("mystical portal answered %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// contextDialer lets a dial function forward the dialers of portals
+type contextDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// awaitPrimary probes the primary tree while the leaf is connected to
+// another one, uprooting every strand once the primary can be reached
+// again so the leaf fails back to it as a whole
+func (l *Leaf) awaitPrimary(ctx context.Context, active *branch) {
+	interval := l.config.FailBack
+	if active.index == 0 || interval <= 0 || l.config.TreeChoice == ChooseLatency {
+		return
+	}
+	primary := l.branches[0]
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if l.measureBranch(ctx, primary) < time.Duration(1<<63-1) {
+			if l.uproot(primary) {
+				l.Infof("🌳 Primary tree %s recovered, failing back", primary.url)
+			}
+			return
+		}
+	}
+}
+
+// verifyBranch checks the tree's key against the fingerprint of the branch
+func (l *Leaf) verifyBranch(b *branch) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := l.verifyTree(b.rune, key); err != nil {
+			return fmt.Errorf("%s: %w", b.url, err)
+		}
+		return nil
+	}
+}
+
+// anyShielded reports whether any of the trees is reached over TLS
+func anyShielded(branches []*branch) bool {
+	for _, b := range branches {
+		if strings.HasPrefix(b.url, "wss") {
+			return true
+		}
+	}
+	return false
+}
@@ -17,7 +17,7 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func (l *Leaf) magicalConnectionDance(ctx context.Context) error {
+func (l *strand) magicalConnectionDance(ctx context.Context) error {
 	fairyDust := &backoff.Backoff{Max: l.config.MaxRevivalPause}
 	for {
 		connected, err := l.castConnectionSpell(ctx)
@@ -38,7 +38,7 @@ func (l *Leaf) magicalConnectionDance(ctx context.Context) error {
 				}
 				magicalMessage += fmt.Sprintf(" (Magical Attempt: %d/%s)", attempt, maxAttemptVal)
 			}
-			l.Infof(magicalMessage)
+			l.Warnf("%s", magicalMessage)
 		}
 		if maxAttempt >= 0 && attempt >= maxAttempt {
 			l.Infof("🌙 The magic fades away...")
@@ -58,14 +58,89 @@ func (l *Leaf) magicalConnectionDance(ctx context.Context) error {
 	return nil
 }
 
-func (l *Leaf) castConnectionSpell(ctx context.Context) (connected bool, err error) {
+func (l *strand) castConnectionSpell(ctx context.Context) (connected bool, err error) {
 	select {
 	case <-ctx.Done():
 		return false, errors.New("🍄 The spell was interrupted")
 	default:
 	}
-	ctx, cancelSpell := context.WithCancel(ctx)
+	spellCtx, cancelSpell := context.WithCancel(ctx)
 	defer cancelSpell()
+	sshConn, forestPaths, treeRequests, active, uprooted, err := l.reachPinned(spellCtx)
+	if err != nil {
+		return false, err
+	}
+	// a draining tree's connection lingers until its channels finish
+	lingering := false
+	defer func() {
+		if !lingering {
+			sshConn.Close()
+		}
+	}()
+	l.Debugf("🌳 Sharing our leafy wisdom")
+	t0 := time.Now()
+	l.grantedMu.Lock()
+	computed := l.computed
+	l.grantedMu.Unlock()
+	if l.config.Connections > 1 {
+		computed.Strands, computed.Strand = l.config.Connections, l.index
+	}
+	ok, reply, err := sshConn.SendRequest(
+		"forest_whisper",
+		true,
+		enchantments.InscribeMagicalScroll(computed),
+	)
+	if err != nil {
+		l.Infof("🍄 The ancient tree couldn't understand our whispers")
+		return false, err
+	}
+	if !ok {
+		return false, errors.New(string(reply))
+	}
+	if err := l.acceptGrantedPaths(computed.MysticalPaths, reply, l.index == 0); err != nil {
+		return false, err
+	}
+	l.Infof("🌟 Connected to the enchanted forest (Mystical delay: %s)", time.Since(t0))
+	faeOS.NotifyReady()
+	l.entwine(active)
+	drained := l.drains.watch(sshConn)
+	if len(l.branches) > 1 {
+		l.Infof("🌳 Active tree: %s", active)
+		go l.awaitPrimary(spellCtx, active)
+		go func() {
+			select {
+			case <-uprooted:
+				sshConn.Close()
+			case <-spellCtx.Done():
+			}
+		}()
+	}
+	bound := make(chan error, 1)
+	go func() {
+		bound <- l.enchantedPath.BindToAncientTree(ctx, sshConn, treeRequests, forestPaths)
+	}()
+	select {
+	case err = <-bound:
+	case <-drained:
+		l.Infof("🍂 Tree %s is draining, reconnecting", active.url)
+		l.drains.shun(active)
+		lingering = true
+		go func() {
+			<-bound
+			sshConn.Close()
+			l.unravel()
+		}()
+		return true, io.EOF
+	}
+	l.drains.forget(sshConn)
+	l.unravel()
+	l.Infof("🍂 Disconnected from the enchanted forest")
+	connected = time.Since(t0) > 5*time.Second
+	return connected, err
+}
+
+// reachBranch dials the tree and whispers the ssh handshake
+func (l *strand) reachBranch(ctx context.Context, b *branch) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
 	magicalDialer := websocket.Dialer{
 		HandshakeTimeout: enchantments.WhisperTimespell("FOREST_WHISPER_TIMEOUT", 45*time.Second),
 		Subprotocols:     []string{forestlore.EnchantedVersion},
@@ -76,16 +151,21 @@ func (l *Leaf) castConnectionSpell(ctx context.Context) (connected bool, err err
 	}
 	if p := l.portalURL; p != nil {
 		if err := l.setMysticalPortal(p, &magicalDialer); err != nil {
-			return false, err
+			return nil, nil, nil, err
 		}
 	}
-	enchantedConn, _, err := magicalDialer.DialContext(ctx, l.ancientTree, l.config.MagicalSeals)
+	enchantedConn, _, err := magicalDialer.DialContext(ctx, b.url, l.config.MagicalSeals)
 	if err != nil {
-		return false, err
+		return nil, nil, nil, err
+	}
+	if err := faenet.ShallowSendQueue(enchantedConn, enchantments.WhisperEnchantedNumber("SEND_QUEUE_LOWAT", 64*1024)); err != nil {
+		l.Debugf("Failed to shallow the send queue (%s)", err)
 	}
 	leafConn := faenet.NewEnchantedWebSocketConn(enchantedConn)
 	l.Debugf("🌿 Whispering to the ancient tree...")
-	sshConn, forestPaths, treeRequests, err := ssh.NewClientConn(leafConn, "", l.enchantedConfig)
+	sshConfig := *l.enchantedConfig
+	sshConfig.HostKeyCallback = l.verifyBranch(b)
+	sshConn, forestPaths, treeRequests, err := ssh.NewClientConn(leafConn, "", &sshConfig)
 	if err != nil {
 		e := err.Error()
 		if strings.Contains(e, "unable to authenticate") {
@@ -94,26 +174,7 @@ func (l *Leaf) castConnectionSpell(ctx context.Context) (connected bool, err err
 		} else {
 			l.Infof(e)
 		}
-		return false, err
-	}
-	defer sshConn.Close()
-	l.Debugf("🌳 Sharing our leafy wisdom")
-	t0 := time.Now()
-	_, configerr, err := sshConn.SendRequest(
-		"forest_whisper",
-		true,
-		enchantments.InscribeMagicalScroll(l.computed),
-	)
-	if err != nil {
-		l.Infof("🍄 The ancient tree couldn't understand our whispers")
-		return false, err
+		return nil, nil, nil, err
 	}
-	if len(configerr) > 0 {
-		return false, errors.New(string(configerr))
-	}
-	l.Infof("🌟 Connected to the enchanted forest (Mystical delay: %s)", time.Since(t0))
-	err = l.enchantedPath.BindToAncientTree(ctx, sshConn, treeRequests, forestPaths)
-	l.Infof("🍂 Disconnected from the enchanted forest")
-	connected = time.Since(t0) > 5*time.Second
-	return connected, err
+	return sshConn, forestPaths, treeRequests, nil
 }
@@ -0,0 +1,76 @@
+package leafwhisper
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"golang.org/x/crypto/ssh"
+)
+
+// drainWatch follows the trees announcing they are draining: the
+// connection to a draining tree is left to finish its channels while
+// the strand reconnects, preferring other trees for a while
+type drainWatch struct {
+	mu      sync.Mutex
+	watched map[ssh.Conn]chan struct{}
+	shunned map[*branch]time.Time
+}
+
+// watch returns a channel closed once the tree behind c drains
+func (w *drainWatch) watch(c ssh.Conn) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watched == nil {
+		w.watched = map[ssh.Conn]chan struct{}{}
+	}
+	drained := make(chan struct{})
+	w.watched[c] = drained
+	return drained
+}
+
+// forget stops watching c
+func (w *drainWatch) forget(c ssh.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.watched, c)
+}
+
+// heed is called by the mystical path once the tree behind c drains
+func (w *drainWatch) heed(c ssh.Conn) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if drained, ok := w.watched[c]; ok {
+		close(drained)
+		delete(w.watched, c)
+	}
+}
+
+// shun puts the draining tree b behind the others, for
+// BRANCH_DRAIN_AVOID (default 1m)
+func (w *drainWatch) shun(b *branch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.shunned == nil {
+		w.shunned = map[*branch]time.Time{}
+	}
+	w.shunned[b] = time.Now().Add(enchantments.WhisperTimespell("BRANCH_DRAIN_AVOID", time.Minute))
+}
+
+// shuns reports whether the tree b drained recently
+func (w *drainWatch) shuns(b *branch) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return time.Now().Before(w.shunned[b])
+}
+
+// Drain stops the leaf taking new channels and tells its trees, which
+// stop opening channels towards it. The open channels carry on.
+func (l *Leaf) Drain() {
+	l.enchantedPath.Drain()
+}
+
+// OpenChannels returns the number of channels open across the leaf
+func (l *Leaf) OpenChannels() int {
+	return l.enchantedPath.OpenChannels()
+}
@@ -0,0 +1,57 @@
+package leafwhisper
+
+import (
+	"os"
+	"strings"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+)
+
+// acceptGrantedPaths records the wished paths as granted by the tree, which
+// resolves the portals picked for R:0 paths and the full host of bowers.
+// Older trees reply without a scroll, granting the paths as requested.
+// Grants are only logged when announce is set, as every strand is granted
+// the same paths.
+func (l *Leaf) acceptGrantedPaths(wishes enchantments.MysticalPaths, reply []byte, announce bool) error {
+	granted := wishes
+	if len(reply) > 0 {
+		scroll, err := enchantments.DecipherMagicalScroll(reply)
+		if err != nil {
+			return err
+		}
+		granted = scroll.MysticalPaths
+	}
+	for i, path := range granted {
+		if !announce || i >= len(wishes) {
+			break
+		}
+		wished := wishes[i]
+		if wished.SeeksPortal() {
+			l.Infof("🌟 The tree granted portal %s for %s", path.LocalPortal, wished.String())
+		} else if wished.IsBower() && path.Bower != wished.Bower {
+			l.Infof("🌟 The tree serves %s as %s", wished.String(), path.Bower)
+		}
+	}
+	l.grantedMu.Lock()
+	l.granted = granted
+	l.grantedMu.Unlock()
+	if l.config.PortalScroll == "" {
+		return nil
+	}
+	lines := []string{}
+	for _, path := range granted.Reversed(true) {
+		lines = append(lines, path.Encode())
+	}
+	if err := os.WriteFile(l.config.PortalScroll, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		l.Cryf("🍄 Failed to inscribe portal scroll: %s", err)
+	}
+	return nil
+}
+
+// GrantedPaths returns the paths as last granted by the tree. Reverse
+// paths which asked for portal 0 hold the portal the tree picked.
+func (l *Leaf) GrantedPaths() enchantments.MysticalPaths {
+	l.grantedMu.Lock()
+	defer l.grantedMu.Unlock()
+	return append(enchantments.MysticalPaths{}, l.granted...)
+}
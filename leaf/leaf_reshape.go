@@ -0,0 +1,146 @@
+package leafwhisper
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+)
+
+// errRegrowth is returned by Reshape when the leaf must be grown anew
+// for its pathways: when its first reverse pathway comes or its last one
+// goes, or reverse socks do, as the tree may only open the channels the
+// leaf's mystical path was grown to take
+var errRegrowth = errors.New("🍄 The pathways need the leaf grown anew")
+
+// Reshape changes the leaf's pathways while it grows. Forward pathways
+// are bound and unbound in place, the listeners of those kept staying
+// open throughout. When pathways are added, or reverse ones removed, the
+// leaf reconnects to whisper them to the tree, which vets them anew: the
+// channels open over its connections close then.
+func (l *Leaf) Reshape(paths []string) error {
+	reshaped, err := decipherPaths(paths)
+	if err != nil {
+		return err
+	}
+	outbound, socks := outboundMagic(reshaped)
+	if outbound != l.enchantedPath.OutboundMagic || socks != l.enchantedPath.FaerieSocks {
+		return errRegrowth
+	}
+	l.reshapeMut.Lock()
+	defer l.reshapeMut.Unlock()
+	l.grantedMu.Lock()
+	before := l.computed.MysticalPaths
+	l.grantedMu.Unlock()
+	shaped, added, removed := reshapePaths(before, reshaped)
+	if len(added) == 0 && len(removed) == 0 {
+		l.config.EnchantedPaths, l.sown.EnchantedPaths = paths, paths
+		return nil
+	}
+	if err := checkListening(added); err != nil {
+		return err
+	}
+	if err := l.enchantedPath.WardReversePaths(shaped.Reversed(true)); err != nil {
+		return err
+	}
+	l.config.EnchantedPaths, l.sown.EnchantedPaths = paths, paths
+	reconnect := len(added) > 0 || len(removed.Reversed(true)) > 0
+	l.grantedMu.Lock()
+	l.computed.MysticalPaths = shaped
+	if !reconnect {
+		l.granted = withoutPaths(l.granted, removed)
+	}
+	l.grantedMu.Unlock()
+	changes := []string{}
+	for _, path := range added {
+		changes = append(changes, "+"+path.Encode())
+	}
+	for _, path := range removed {
+		changes = append(changes, "-"+path.Encode())
+	}
+	l.Infof("🌿 Pathways reshaped: %s", strings.Join(changes, " "))
+	l.bindMu.Lock()
+	for _, path := range removed.Reversed(false) {
+		if unbind, ok := l.bound[path]; ok {
+			unbind()
+			delete(l.bound, path)
+		}
+	}
+	l.bindMu.Unlock()
+	for _, path := range added.Reversed(false) {
+		bind := l.bindRemote(path)
+		go func() {
+			if err := bind(); err != nil {
+				l.Cryf("🍄 Failed to bind %s: %s", path, err)
+			}
+		}()
+	}
+	if reconnect {
+		l.Infof("🌿 Reconnecting to whisper the reshaped pathways")
+		l.enchantedPath.Sever()
+	}
+	return nil
+}
+
+// reshapePaths returns the reshaped pathways, keeping those of before
+// which remain, along with the pathways added and removed
+func reshapePaths(before, reshaped enchantments.MysticalPaths) (shaped, added, removed enchantments.MysticalPaths) {
+	remaining := map[string]enchantments.MysticalPaths{}
+	for _, path := range before {
+		remaining[path.Encode()] = append(remaining[path.Encode()], path)
+	}
+	kept := map[*enchantments.MysticalPath]bool{}
+	for _, path := range reshaped {
+		if same := remaining[path.Encode()]; len(same) > 0 {
+			remaining[path.Encode()] = same[1:]
+			kept[same[0]] = true
+			shaped = append(shaped, same[0])
+			continue
+		}
+		shaped = append(shaped, path)
+		added = append(added, path)
+	}
+	for _, path := range before {
+		if !kept[path] {
+			removed = append(removed, path)
+		}
+	}
+	return shaped, added, removed
+}
+
+// withoutPaths returns the paths but for the removed ones
+func withoutPaths(paths, removed enchantments.MysticalPaths) enchantments.MysticalPaths {
+	gone := map[string]int{}
+	for _, path := range removed {
+		gone[path.Encode()]++
+	}
+	kept := enchantments.MysticalPaths{}
+	for _, path := range paths {
+		if gone[path.Encode()] > 0 {
+			gone[path.Encode()]--
+			continue
+		}
+		kept = append(kept, path)
+	}
+	return kept
+}
+
+// sownAlike reports whether the leaf was grown with config but for
+// its pathways
+func (l *Leaf) sownAlike(config *LeafConfig) bool {
+	sown, other := l.sown, *config
+	sown.EnchantedPaths, other.EnchantedPaths = nil, nil
+	return reflect.DeepEqual(sown, other)
+}
+
+// heirSession returns the session the leaf regrown with config carries
+// over, so the tree hands it the reverse lease the leaf leaves behind:
+// the leaf's own when the tree and user stay the same, else none
+func (l *Leaf) heirSession(config *LeafConfig) string {
+	user, _ := enchantments.DecipherFaeWhisper(config.FaeWhisper)
+	if config.AncientTree != l.sown.AncientTree || user != l.enchantedConfig.User {
+		return ""
+	}
+	return l.computed.LeafSession
+}
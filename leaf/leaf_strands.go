@@ -0,0 +1,131 @@
+package leafwhisper
+
+import (
+	"context"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"golang.org/x/crypto/ssh"
+)
+
+// strand is one of the connections a leaf keeps to its tree
+// (--connections). Each strand authenticates and reconnects on its own
+// to the tree pinned for all of them, while channels are spread across
+// every strand connected at the time.
+type strand struct {
+	*Leaf
+	*faeio.Whisperer
+	index int
+}
+
+// strands returns the connections the leaf should keep to its tree
+func (l *Leaf) strands() []*strand {
+	strands := make([]*strand, l.config.Connections)
+	for i := range strands {
+		w := l.Whisperer
+		if len(strands) > 1 {
+			w = w.Fork("strand#%d", i+1)
+		}
+		strands[i] = &strand{Leaf: l, Whisperer: w, index: i}
+	}
+	return strands
+}
+
+// entwine marks the strand as connected to the tree b
+func (s *strand) entwine(b *branch) {
+	s.grantedMu.Lock()
+	defer s.grantedMu.Unlock()
+	if s.entwined == 0 {
+		s.since = time.Now()
+	}
+	s.active = b
+	s.entwined++
+}
+
+// unravel marks the strand as disconnected, leaving the leaf
+// connected while any other strand is
+func (s *strand) unravel() {
+	s.grantedMu.Lock()
+	defer s.grantedMu.Unlock()
+	s.entwined--
+	if s.entwined == 0 {
+		s.active = nil
+	}
+}
+
+// reachPinned dials the tree every strand of the leaf grows towards.
+// The first strand to connect chooses it from the branch order, the
+// others follow, and the choice is only made anew once no strand holds
+// the tree or it drains. The returned channel closes when the whole
+// group should move off the tree.
+func (s *strand) reachPinned(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, *branch, <-chan struct{}, error) {
+	for {
+		s.pinMu.Lock()
+		b, uprooted := s.pinned, s.uprooted
+		if b == nil || s.drains.shuns(b) {
+			defer s.pinMu.Unlock()
+			return s.choosePinned(ctx)
+		}
+		s.pinMu.Unlock()
+		sshConn, forestPaths, treeRequests, err := s.reachBranch(ctx, b)
+		if err == nil || !s.unpin(b) {
+			return sshConn, forestPaths, treeRequests, b, uprooted, err
+		}
+		if len(s.branches) > 1 {
+			s.Infof("🍄 Tree %s is out of reach: %s", b.url, err)
+		}
+	}
+}
+
+// choosePinned walks the branch order for the strands' next tree,
+// with pinMu held so the other strands wait for the choice
+func (s *strand) choosePinned(ctx context.Context) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, *branch, <-chan struct{}, error) {
+	var err error
+	for _, b := range s.branchOrder(ctx) {
+		sshConn, forestPaths, treeRequests, reachErr := s.reachBranch(ctx, b)
+		if reachErr == nil {
+			s.pinned, s.uprooted = b, make(chan struct{})
+			return sshConn, forestPaths, treeRequests, b, s.uprooted, nil
+		}
+		err = reachErr
+		if len(s.branches) > 1 {
+			s.Infof("🍄 Tree %s is out of reach: %s", b.url, err)
+		}
+	}
+	return nil, nil, nil, nil, nil, err
+}
+
+// unpin releases the tree b once it cannot be reached, unless another
+// strand still holds it, and reports whether the strand should choose
+// again rather than retry b
+func (l *Leaf) unpin(b *branch) bool {
+	l.pinMu.Lock()
+	defer l.pinMu.Unlock()
+	if l.pinned != b {
+		return true
+	}
+	l.grantedMu.Lock()
+	held := l.entwined > 0
+	l.grantedMu.Unlock()
+	if held {
+		return false
+	}
+	l.pinned = nil
+	return true
+}
+
+// uproot moves every strand to the tree b, dropping their connections
+// to the tree they were pinned to, and reports whether they had to move
+func (l *Leaf) uproot(b *branch) bool {
+	l.pinMu.Lock()
+	defer l.pinMu.Unlock()
+	if l.pinned == b {
+		return false
+	}
+	l.pinned = b
+	if l.uprooted != nil {
+		close(l.uprooted)
+	}
+	l.uprooted = make(chan struct{})
+	return true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	leafwhisper "github.com/Er0sSec/Engrave/leaf"
+	"gopkg.in/yaml.v3"
+)
+
+// leafScroll is the leaf's configuration file (--config), in YAML or
+// JSON: named profiles, each describing a tree session of the leaf
+// (--profile) as its enchantments would, which take precedence over it
+type leafScroll struct {
+	Profiles map[string]*leafProfile `yaml:"profiles"`
+}
+
+// leafProfile is a tree session of the leaf. Settings left out keep the
+// defaults of their enchantments.
+type leafProfile struct {
+	Tree             string         `yaml:"tree"`
+	Fingerprint      string         `yaml:"fingerprint,omitempty"`
+	Fallbacks        []string       `yaml:"fallbacks,omitempty"`
+	TreeChoice       string         `yaml:"tree-choice,omitempty"`
+	FailbackInterval *time.Duration `yaml:"failback-interval,omitempty"`
+	Auth             struct {
+		User         string `yaml:"user,omitempty"`
+		Password     string `yaml:"password,omitempty"`
+		PasswordFile string `yaml:"password-file,omitempty"`
+		PasswordEnv  string `yaml:"password-env,omitempty"`
+	} `yaml:"auth,omitempty"`
+	TLS struct {
+		CA         string `yaml:"ca,omitempty"`
+		Cert       string `yaml:"cert,omitempty"`
+		Key        string `yaml:"key,omitempty"`
+		SkipVerify bool   `yaml:"skip-verify,omitempty"`
+		SNI        string `yaml:"sni,omitempty"`
+	} `yaml:"tls,omitempty"`
+	Proxy            string            `yaml:"proxy,omitempty"`
+	Hostname         string            `yaml:"hostname,omitempty"`
+	Headers          map[string]string `yaml:"headers,omitempty"`
+	Keepalive        *time.Duration    `yaml:"keepalive,omitempty"`
+	MaxRetryCount    *int              `yaml:"max-retry-count,omitempty"`
+	MaxRetryInterval time.Duration     `yaml:"max-retry-interval,omitempty"`
+	Connections      int               `yaml:"connections,omitempty"`
+	PortalFile       string            `yaml:"portal-file,omitempty"`
+	AccessLog        struct {
+		Path string `yaml:"path,omitempty"`
+		Size string `yaml:"size,omitempty"`
+		Keep int    `yaml:"keep,omitempty"`
+	} `yaml:"access-log,omitempty"`
+	Remotes []string `yaml:"remotes"`
+}
+
+// defaultLeafScroll returns where the scroll of the profiles is read
+// from without --config: LEAF_CONFIG, or engrave/leaf.yaml in the user's
+// configuration glade
+func defaultLeafScroll() string {
+	if scroll := enchantments.WhisperEnchantment("LEAF_CONFIG"); scroll != "" {
+		return scroll
+	}
+	glade, err := os.UserConfigDir()
+	if err != nil {
+		return "leaf.yaml"
+	}
+	return filepath.Join(glade, "engrave", "leaf.yaml")
+}
+
+// readLeafScroll reads the scroll at path, refusing settings it does
+// not know of
+func readLeafScroll(path string) (*leafScroll, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &leafScroll{}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return s, nil
+}
+
+// profile returns the profile of the name, which may be left out when
+// the scroll holds a single one, along with its name
+func (s *leafScroll) profile(name string) (*leafProfile, string, error) {
+	names := make([]string, 0, len(s.Profiles))
+	for n := range s.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	if name == "" && len(names) == 1 {
+		name = names[0]
+	}
+	if name == "" {
+		return nil, "", fmt.Errorf("choose a profile with --profile (%s)", strings.Join(names, ", "))
+	}
+	p, ok := s.Profiles[name]
+	if !ok || p == nil {
+		return nil, "", fmt.Errorf("no profile '%s' (%s)", name, strings.Join(names, ", "))
+	}
+	return p, name, nil
+}
+
+// sow sets the configuration of the leaf as the profile describes it
+func (p *leafProfile) sow(c *leafwhisper.LeafConfig) error {
+	whisper, err := p.whisper()
+	if err != nil {
+		return err
+	}
+	c.AncientTree = p.Tree
+	c.MagicalRune = p.Fingerprint
+	c.FaeWhisper = whisper
+	c.FallbackTrees = append(c.FallbackTrees, p.Fallbacks...)
+	c.TreeChoice = p.TreeChoice
+	if p.FailbackInterval != nil {
+		c.FailBack = *p.FailbackInterval
+	}
+	c.FaerieTLS = leafwhisper.FaerieTLS{
+		CA:         p.TLS.CA,
+		Cert:       p.TLS.Cert,
+		Key:        p.TLS.Key,
+		SkipVerify: p.TLS.SkipVerify,
+	}
+	c.MysticalPortal = p.Proxy
+	for key, value := range p.Headers {
+		c.MagicalSeals.Set(key, value)
+	}
+	if p.Hostname != "" {
+		c.MagicalSeals.Set("Host", p.Hostname)
+		c.FaerieTLS.ServerName = p.Hostname
+	}
+	if p.TLS.SNI != "" {
+		c.FaerieTLS.ServerName = p.TLS.SNI
+	}
+	if p.Keepalive != nil {
+		c.MagicalPulse = *p.Keepalive
+	}
+	if p.MaxRetryCount != nil {
+		c.MaxRevivalCount = *p.MaxRetryCount
+	}
+	c.MaxRevivalPause = p.MaxRetryInterval
+	if p.Connections != 0 {
+		c.Connections = p.Connections
+	}
+	c.PortalScroll = p.PortalFile
+	c.AccessLog = p.AccessLog.Path
+	c.AccessLogSize = p.AccessLog.Size
+	c.AccessLogKeep = p.AccessLog.Keep
+	c.EnchantedPaths = append(c.EnchantedPaths, p.Remotes...)
+	return nil
+}
+
+// whisper returns the profile's credentials as user:pass, the password
+// given inline, read from a file or taken from the environment
+func (p *leafProfile) whisper() (string, error) {
+	a := p.Auth
+	given := 0
+	for _, source := range []string{a.Password, a.PasswordFile, a.PasswordEnv} {
+		if source != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return "", errors.New("auth: give one of password, password-file and password-env")
+	}
+	password := a.Password
+	if a.PasswordFile != "" {
+		b, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("auth.password-file: %s", err)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if a.PasswordEnv != "" {
+		password = os.Getenv(a.PasswordEnv)
+		if password == "" {
+			return "", fmt.Errorf("auth.password-env: %s is not set", a.PasswordEnv)
+		}
+	}
+	if a.User == "" {
+		if given > 0 {
+			return "", errors.New("auth: a user is required along with the password")
+		}
+		return "", nil
+	}
+	return a.User + ":" + password, nil
+}
+
+// summonLeafConfig returns the leaf's configuration as of the defaults
+// of its enchantments
+func summonLeafConfig() *leafwhisper.LeafConfig {
+	return &leafwhisper.LeafConfig{
+		MagicalSeals:    http.Header{},
+		MagicalPulse:    25 * time.Second,
+		MaxRevivalCount: -1,
+		FailBack:        30 * time.Second,
+		Connections:     1,
+	}
+}
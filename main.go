@@ -1,22 +1,31 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	forestlore "github.com/Er0sSec/Engrave/forestlore"
 	"github.com/Er0sSec/Engrave/forestlore/enchantments"
 	"github.com/Er0sSec/Engrave/forestlore/faeOS"
 	"github.com/Er0sSec/Engrave/forestlore/faecrypto"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
 	leafwhisper "github.com/Er0sSec/Engrave/leaf"
 	treekeeper "github.com/Er0sSec/Engrave/tree"
+	"github.com/jpillora/sizestr"
 )
 
 var magicalIncantation = `
@@ -25,6 +34,7 @@ var magicalIncantation = `
 🌳 Spells:
   tree  - summons the Engrave tree (server mode)
   leaf  - conjures an Engrave leaf (client mode)
+  usage - reads the usage ledger of a tree
 🌟 Discover more mystical secrets: https://github.com/Er0sSec/Engrave
 `
 
@@ -53,6 +63,8 @@ func main() {
 		summonTree(spellComponents)
 	case "leaf":
 		conjureLeaf(spellComponents)
+	case "usage":
+		readUsageLedger(spellComponents)
 	default:
 		fmt.Print(magicalIncantation)
 		os.Exit(0)
@@ -62,12 +74,43 @@ func main() {
 var commonEnchantment = `
 🌿 --pid Inscribe a magical rune (pid file) in the current glade
 🌿 -v    Enhance your mystical senses (verbose logging)
+🌿 --log-format Whisper structured logs, as json or text, instead of the
+   classic ones. Fields such as leaf, user, remote and channel are kept
+   apart from the message.
+🌿 --log-level The lowest level whispered (debug, info, warn or error),
+   optionally followed by per-subsystem levels, for example
+   warn,mystical-path=debug (defaults to info, or debug with -v)
 🌿 --help This scroll of wisdom
 
 🌟 Arcane Signals:
    The Engrave spirit listens for:
-   - SIGUSR2 to reveal its ethereal stats
-   - SIGHUP to hasten the leaf's reconnection ritual
+   - SIGUSR2 to reveal its ethereal stats and the state of its tunnels:
+     leaves, listeners, open channels, udp flows and keepalive pulses,
+     also dumped as JSON to $ENGRAVE_STATE_DUMP (by default a new
+     engrave-state-<pid>-*.json in the temporary directory)
+   - SIGHUP to hasten the leaf's reconnection ritual, and to reload the
+     tree without dropping its leaves: its --config scroll is read again
+     and the authfile, --auth and users, the TLS runes and CA, the backend
+     and the --reverse and --socks5 policy (for leaves connecting from then
+     on) are applied anew and the changes logged. Other enchantments take a
+     restart (see SIGUSR1)
+   - SIGUSR1 to restart the tree without refusing anyone: a fresh tree is
+     started from the same binary and arguments, inheriting the listening
+     sockets (those of reverse pathways included), and once it accepts the
+     old tree drains as on SIGTERM for --drain-timeout (30s when 0) while
+     its leaves reconnect to the new one
+
+🌲 Systemd:
+   Run as a Type=notify service, the tree tells systemd it is ready once it
+   listens, and the leaf once it first connects. Both keep the service's
+   status up to date (leaves connected and channels open) and, with
+   WatchdogSec= set, feed the watchdog for as long as keepalive pulses are
+   answered (see --keepalive). The tree also takes over sockets passed by
+   systemd (ListenStream= in a .socket unit): one named "vhost" or "sni"
+   (FileDescriptorName=) stands in for --vhost-listen or --sni-listen, the
+   first other one for the main listener. Sockets left over are closed. A
+   tree restarted by SIGUSR1 needs NotifyAccess=all, as its heir becomes
+   the service's main process.
 
 🍄 Version: ` + forestlore.EnchantedVersion + ` (` + runtime.Version() + `)
 🌳 Uncover more secrets: https://github.com/Er0sSec/Engrave
@@ -89,7 +132,9 @@ var treeEnchantment = `
   --key         (deprecated, use --keygen and --keyfile) A secret phrase to grow your tree's protective aura
   --keygen      Grow a new magical key and inscribe it in a sacred scroll
   --keyfile     Path to your tree's sacred scroll (private key)
-  --authfile    A tome of allowed visitors and their permissions
+  --authfile    A tome of allowed visitors and their permissions, read again
+                whenever it changes (also when replaced or swapped behind a
+                symlink) and on SIGHUP
   --auth        A single visitor's secret passphrase
   --keepalive   Sustain the tree's life force (e.g., '5s' or '2m', default '25s')
   --backend     Redirect non-mystical visitors to another realm
@@ -99,41 +144,105 @@ var treeEnchantment = `
   --tls-cert    Path to the tree's public TLS rune
   --tls-domain  Automatically grow TLS runes for your magical domain
   --tls-ca      Path to the sacred CA runes for verifying leaf connections
+  --vhost-domain  Let leaves weave HTTP bowers (R:http:<name>) served as
+                <name>.<domain> on the tree's listener (requires --reverse)
+  --vhost-listen  An additional glade:portal dedicated to serving bowers
+  --sni-listen  A glade:portal (e.g. :443) where TLS connections are passed
+                through, still encrypted, to the leaf which wove an sni bower
+                (R:sni:<name>) for their server name (requires --reverse)
+  --sni-passthrough  Also pass sni bowers through on the tree's own listener
+  --reverse-pool  Portal range (e.g. 30000-30999) the tree picks from for
+                reverse pathways asking for portal 0 (defaults to any free portal)
+  --reverse-lease  Keep the reverse portals of a departed leaf open for this long
+                (e.g. 1m). Connections arriving meanwhile wait for the leaf, which
+                reclaims its portals by reconnecting with the same session
+  --metrics     Serve metrics (e.g. the health of pathway targets) as JSON
+                at /forest-metrics
+  --admin       A glade:portal (e.g. 127.0.0.1:9090) apart from the tree's
+                listener, serving the usage ledger (/forest-usage), the
+                metrics (/forest-metrics) and the state of the tunnels, which
+                names users, glades and lease keys (/forest-state, ?format=text
+                for people), as JSON to the tree's keepers
+  --user-rate-up, --user-rate-down  Cap the fairy dust flowing from and to all
+                leaves of a user (e.g. 2MB, 512KB or 10mbit per second)
+  --leaf-rate-up, --leaf-rate-down  Cap the fairy dust flowing from and to
+                each leaf
+  --user-max-channels, --leaf-max-channels  Limit the channels open at once
+                for all leaves of a user, and for each leaf. Channels beyond
+                the limit are refused
+  --user-channel-rate, --leaf-channel-rate  Limit how quickly new channels
+                may open (e.g. 10/s or 100/1m), refusing those beyond it
+  --usage-ledger  Path of a ledger where the tree tallies the fairy dust,
+                channels and connected time of every user and leaf by day and
+                month (UTC). The ledger survives restarts, is read with
+                'engrave usage' and, with --admin, served at /forest-usage
+  --user-quota-daily, --user-quota-monthly  Refuse new channels of users whose
+                fairy dust (both ways) reached the quota this day or month
+                (e.g. 10GB). Requires --usage-ledger
+  --access-log  Record every channel as a line of JSON in this scroll (- for
+                stdout): its sessions, user, peer, direction, source,
+                destination as asked for and as resolved, fairy dust each way,
+                duration and why it closed. Written whether or not -v is given
+  --access-log-size  Rotate the access log once it grows past this size
+                (default 100MB)
+  --access-log-keep  Number of rotated access logs kept (default 5)
+  --drain-timeout  On SIGTERM or SIGINT, stop taking new leaves and channels,
+                tell the leaves to reconnect elsewhere and wait this long for
+                the open channels to finish before withering (e.g. 30s). While
+                draining /forest-health answers 503. A second signal withers at
+                once, as does the first by default (0)
+  --config      A YAML scroll of the tree's configuration (see below), read
+                again on SIGHUP
+  --check-config  Validate the configuration, print it in the scroll's form
+                with its secrets redacted and exit (1 when invalid)
+
+📜 Configuration scroll:
+   Every enchantment above may be given by the scroll of --config instead.
+   Enchantments win over the environment (HOST, PORT, AUTH, ENGRAVE_KEY_FILE
+   and ENGRAVE_KEY), which wins over the scroll. The other ENGRAVE_*
+   whispers only come from the environment. For example:
+
+     listen: {host: 0.0.0.0, port: 443, vhost: ":8443", sni: "", sni-passthrough: false}
+     tls: {key: tree.key, cert: tree.crt, domains: [], ca: leaves-ca.pem}
+     keys: {file: /etc/engrave/tree.key}       # --keyfile (and seed, --key)
+     auth:
+       file: /etc/engrave/users.json           # --authfile
+       user: admin:secret                      # --auth
+       users:                                  # as in an authfile, "*" allows all
+         alice: {password: secret, allow: ["^10\\.0\\.", "example.com:443"]}
+     backend: http://127.0.0.1:3000
+     reverse: true
+     socks5: false
+     keepalive: 25s
+     vhost-domain: tunnels.example.com
+     reverse-pool: 30000-30999
+     reverse-lease: 1m
+     limits: {user-rate-up: 10mbit, user-max-channels: 100, user-quota-daily: 10GB}
+     usage-ledger: /var/lib/engrave/usage.json
+     access-log: {path: /var/log/engrave/access.log, size: 100MB, keep: 5}
+     logging: {format: json, level: info, verbose: false}
+     metrics: true
+     admin: 127.0.0.1:9090
+     drain-timeout: 30s
+     pid: false
+
+   The limits take the names of their enchantments (user-rate-down,
+   leaf-max-channels, user-channel-rate, ...).
 ` + commonEnchantment
 
 func summonTree(spellComponents []string) {
-	enchantment := flag.NewFlagSet("tree", flag.ContinueOnError)
-	treeConfig := &treekeeper.EnchantedConfig{}
-
-	enchantment.StringVar(&treeConfig.AncientSeed, "key", "", "")
-	enchantment.StringVar(&treeConfig.RuneScroll, "keyfile", "", "")
-	enchantment.StringVar(&treeConfig.FaeRegistry, "authfile", "", "")
-	enchantment.StringVar(&treeConfig.FaeWhisper, "auth", "", "")
-	enchantment.DurationVar(&treeConfig.MagicalPulse, "keepalive", 25*time.Second, "")
-	enchantment.StringVar(&treeConfig.MysticalPortal, "proxy", "", "")
-	enchantment.StringVar(&treeConfig.MysticalPortal, "backend", "", "")
-	enchantment.BoolVar(&treeConfig.FaerieSocks, "socks5", false, "")
-	enchantment.BoolVar(&treeConfig.ReverseSpell, "reverse", false, "")
-	enchantment.StringVar(&treeConfig.FaerieTLS.Key, "tls-key", "", "")
-	enchantment.StringVar(&treeConfig.FaerieTLS.Cert, "tls-cert", "", "")
-	enchantment.Var(multiFlag{&treeConfig.FaerieTLS.Domains}, "tls-domain", "")
-	enchantment.StringVar(&treeConfig.FaerieTLS.CA, "tls-ca", "", "")
-
-	realm := enchantment.String("host", "", "")
-	p := enchantment.String("p", "", "")
-	gateway := enchantment.String("port", "", "")
-	inscribeRune := enchantment.Bool("pid", false, "")
-	enhancedSenses := enchantment.Bool("v", false, "")
-	growNewKey := enchantment.String("keygen", "", "")
+	treeConfig, spirit, err := parseTreeEnchantments(spellComponents)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	enchantment.Usage = func() {
-		fmt.Print(treeEnchantment)
-		os.Exit(0)
+	if spirit.checkConfig {
+		checkTreeConfig(treeConfig, spirit)
+		return
 	}
-	enchantment.Parse(spellComponents)
 
-	if *growNewKey != "" {
-		if err := faecrypto.InscribeMagicalRuneScroll(*growNewKey, treeConfig.AncientSeed); err != nil {
+	if spirit.growNewKey != "" {
+		if err := faecrypto.InscribeMagicalRuneScroll(spirit.growNewKey, treeConfig.AncientSeed); err != nil {
 			log.Fatal(err)
 		}
 		return
@@ -144,53 +253,287 @@ func summonTree(spellComponents []string) {
 		log.Print("Please use 'engrave tree --keygen /path/to/scroll', then 'engrave tree --keyfile /path/to/scroll' to specify your tree's sacred scroll")
 	}
 
-	if *realm == "" {
-		*realm = os.Getenv("HOST")
+	if err := faeio.ConfigureWhispers(spirit.Logging.Format, spirit.Logging.Level); err != nil {
+		log.Fatal(err)
 	}
-	if *realm == "" {
-		*realm = "0.0.0.0"
+
+	tree, err := treekeeper.PlantNewTree(treeConfig)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *gateway == "" {
-		*gateway = *p
+
+	tree.Debug = spirit.Logging.Verbose
+
+	if spirit.PID {
+		inscribeMagicalRune()
 	}
-	if *gateway == "" {
-		*gateway = os.Getenv("PORT")
+
+	go faeOS.WhisperFaerieStats(func() faeOS.ForestState {
+		return tree.State()
+	})
+
+	go faeOS.WhisperReload(func() error {
+		reloaded, _, err := parseTreeEnchantments(spellComponents)
+		if err != nil {
+			return err
+		}
+		return tree.Reload(reloaded)
+	})
+
+	handedOff := make(chan struct{})
+	go faeOS.WhisperHandoff(func() error {
+		if err := tree.Handoff(); err != nil {
+			return err
+		}
+		close(handedOff)
+		return nil
+	})
+
+	ctx := drainGracefully(treeConfig.DrainTimeout, tree.Drain, handedOff)
+	if err := tree.SproutInContext(ctx, spirit.Listen.Host, spirit.Listen.Port); err != nil {
+		log.Fatal(err)
 	}
-	if *gateway == "" {
-		*gateway = "8080"
+	faenet.HeirReady()
+	faeOS.NotifyReady()
+	go faeOS.TendWatchdog(tree.Vitality)
+
+	if err := tree.AwaitDormancy(); err != nil {
+		log.Fatal(err)
 	}
+}
+
+// treeSpirit holds the tree's enchantments: its effective scroll, along
+// with those which only direct the command
+type treeSpirit struct {
+	*treeScroll
+	config      string
+	checkConfig bool
+	growNewKey  string
+	// domains given by --tls-domain, which replace those of the scroll
+	domains []string
+}
 
-	if treeConfig.RuneScroll == "" {
-		treeConfig.RuneScroll = enchantments.WhisperEnchantment("KEY_FILE")
-	} else if treeConfig.AncientSeed == "" {
-		treeConfig.AncientSeed = enchantments.WhisperEnchantment("KEY")
+// parseTreeEnchantments parses the tree's enchantments over the scroll
+// of --config, if any, and the environment: enchantments win over the
+// environment, which wins over the scroll. It is parsed anew on every
+// reload, rereading the scroll.
+func parseTreeEnchantments(spellComponents []string) (*treekeeper.EnchantedConfig, treeSpirit, error) {
+	spirit := treeSpirit{treeScroll: summonTreeScroll()}
+	// a first parse finds the scroll, which the enchantments are then
+	// parsed over
+	treeEnchantments(&spirit).Parse(spellComponents)
+	scroll := summonTreeScroll()
+	if spirit.config != "" {
+		if err := scroll.read(spirit.config); err != nil {
+			return nil, spirit, err
+		}
+	}
+	scroll.whisperEnvironment()
+	spirit = treeSpirit{treeScroll: scroll}
+	treeEnchantments(&spirit).Parse(spellComponents)
+	if len(spirit.domains) > 0 {
+		scroll.TLS.Domains = spirit.domains
 	}
+	if scroll.Listen.Host == "" {
+		scroll.Listen.Host = "0.0.0.0"
+	}
+	if scroll.Listen.Port == "" {
+		scroll.Listen.Port = "8080"
+	}
+	treeConfig, err := scroll.enchantedConfig()
+	if err != nil {
+		return nil, spirit, fmt.Errorf("%s: %s", spirit.config, err)
+	}
+	return treeConfig, spirit, nil
+}
 
-	if treeConfig.FaeWhisper == "" {
-		treeConfig.FaeWhisper = os.Getenv("AUTH")
+// treeEnchantments returns the tree's enchantments, bound to the spirit
+// and defaulting to its settings
+func treeEnchantments(spirit *treeSpirit) *flag.FlagSet {
+	enchantment := flag.NewFlagSet("tree", flag.ContinueOnError)
+	s := spirit.treeScroll
+
+	enchantment.StringVar(&s.Keys.Seed, "key", s.Keys.Seed, "")
+	enchantment.StringVar(&s.Keys.File, "keyfile", s.Keys.File, "")
+	enchantment.StringVar(&s.Auth.File, "authfile", s.Auth.File, "")
+	enchantment.StringVar(&s.Auth.User, "auth", s.Auth.User, "")
+	enchantment.DurationVar(&s.Keepalive, "keepalive", s.Keepalive, "")
+	enchantment.StringVar(&s.Backend, "proxy", s.Backend, "")
+	enchantment.StringVar(&s.Backend, "backend", s.Backend, "")
+	enchantment.BoolVar(&s.Socks5, "socks5", s.Socks5, "")
+	enchantment.BoolVar(&s.Reverse, "reverse", s.Reverse, "")
+	enchantment.StringVar(&s.TLS.Key, "tls-key", s.TLS.Key, "")
+	enchantment.StringVar(&s.TLS.Cert, "tls-cert", s.TLS.Cert, "")
+	enchantment.StringVar(&s.TLS.CA, "tls-ca", s.TLS.CA, "")
+	enchantment.Var(multiFlag{&spirit.domains}, "tls-domain", "")
+	enchantment.StringVar(&s.VhostDomain, "vhost-domain", s.VhostDomain, "")
+	enchantment.StringVar(&s.Listen.Vhost, "vhost-listen", s.Listen.Vhost, "")
+	enchantment.StringVar(&s.Listen.SNI, "sni-listen", s.Listen.SNI, "")
+	enchantment.BoolVar(&s.Listen.SNIPassthrough, "sni-passthrough", s.Listen.SNIPassthrough, "")
+	enchantment.StringVar(&s.ReversePool, "reverse-pool", s.ReversePool, "")
+	enchantment.DurationVar(&s.ReverseLease, "reverse-lease", s.ReverseLease, "")
+	enchantment.BoolVar(&s.Metrics, "metrics", s.Metrics, "")
+	enchantment.StringVar(&s.Admin, "admin", s.Admin, "")
+	enchantment.StringVar(&s.Limits.UserRateUp, "user-rate-up", s.Limits.UserRateUp, "")
+	enchantment.StringVar(&s.Limits.UserRateDown, "user-rate-down", s.Limits.UserRateDown, "")
+	enchantment.StringVar(&s.Limits.LeafRateUp, "leaf-rate-up", s.Limits.LeafRateUp, "")
+	enchantment.StringVar(&s.Limits.LeafRateDown, "leaf-rate-down", s.Limits.LeafRateDown, "")
+	enchantment.IntVar(&s.Limits.UserMaxChannels, "user-max-channels", s.Limits.UserMaxChannels, "")
+	enchantment.IntVar(&s.Limits.LeafMaxChannels, "leaf-max-channels", s.Limits.LeafMaxChannels, "")
+	enchantment.StringVar(&s.Limits.UserChannelRate, "user-channel-rate", s.Limits.UserChannelRate, "")
+	enchantment.StringVar(&s.Limits.LeafChannelRate, "leaf-channel-rate", s.Limits.LeafChannelRate, "")
+	enchantment.StringVar(&s.UsageLedger, "usage-ledger", s.UsageLedger, "")
+	enchantment.StringVar(&s.Limits.UserQuotaDaily, "user-quota-daily", s.Limits.UserQuotaDaily, "")
+	enchantment.StringVar(&s.Limits.UserQuotaMonthly, "user-quota-monthly", s.Limits.UserQuotaMonthly, "")
+	enchantment.StringVar(&s.AccessLog.Path, "access-log", s.AccessLog.Path, "")
+	enchantment.StringVar(&s.AccessLog.Size, "access-log-size", s.AccessLog.Size, "")
+	enchantment.IntVar(&s.AccessLog.Keep, "access-log-keep", s.AccessLog.Keep, "")
+	enchantment.DurationVar(&s.DrainTimeout, "drain-timeout", s.DrainTimeout, "")
+
+	enchantment.StringVar(&s.Listen.Host, "host", s.Listen.Host, "")
+	enchantment.StringVar(&s.Listen.Port, "p", s.Listen.Port, "")
+	enchantment.StringVar(&s.Listen.Port, "port", s.Listen.Port, "")
+	enchantment.BoolVar(&s.PID, "pid", s.PID, "")
+	enchantment.BoolVar(&s.Logging.Verbose, "v", s.Logging.Verbose, "")
+	enchantment.StringVar(&s.Logging.Format, "log-format", s.Logging.Format, "")
+	enchantment.StringVar(&s.Logging.Level, "log-level", s.Logging.Level, "")
+	enchantment.StringVar(&spirit.config, "config", spirit.config, "")
+	enchantment.BoolVar(&spirit.checkConfig, "check-config", spirit.checkConfig, "")
+	enchantment.StringVar(&spirit.growNewKey, "keygen", spirit.growNewKey, "")
+
+	enchantment.Usage = func() {
+		fmt.Print(treeEnchantment)
+		os.Exit(0)
 	}
+	return enchantment
+}
 
-	tree, err := treekeeper.PlantNewTree(treeConfig)
+// checkTreeConfig validates the tree's configuration and prints it,
+// its secrets redacted, exiting with 1 when it is invalid
+func checkTreeConfig(treeConfig *treekeeper.EnchantedConfig, spirit treeSpirit) {
+	err := faeio.ConfigureWhispers(spirit.Logging.Format, spirit.Logging.Level)
+	if err == nil {
+		err = treekeeper.CheckConfig(treeConfig)
+	}
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("# Effective configuration of the tree, secrets redacted")
+	if err := spirit.redacted().inscribe(os.Stdout); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	tree.Debug = *enhancedSenses
+// handoffDrainTimeout is how long a tree drains after a handoff when no
+// --drain-timeout is given, its leaves reconnecting to the heir meanwhile
+const handoffDrainTimeout = 30 * time.Second
 
-	if *inscribeRune {
-		inscribeMagicalRune()
-	}
+// drainGracefully returns a context done once the process should wither:
+// when interrupted, or with a timeout, once drained after the first
+// interrupt (at most for the timeout) or at the next interrupt. After a
+// handoff the process always drains, at most for the timeout or else
+// handoffDrainTimeout.
+func drainGracefully(timeout time.Duration, drain func(context.Context), handedOff <-chan struct{}) context.Context {
+	draining, halted := faeOS.WhisperDrainContexts(timeout > 0, handedOff)
+	ctx, wither := context.WithCancel(halted)
+	go func() {
+		<-draining.Done()
+		select {
+		case <-handedOff:
+			if timeout <= 0 {
+				timeout = handoffDrainTimeout
+			}
+		default:
+		}
+		if timeout > 0 {
+			deadline, cancel := context.WithTimeout(ctx, timeout)
+			drain(deadline)
+			cancel()
+		}
+		wither()
+	}()
+	return ctx
+}
 
-	go faeOS.WhisperFaerieStats()
+var usageEnchantment = `
+📜 Usage: engrave usage [enchantments]
 
-	ctx := faeOS.WhisperInterruptContext()
-	if err := tree.SproutInContext(ctx, *realm, *gateway); err != nil {
-		log.Fatal(err)
-	}
+Reads the usage ledger a tree inscribes (see tree --usage-ledger) and shows
+the fairy dust, channels and connected time of every user today, this month
+and in total. Days and months are in UTC. The tree inscribes the ledger every
+30s, so the newest usage may be missing (see /forest-usage on the tree's
+--admin for it).
 
-	if err := tree.AwaitDormancy(); err != nil {
+🌿 Enchantments:
+  --ledger   Path of the usage ledger (defaults to the USAGE_LEDGER whisper)
+  --user     Only show the given user (and their leaves)
+  --leaves   Show every leaf instead of every user
+  --json     Show the records as JSON
+  --help     This scroll of wisdom
+`
+
+func readUsageLedger(spellComponents []string) {
+	enchantment := flag.NewFlagSet("usage", flag.ContinueOnError)
+	ledger := enchantment.String("ledger", "", "")
+	user := enchantment.String("user", "", "")
+	leaves := enchantment.Bool("leaves", false, "")
+	asJSON := enchantment.Bool("json", false, "")
+	enchantment.Usage = func() {
+		fmt.Print(usageEnchantment)
+		os.Exit(0)
+	}
+	enchantment.Parse(spellComponents)
+	if *ledger == "" {
+		*ledger = os.Getenv("USAGE_LEDGER")
+	}
+	if *ledger == "" {
+		log.Fatal("A usage ledger is required (--ledger)")
+	}
+	scroll, err := treekeeper.ReadUsageScroll(*ledger)
+	if err != nil {
 		log.Fatal(err)
 	}
+	records := scroll.Users
+	if *leaves {
+		records = scroll.Leaves
+	}
+	if *user != "" {
+		chosen := map[string]*treekeeper.UsageRecord{}
+		for name, r := range records {
+			if name == *user || strings.HasPrefix(name, *user+"/") {
+				chosen[name] = r
+			}
+		}
+		records = chosen
+	}
+	if *asJSON {
+		b, _ := json.MarshalIndent(records, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTODAY\tMONTH\tTOTAL\tCHANNELS\tCHANNEL MIN\tCONNECTED MIN\tLAST SEEN")
+	for _, name := range names {
+		r := records[name]
+		day, month := r.Day(now), r.Month(now)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%.1f\t%.1f\t%s\n",
+			name,
+			sizestr.ToString(day.Up+day.Down),
+			sizestr.ToString(month.Up+month.Down),
+			sizestr.ToString(r.Total.Up+r.Total.Down),
+			r.Total.Channels,
+			r.Total.ChannelMinutes,
+			r.Total.ConnectedMinutes,
+			r.LastSeen.Local().Format("2006-01-02 15:04"))
+	}
+	w.Flush()
 }
 
 type multiFlag struct {
@@ -233,9 +576,12 @@ func (flag *headerFlags) Set(arg string) error {
 }
 
 var leafEnchantment = `
-🍃 Usage: engrave leaf [enchantments] <tree> <pathway> [pathway] ...
+🍃 Usage: engrave leaf [enchantments] <tree> <pathway> [pathway] ... [--- [enchantments] <tree> <pathway> ...]
+       engrave leaf --profile <name> [enchantments] [pathway] ... [--- ...]
 
-<tree> is the mystical address of the Engrave tree.
+<tree> is the mystical address of the Engrave tree. A single leaf may grow towards
+several trees at once: each session after a --- has its own tree, enchantments and
+pathways, and reconnects on its own.
 <pathway>s are secret tunnels through the tree, each in the form:
 <local-glade>:<local-portal>:<distant-glade>:<distant-portal>/<element>
 
@@ -251,6 +597,64 @@ R:<local-interface>:<local-portal>:<distant-glade>:<distant-portal>/<element>
 
 Which creates a reverse tunnel, sharing <distant-glade>:<distant-portal> from the leaf to the tree's <local-interface>:<local-portal>.
 
+Pathways may also be written as URLs, which can carry charms (per-pathway options):
+
+<element>://<local-glade>:<local-portal>?target=<distant-glade>:<distant-portal>&via=<side>&<charm>=<value>
+
+■ element is tcp, udp, socks or whisper.
+■ target defaults to 127.0.0.1 and the local-portal.
+■ via is remote (the default) or local, which creates a reverse tunnel.
+■ idle closes channels after no fairy dust flows for the given duration (e.g. 5m).
+■ max_conns limits the number of channels open at once, and conn_rate how
+  quickly they may open (e.g. 10/s or 100/1m). Connections beyond either are
+  refused.
+■ lifetime closes channels once they have been open for the given duration
+  (e.g. 12h), whether or not fairy dust still flows.
+■ group=<name> lets several leaves serve the same reverse pathway: the tree
+  listens once and spreads connections across the leaves of the group, as
+  chosen by balance=round-robin (the default) or balance=least-conn. Leaves
+  leave the group the moment they disconnect.
+■ Targets may list up to 32 glade:portal pairs separated by commas, which
+  the dialing side spreads connections across as chosen by
+  balance=round-robin (the default), least-conn or failover. Targets are
+  checked every health interval (default 10s, at least 1s, 0s disables) and
+  ejected after eject_after failed dials (default 3) until they pass a check
+  again.
+■ rate_up and rate_down cap the fairy dust flowing towards the target and back
+  (e.g. 2MB, 512KB or 10mbit per second), shared by every channel of the pathway.
+■ priority=interactive, normal (the default) or bulk orders the writes of
+  channels sharing one connection: interactive channels go first, so
+  keystrokes stay quick while transfers run. Channels of the same class take
+  turns, so no single channel hogs the connection. Both sides must know the charm.
+■ tls=true originates TLS towards the target, verified with tls_ca (defaults to
+  the system pool) against tls_sni (defaults to the distant-glade). tls_cert and
+  tls_key present a leaf certificate, tls_skip_verify=true disables verification.
+■ tls_serve_cert and tls_serve_key terminate TLS on the listening side. For
+  reverse tunnels the leaf terminates TLS, so certificates stay on the leaf.
+
+HTTP services may also be shared through the tree's own listener, routed by name:
+
+R:http:<name>:<distant-glade>:<distant-portal>
+
+Which serves <distant-glade>:<distant-portal> from the leaf as <name>.<vhost-domain>
+on the tree (distant-glade defaults to 127.0.0.1, distant-portal to 80). As a URL,
+http://<name>?via=local&target=... also accepts basic_auth=<user>:<pass> and
+access_log=true.
+
+R:sni:<name>:<distant-glade>:<distant-portal>
+
+Which passes TLS connections for the server name <name> arriving on the tree's
+sni listener through to <distant-glade>:<distant-portal> (distant-portal defaults
+to 443). The tree never decrypts them.
+
+Portals may also be given as a range (<first>-<last>) on both sides, which
+shares every portal in the range through a single pathway. Both ranges must
+cover the same number of portals, at most 1024 unless raised through
+$ENGRAVE_FOREST_MAX_PORTAL_SPAN.
+
+Reverse pathways may ask the tree to pick a free local-portal by giving 0
+(e.g. R:0:localhost:22). The leaf logs the portal it was granted.
+
 🌿 Pathway examples:
 3000
 example.com:3000
@@ -263,6 +667,18 @@ R:socks
 R:5000:socks
 breeze:example.com:22
 1.1.1.1:53/air
+8000-8010:10.0.0.5:8000-8010
+R:30000-30100:localhost:30000-30100
+R:0:localhost:22
+tcp://127.0.0.1:5432?target=db.internal:5432&idle=5m&max_conns=20&conn_rate=10/s
+tcp://0.0.0.0:2222?via=local&target=localhost:22
+tcp://127.0.0.1:8443?target=api.internal:443&tls=true&tls_ca=/etc/ca.pem
+tcp://0.0.0.0:8080?via=local&target=localhost:8080&group=web
+5432:db1:5432,db2:5432
+tcp://127.0.0.1:5432?target=db1:5432,db2:5432&balance=failover&health=5s
+tcp://127.0.0.1:2222?target=bastion:22&priority=interactive
+R:http:myapp:localhost:3000
+R:sni:db.example.com:localhost:5432
 
 🍄 Enchantments:
   --fingerprint   A strongly recommended magical sigil to verify the tree's identity
@@ -278,74 +694,342 @@ breeze:example.com:22
   --tls-skip-verify   Trust the tree without verification (use with caution!)
   --tls-key       Path to the leaf's private TLS rune for mutual authentication
   --tls-cert      Path to the leaf's public TLS rune for mutual authentication
+  --fallback      A further tree to grow towards when the others are out of reach,
+                  as <tree>[#<fingerprint>], held to --fingerprint when given
+                  without one (may be given more than once)
+  --tree-choice   Try the trees by 'priority' (in the order given, the default) or
+                  by measured 'latency'
+  --failback-interval   How often to probe the primary tree while connected to a
+                  fallback, failing back once it recovers (default 30s, 0 disables)
+  --connections   Open this many connections to the tree and spread channels
+                  across them (default 1). Reverse pathways are shared by every
+                  connection, and the leaf keeps working while any of them is up.
+                  Every connection grows towards the same tree, failing over and
+                  back together
+  --access-log    Record every channel as a line of JSON in this scroll (- for
+                  stdout), rotated at --access-log-size (default 100MB) keeping
+                  --access-log-keep old scrolls (default 5). Sessions naming the
+                  same scroll share it
+  --portal-file   Inscribe the reverse pathways as granted by the tree (including
+                  portals it picked) into this scroll on every connection
+  --name          Name this session in the logs and status (defaults to session#<n>
+                  when several sessions are given)
+  --admin         A glade:portal serving the status of every session (/forest-status),
+                  the state of its tunnels (/forest-state, ?format=text for people)
+                  and metrics (/forest-metrics) as JSON
+  --drain-timeout   On SIGTERM or SIGINT, stop taking new channels, tell the trees
+                  and wait this long for the open channels to finish before
+                  withering (e.g. 30s). A second signal withers at once, as does
+                  the first by default (0). Leaves also reconnect elsewhere when
+                  their tree drains
+  --profile       Grow the session from this profile of the scroll (see below)
+  --config        The scroll of the profiles (defaults to the ENGRAVE_LEAF_CONFIG
+                  whisper, or engrave/leaf.yaml in the user's configuration glade,
+                  such as ~/.config/engrave/leaf.yaml)
+
+📜 Profiles:
+   A scroll in YAML or JSON may describe sessions by name, each grown with
+   --profile <name> (a scroll of a single profile needs no --profile). Further
+   enchantments win over the profile, and any arguments are added to its
+   pathways. Several profiles grow together as sessions, separated by ---.
+   For example:
+
+     profiles:
+       staging:
+         tree: https://staging.example.com
+         fingerprint: Cn7xPHbvTcJ2YOkqQy5OyVYOJ1o8+IiA8h1oVQbYD7A=
+         fallbacks: ["https://backup.example.com#<fingerprint>"]
+         tree-choice: priority
+         failback-interval: 30s
+         auth:
+           user: deploy
+           password-env: STAGING_PASSWORD  # or password: ..., or password-file: ...
+         tls: {ca: /etc/engrave/ca.pem, cert: leaf.crt, key: leaf.key, sni: tunnels.example.com}
+         proxy: socks5h://127.0.0.1:1080
+         headers: {X-Team: platform}
+         hostname: staging.example.com
+         keepalive: 25s
+         max-retry-count: -1
+         max-retry-interval: 5m
+         connections: 2
+         portal-file: /run/engrave/staging.portals
+         access-log: {path: /var/log/engrave/staging.log, size: 100MB, keep: 5}
+         remotes:
+           - 5432:db.internal:5432
+           - R:2222:localhost:22
+           - tcp://127.0.0.1:6379?target=cache.internal:6379&idle=5m
+
+   The scroll is watched: once it changes, each profile is read anew. Added
+   and removed pathways are applied without restarting the leaf, as the
+   listeners of forward pathways which stay remain open; when pathways are
+   added, or reverse ones removed, the leaf reconnects to tell its tree,
+   closing the channels open at the time. Changes to other settings, or to
+   whether the session has reverse pathways at all, grow the session anew.
+   A profile which fails to read leaves its session as it was.
 ` + commonEnchantment
 
 func conjureLeaf(spellComponents []string) {
-	enchantments := flag.NewFlagSet("leaf", flag.ContinueOnError)
-	leafConfig := leafwhisper.LeafConfig{MagicalSeals: http.Header{}}
-
-	enchantments.StringVar(&leafConfig.MagicalRune, "fingerprint", "", "")
-	enchantments.StringVar(&leafConfig.FaeWhisper, "auth", "", "")
-	enchantments.DurationVar(&leafConfig.MagicalPulse, "keepalive", 25*time.Second, "")
-	enchantments.IntVar(&leafConfig.MaxRevivalCount, "max-retry-count", -1, "")
-	enchantments.DurationVar(&leafConfig.MaxRevivalPause, "max-retry-interval", 0, "")
-	enchantments.StringVar(&leafConfig.MysticalPortal, "proxy", "", "")
-	enchantments.StringVar(&leafConfig.FaerieTLS.CA, "tls-ca", "", "")
-	enchantments.BoolVar(&leafConfig.FaerieTLS.SkipVerify, "tls-skip-verify", false, "")
-	enchantments.StringVar(&leafConfig.FaerieTLS.Cert, "tls-cert", "", "")
-	enchantments.StringVar(&leafConfig.FaerieTLS.Key, "tls-key", "", "")
-	enchantments.Var(&headerFlags{leafConfig.MagicalSeals}, "header", "")
-
-	treeName := enchantments.String("hostname", "", "")
-	magicalName := enchantments.String("sni", "", "")
-	inscribeRune := enchantments.Bool("pid", false, "")
-	enhancedSenses := enchantments.Bool("v", false, "")
-
-	enchantments.Usage = func() {
-		fmt.Print(leafEnchantment)
-		os.Exit(0)
+	canopy := leafwhisper.NewCanopy()
+	sessions := []*leafSession{}
+	spirit := leafSpirit{}
+	for _, args := range splitLeafSessions(spellComponents) {
+		session, err := parseLeafSession(args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sessions = append(sessions, session)
+		spirit.merge(session.spirit)
 	}
-	enchantments.Parse(spellComponents)
 
-	spellComponents = enchantments.Args()
-	if len(spellComponents) < 2 {
-		log.Fatalf("A tree and at least one pathway are required for the spell")
+	if err := faeio.ConfigureWhispers(spirit.logFormat, spirit.logLevel); err != nil {
+		log.Fatal(err)
 	}
 
-	leafConfig.AncientTree = spellComponents[0]
-	leafConfig.EnchantedPaths = spellComponents[1:]
+	for i, session := range sessions {
+		if len(sessions) > 1 && session.config.Name == "" {
+			session.config.Name = fmt.Sprintf("session#%d", i+1)
+		}
+		session.config.Whisperer = canopy.Whisperer
+		leaf, err := leafwhisper.GrowNewLeaf(session.config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		session.leaf = leaf
+		canopy.Adopt(leaf)
+	}
 
-	if leafConfig.FaeWhisper == "" {
-		leafConfig.FaeWhisper = os.Getenv("AUTH")
+	canopy.Debug = spirit.enhancedSenses
+
+	if spirit.inscribeRune {
+		inscribeMagicalRune()
 	}
 
-	if *treeName != "" {
-		leafConfig.MagicalSeals.Set("Host", *treeName)
-		leafConfig.FaerieTLS.ServerName = *treeName
+	go faeOS.WhisperFaerieStats(func() faeOS.ForestState {
+		return canopy.State()
+	})
+
+	ctx := drainGracefully(spirit.drainTimeout, canopy.Drain, nil)
+	if spirit.admin != "" {
+		if err := canopy.ServeAdmin(ctx, spirit.admin); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if *magicalName != "" {
-		leafConfig.FaerieTLS.ServerName = *magicalName
+	if err := canopy.Sprout(ctx); err != nil {
+		log.Fatal(err)
 	}
+	watchLeafProfiles(canopy, sessions)
+	go faeOS.TendWatchdog(canopy.Vitality)
 
-	leaf, err := leafwhisper.GrowNewLeaf(&leafConfig)
-	if err != nil {
+	if err := canopy.AwaitDormancy(); err != nil {
 		log.Fatal(err)
 	}
+}
 
-	leaf.Debug = *enhancedSenses
+// leafSession is a tree session of the leaf, as described by its
+// enchantments over the profile they name, if any
+type leafSession struct {
+	args    []string
+	config  *leafwhisper.LeafConfig
+	spirit  leafSpirit
+	scroll  string // the scroll of the profile
+	profile string
+	leaf    *leafwhisper.Leaf
+	// given by enchantments over the profile
+	fallbacks             []string
+	treeName, magicalName string
+}
 
-	if *inscribeRune {
-		inscribeMagicalRune()
+// watchLeafProfiles reconfigures the sessions grown from profiles
+// whenever their scroll changes
+func watchLeafProfiles(canopy *leafwhisper.Canopy, sessions []*leafSession) {
+	scrolls := map[string][]*leafSession{}
+	for _, session := range sessions {
+		if session.scroll != "" {
+			scrolls[session.scroll] = append(scrolls[session.scroll], session)
+		}
 	}
+	for scroll, watched := range scrolls {
+		var reconfiguring sync.Mutex
+		_, err := enchantments.WatchScroll(scroll, func() {
+			reconfiguring.Lock()
+			defer reconfiguring.Unlock()
+			for _, session := range watched {
+				session.reconfigure(canopy)
+			}
+		})
+		if err != nil {
+			canopy.Cryf("🍄 Failed to watch %s: %s", scroll, err)
+		}
+	}
+}
 
-	go faeOS.WhisperFaerieStats()
+// reconfigure applies the session's profile as read anew, leaving the
+// leaf as it was when the profile is invalid
+func (s *leafSession) reconfigure(canopy *leafwhisper.Canopy) {
+	reread, err := parseLeafSession(s.args)
+	if err == nil {
+		if reread.config.Name == "" {
+			reread.config.Name = s.config.Name
+		}
+		reread.config.Whisperer = canopy.Whisperer
+		s.leaf, err = canopy.Reconfigure(s.leaf, reread.config)
+	}
+	if err != nil {
+		canopy.Cryf("🍄 Failed to apply profile %s anew, nothing changed: %s", s.profile, err)
+		return
+	}
+	s.config = reread.config
+}
 
-	ctx := faeOS.WhisperInterruptContext()
-	if err := leaf.Sprout(ctx); err != nil {
-		log.Fatal(err)
+// leafSpirit holds the process-wide enchantments of the leaf, which
+// may be given with any of its tree sessions
+type leafSpirit struct {
+	admin                        string
+	inscribeRune, enhancedSenses bool
+	logFormat, logLevel          string
+	drainTimeout                 time.Duration
+}
+
+// merge adds the enchantments of another session, the later ones winning
+func (s *leafSpirit) merge(other leafSpirit) {
+	if other.admin != "" {
+		s.admin = other.admin
+	}
+	if other.logFormat != "" {
+		s.logFormat = other.logFormat
 	}
+	if other.logLevel != "" {
+		s.logLevel = other.logLevel
+	}
+	if other.drainTimeout != 0 {
+		s.drainTimeout = other.drainTimeout
+	}
+	s.inscribeRune = s.inscribeRune || other.inscribeRune
+	s.enhancedSenses = s.enhancedSenses || other.enhancedSenses
+}
 
-	if err := leaf.AwaitDormancy(); err != nil {
-		log.Fatal(err)
+// splitLeafSessions splits the leaf's arguments into one set per
+// tree session, separated by ---
+func splitLeafSessions(spellComponents []string) [][]string {
+	sessions := [][]string{{}}
+	for _, arg := range spellComponents {
+		if arg == "---" {
+			sessions = append(sessions, []string{})
+			continue
+		}
+		sessions[len(sessions)-1] = append(sessions[len(sessions)-1], arg)
+	}
+	return sessions
+}
+
+// parseLeafSession parses the enchantments of a single tree session,
+// along with the process-wide --admin, --pid, -v, --drain-timeout and
+// logging enchantments. With --profile (or --config), they are parsed
+// over the profile, and any arguments are further pathways.
+func parseLeafSession(spellComponents []string) (*leafSession, error) {
+	// a first parse finds the profile, which the enchantments are then
+	// parsed over
+	probe := &leafSession{}
+	leafEnchantments(summonLeafConfig(), probe).Parse(spellComponents)
+	session := &leafSession{args: spellComponents, scroll: probe.scroll, profile: probe.profile}
+	leafConfig := summonLeafConfig()
+	if session.profile != "" || session.scroll != "" {
+		if session.scroll == "" {
+			session.scroll = defaultLeafScroll()
+		}
+		scroll, err := readLeafScroll(session.scroll)
+		if err != nil {
+			return nil, err
+		}
+		profile, name, err := scroll.profile(session.profile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", session.scroll, err)
+		}
+		if err := profile.sow(leafConfig); err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %s", session.scroll, name, err)
+		}
+		session.profile = name
+		leafConfig.Name = name
+	}
+	profiled := session.scroll != ""
+	session.config = leafConfig
+	enchantment := leafEnchantments(leafConfig, session)
+	enchantment.Parse(spellComponents)
+	if len(session.fallbacks) > 0 {
+		leafConfig.FallbackTrees = session.fallbacks
+	}
+
+	spellComponents = enchantment.Args()
+	if profiled {
+		leafConfig.EnchantedPaths = append(leafConfig.EnchantedPaths, spellComponents...)
+		if leafConfig.AncientTree == "" || len(leafConfig.EnchantedPaths) == 0 {
+			return nil, fmt.Errorf("%s: profile %s needs a tree and at least one pathway", session.scroll, session.profile)
+		}
+	} else {
+		if len(spellComponents) < 2 {
+			return nil, errors.New("A tree and at least one pathway are required for the spell")
+		}
+		leafConfig.AncientTree = spellComponents[0]
+		leafConfig.EnchantedPaths = spellComponents[1:]
+	}
+
+	if leafConfig.FaeWhisper == "" {
+		leafConfig.FaeWhisper = os.Getenv("AUTH")
+	}
+
+	if session.treeName != "" {
+		leafConfig.MagicalSeals.Set("Host", session.treeName)
+		leafConfig.FaerieTLS.ServerName = session.treeName
+	}
+	if session.magicalName != "" {
+		leafConfig.FaerieTLS.ServerName = session.magicalName
 	}
+	return session, nil
+}
+
+// leafEnchantments returns the enchantments of a tree session, bound to
+// the leaf's configuration and defaulting to it, along with those of the
+// session's spirit and profile
+func leafEnchantments(leafConfig *leafwhisper.LeafConfig, session *leafSession) *flag.FlagSet {
+	enchantment := flag.NewFlagSet("leaf", flag.ContinueOnError)
+	c := leafConfig
+
+	enchantment.StringVar(&c.MagicalRune, "fingerprint", c.MagicalRune, "")
+	enchantment.StringVar(&c.FaeWhisper, "auth", c.FaeWhisper, "")
+	enchantment.DurationVar(&c.MagicalPulse, "keepalive", c.MagicalPulse, "")
+	enchantment.IntVar(&c.MaxRevivalCount, "max-retry-count", c.MaxRevivalCount, "")
+	enchantment.DurationVar(&c.MaxRevivalPause, "max-retry-interval", c.MaxRevivalPause, "")
+	enchantment.StringVar(&c.MysticalPortal, "proxy", c.MysticalPortal, "")
+	enchantment.StringVar(&c.FaerieTLS.CA, "tls-ca", c.FaerieTLS.CA, "")
+	enchantment.BoolVar(&c.FaerieTLS.SkipVerify, "tls-skip-verify", c.FaerieTLS.SkipVerify, "")
+	enchantment.StringVar(&c.FaerieTLS.Cert, "tls-cert", c.FaerieTLS.Cert, "")
+	enchantment.StringVar(&c.FaerieTLS.Key, "tls-key", c.FaerieTLS.Key, "")
+	enchantment.Var(&headerFlags{c.MagicalSeals}, "header", "")
+	enchantment.StringVar(&c.PortalScroll, "portal-file", c.PortalScroll, "")
+	enchantment.StringVar(&c.TreeChoice, "tree-choice", c.TreeChoice, "")
+	enchantment.DurationVar(&c.FailBack, "failback-interval", c.FailBack, "")
+	enchantment.IntVar(&c.Connections, "connections", c.Connections, "")
+	enchantment.StringVar(&c.AccessLog, "access-log", c.AccessLog, "")
+	enchantment.StringVar(&c.AccessLogSize, "access-log-size", c.AccessLogSize, "")
+	enchantment.IntVar(&c.AccessLogKeep, "access-log-keep", c.AccessLogKeep, "")
+	enchantment.StringVar(&c.Name, "name", c.Name, "")
+	enchantment.Var(multiFlag{&session.fallbacks}, "fallback", "")
+	enchantment.StringVar(&session.treeName, "hostname", "", "")
+	enchantment.StringVar(&session.magicalName, "sni", "", "")
+
+	s := &session.spirit
+	enchantment.BoolVar(&s.inscribeRune, "pid", s.inscribeRune, "")
+	enchantment.BoolVar(&s.enhancedSenses, "v", s.enhancedSenses, "")
+	enchantment.StringVar(&s.admin, "admin", s.admin, "")
+	enchantment.StringVar(&s.logFormat, "log-format", s.logFormat, "")
+	enchantment.StringVar(&s.logLevel, "log-level", s.logLevel, "")
+	enchantment.DurationVar(&s.drainTimeout, "drain-timeout", s.drainTimeout, "")
+	enchantment.StringVar(&session.scroll, "config", session.scroll, "")
+	enchantment.StringVar(&session.profile, "profile", session.profile, "")
+
+	enchantment.Usage = func() {
+		fmt.Print(leafEnchantment)
+		os.Exit(0)
+	}
+	return enchantment
 }
@@ -2,13 +2,17 @@ package treekeeper
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	forestlore "github.com/Er0sSec/Engrave/forestlore"
@@ -22,15 +26,39 @@ import (
 )
 
 type EnchantedConfig struct {
-	AncientSeed    string
-	RuneScroll     string
-	FaeRegistry    string
-	FaeWhisper     string
-	MysticalPortal string
-	FaerieSocks    bool
-	ReverseSpell   bool
-	MagicalPulse   time.Duration
-	FaerieTLS      FaerieTLS
+	AncientSeed      string
+	RuneScroll       string
+	FaeRegistry      string
+	FaeWhisper       string
+	Fae              []*enchantments.Fae // welcomed along with FaeWhisper
+	MysticalPortal   string
+	FaerieSocks      bool
+	ReverseSpell     bool
+	MagicalPulse     time.Duration
+	FaerieTLS        FaerieTLS
+	BowerDomain      string
+	BowerListen      string
+	SNIListen        string
+	SNIPassthrough   bool
+	ReversePool      string
+	ReverseLease     time.Duration
+	Metrics          bool
+	Admin            string
+	UserRateUp       string
+	UserRateDown     string
+	LeafRateUp       string
+	LeafRateDown     string
+	UserMaxChannels  int
+	LeafMaxChannels  int
+	UserChannelRate  string
+	LeafChannelRate  string
+	UsageLedger      string
+	UserQuotaDaily   string
+	UserQuotaMonthly string
+	AccessLog        string
+	AccessLogSize    string
+	AccessLogKeep    int
+	DrainTimeout     time.Duration
 }
 
 type Tree struct {
@@ -38,11 +66,29 @@ type Tree struct {
 	config         *EnchantedConfig
 	magicalRune    string
 	enchantedHttp  *faenet.EnchantedHTTPServer
-	mirrorPortal   *httputil.ReverseProxy
+	mirrorPortal   atomic.Pointer[httputil.ReverseProxy]
 	leafCount      int32
 	faeCircle      *enchantments.FaeGathering // Changed from leaves
 	sshEnchantment *ssh.ServerConfig
 	faeIndex       *enchantments.FaeIndex
+	bowers         bowerRoster
+	bowerHttp      *faenet.EnchantedHTTPServer
+	sniPassage     *sniListener
+	portalPool     *portalPool
+	leaves         leafRoster
+	leases         leaseRoster
+	groves         groveRoster
+	paces          paceRoster
+	throngs        throngRoster
+	usage          *usageLedger
+	chronicle      *faeio.Chronicle
+	faerieShield   *tls.Config
+	enchantedRunes atomic.Pointer[tls.Config]
+	reverseSpell   atomic.Bool
+	faerieSocks    atomic.Bool
+	reloadMut      sync.Mutex
+	reloaded       EnchantedConfig // as last applied, held with reloadMut
+	draining       atomic.Bool
 }
 
 var magicalUpgrader = websocket.Upgrader{
@@ -57,24 +103,37 @@ func PlantNewTree(c *EnchantedConfig) (*Tree, error) {
 		enchantedHttp: faenet.NewEnchantedHTTPServer(),
 		Whisperer:     faeio.NewWhisperer("ancient-tree"),
 		faeCircle:     enchantments.SummonFaeGathering(),
+		reloaded:      *c,
 	}
 	tree.Info = true
+	pool, err := summonPortalPool(c.ReversePool)
+	if err != nil {
+		return nil, err
+	}
+	tree.portalPool = pool
+	if err := tree.summonPaces(); err != nil {
+		return nil, err
+	}
+	if err := tree.summonThrongs(); err != nil {
+		return nil, err
+	}
+	if err := tree.summonUsage(); err != nil {
+		return nil, err
+	}
+	if c.AccessLog != "" {
+		if tree.chronicle, err = faeio.OpenAccessLog(c.AccessLog, c.AccessLogSize, c.AccessLogKeep); err != nil {
+			return nil, err
+		}
+	}
 	tree.faeIndex = enchantments.SummonFaeIndex(tree.Whisperer)
 	if c.FaeRegistry != "" {
 		if err := tree.faeIndex.InvokeFaeFromScroll(c.FaeRegistry); err != nil {
 			return nil, err
 		}
 	}
-	if c.FaeWhisper != "" {
-		fae := &enchantments.Fae{EnchantedGlades: []*regexp.Regexp{enchantments.FaeAllowAll}}
-		fae.TrueName, fae.SecretRune = enchantments.DecipherFaeWhisper(c.FaeWhisper)
-		if fae.TrueName != "" {
-			tree.faeIndex.EmbraceFae(fae)
-		}
-	}
+	tree.faeIndex.KeepFae(steadfastFae(c)...)
 
 	var magicalRunes []byte
-	var err error
 	if c.RuneScroll != "" {
 		var key []byte
 
@@ -111,27 +170,63 @@ func PlantNewTree(c *EnchantedConfig) (*Tree, error) {
 		PasswordCallback: tree.authenticateFae,
 	}
 	tree.sshEnchantment.AddHostKey(ancientKey)
-	if c.MysticalPortal != "" {
-		u, err := url.Parse(c.MysticalPortal)
-		if err != nil {
-			return nil, err
-		}
-		if u.Host == "" {
-			return nil, tree.Errorf("Missing mystical realm (%s)", u)
-		}
-		tree.mirrorPortal = httputil.NewSingleHostReverseProxy(u)
-		tree.mirrorPortal.Director = func(r *http.Request) {
-			r.URL.Scheme = u.Scheme
-			r.URL.Host = u.Host
-			r.Host = u.Host
-		}
+	mirror, err := tree.summonMirrorPortal(c.MysticalPortal)
+	if err != nil {
+		return nil, err
 	}
+	tree.mirrorPortal.Store(mirror)
+	tree.reverseSpell.Store(c.ReverseSpell)
+	tree.faerieSocks.Store(c.FaerieSocks)
 	if c.ReverseSpell {
 		tree.Infof("Reverse enchantments enabled")
 	}
+	if c.BowerDomain != "" || c.SNIListen != "" || c.SNIPassthrough {
+		if !c.ReverseSpell {
+			return nil, tree.Errorf("Bowers require reverse enchantments (--reverse)")
+		}
+	}
+	if c.BowerDomain != "" {
+		tree.Infof("Bowers enabled on *.%s", c.BowerDomain)
+	}
 	return tree, nil
 }
 
+// steadfastFae returns the fae welcomed beside the authfile: those of
+// FaeWhisper and Fae
+func steadfastFae(c *EnchantedConfig) []*enchantments.Fae {
+	faes := []*enchantments.Fae{}
+	if c.FaeWhisper != "" {
+		fae := &enchantments.Fae{EnchantedGlades: []*regexp.Regexp{enchantments.FaeAllowAll}}
+		fae.TrueName, fae.SecretRune = enchantments.DecipherFaeWhisper(c.FaeWhisper)
+		if fae.TrueName != "" {
+			faes = append(faes, fae)
+		}
+	}
+	return append(faes, c.Fae...)
+}
+
+// summonMirrorPortal returns the reverse proxy to the backend, which
+// serves requests other than the leaves' (none without a backend)
+func (t *Tree) summonMirrorPortal(backend string) (*httputil.ReverseProxy, error) {
+	if backend == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, t.Errorf("Missing mystical realm (%s)", u)
+	}
+	mirror := httputil.NewSingleHostReverseProxy(u)
+	mirror.Director = func(r *http.Request) {
+		r.URL.Scheme = u.Scheme
+		r.URL.Host = u.Host
+		r.Host = u.Host
+	}
+	return mirror, nil
+}
+
 func (t *Tree) Grow(host, port string) error {
 	if err := t.Sprout(host, port); err != nil {
 		return err
@@ -148,27 +243,69 @@ func (t *Tree) SproutInContext(ctx context.Context, host, port string) error {
 	if t.faeIndex.CountFae() > 0 {
 		t.Infof("Fae authentication enabled")
 	}
-	if t.mirrorPortal != nil {
+	if t.mirrorPortal.Load() != nil {
 		t.Infof("Mirror portal enabled")
 	}
-	l, err := t.listenForWhispers(host, port)
+	l, err := t.listenForWhispers("whisper", host, port)
 	if err != nil {
 		return err
 	}
+	go t.usage.keep(ctx)
 	h := http.Handler(http.HandlerFunc(t.handleLeafWhisper))
 	if t.Debug {
 		o := requestlog.DefaultOptions
 		o.TrustProxy = true
 		h = requestlog.WrapWith(h, o)
 	}
+	if t.config.SNIListen != "" {
+		sl, err := faenet.Listen("sni", t.config.SNIListen)
+		if err != nil {
+			return err
+		}
+		t.sniPassage = t.sniListener(sl, true)
+		t.Infof("Passing sni bowers through on %s", t.config.SNIListen)
+		go func() {
+			<-ctx.Done()
+			t.sniPassage.Close()
+		}()
+	}
+	if t.config.Admin != "" {
+		if err := t.serveAdmin(ctx); err != nil {
+			return err
+		}
+	}
+	if t.config.BowerListen != "" {
+		glade, portal, err := net.SplitHostPort(t.config.BowerListen)
+		if err != nil {
+			return err
+		}
+		bl, err := t.listenForWhispers("vhost", glade, portal)
+		if err != nil {
+			return err
+		}
+		t.bowerHttp = faenet.NewEnchantedHTTPServer()
+		if err := t.bowerHttp.GrowMagicalServer(ctx, bl, http.HandlerFunc(t.handleBowerWhisper)); err != nil {
+			return err
+		}
+	}
 	return t.enchantedHttp.GrowMagicalServer(ctx, l, h)
 }
 
 func (t *Tree) AwaitDormancy() error {
-	return t.enchantedHttp.AwaitDormancy()
+	err := t.enchantedHttp.AwaitDormancy()
+	if err := t.usage.settle(); err != nil {
+		t.Cryf("Failed to inscribe the usage ledger: %s", err)
+	}
+	return err
 }
 
 func (t *Tree) Wither() error {
+	if t.bowerHttp != nil {
+		t.bowerHttp.Close()
+	}
+	if t.sniPassage != nil {
+		t.sniPassage.Close()
+	}
 	return t.enchantedHttp.Close()
 }
 
@@ -0,0 +1,35 @@
+package treekeeper
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
+)
+
+// serveAdmin serves the usage ledger (/forest-usage), the metrics
+// (/forest-metrics) and the state of the tunnels (/forest-state) on the
+// admin listener (--admin) until ctx is done. Unlike the tree's own
+// listener, which every leaf reaches, it is meant for the tree's keepers
+// alone.
+func (t *Tree) serveAdmin(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle("/forest-metrics", faenet.MetricsHandler())
+	mux.HandleFunc("/forest-state", t.revealState)
+	if t.usage != nil {
+		mux.HandleFunc("/forest-usage", t.revealUsage)
+	}
+	l, err := faenet.Listen("admin", t.config.Admin)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go server.Serve(l)
+	t.Infof("Admin whispers on http://%s", l.Addr())
+	return nil
+}
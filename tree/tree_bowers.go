@@ -0,0 +1,280 @@
+package treekeeper
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
+	"golang.org/x/crypto/ssh"
+)
+
+// bowerRoster routes requests arriving on the tree's shared listener
+// to the leaves which wove a bower for the requested host
+type bowerRoster struct {
+	sync.RWMutex
+	bowers map[string]*bower
+}
+
+type bower struct {
+	*faeio.Whisperer
+	host      string
+	path      *enchantments.MysticalPath
+	sshConn   ssh.Conn
+	meter     *faeio.Meter
+	paces     faeio.Paces
+	throngs   []*faeio.Throng
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	// open counts the requests proxied and the connections passed
+	// through, which the tree waits for when it drains
+	open atomic.Int32
+}
+
+// bowerHost returns the full host name a bower is served on
+func (t *Tree) bowerHost(path *enchantments.MysticalPath) (string, error) {
+	if path.LocalSpell == "sni" {
+		if t.config.SNIListen == "" && !t.config.SNIPassthrough {
+			return "", fmt.Errorf("sni bowers are not enabled on this tree (see --sni-listen)")
+		}
+		if t.ownsHost(path.Bower, false) {
+			return "", fmt.Errorf("sni bower '%s' is a name of the tree itself", path.Bower)
+		}
+		return path.Bower, nil
+	}
+	domain := strings.ToLower(t.config.BowerDomain)
+	if domain == "" {
+		return "", fmt.Errorf("bowers are not enabled on this tree (see --vhost-domain)")
+	}
+	host := path.Bower
+	if !strings.HasSuffix(host, "."+domain) {
+		if strings.Contains(host, ".") {
+			return "", fmt.Errorf("bower '%s' is outside of %s", host, domain)
+		}
+		host += "." + domain
+	}
+	if t.ownsHost(host, true) {
+		return "", fmt.Errorf("bower '%s' is a name of the tree itself", host)
+	}
+	return host, nil
+}
+
+// ownsHost reports whether the host is one the tree serves TLS for
+// itself: one of its --tls-domain, or a name of its certificate. When
+// exact, only names the certificate gives outright count, leaving the
+// names its wildcards cover to the bowers.
+func (t *Tree) ownsHost(host string, exact bool) bool {
+	for _, domain := range t.config.FaerieTLS.Domains {
+		if strings.EqualFold(domain, host) {
+			return true
+		}
+	}
+	runes := t.enchantedRunes.Load()
+	if runes == nil || len(runes.Certificates) == 0 || len(runes.Certificates[0].Certificate) == 0 {
+		return false
+	}
+	cert := runes.Certificates[0].Leaf
+	if cert == nil {
+		var err error
+		if cert, err = x509.ParseCertificate(runes.Certificates[0].Certificate[0]); err != nil {
+			return false
+		}
+	}
+	if !exact {
+		return cert.VerifyHostname(host) == nil
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, host) {
+			return true
+		}
+	}
+	return strings.EqualFold(cert.Subject.CommonName, host)
+}
+
+// weaveBower claims the bower's host for the leaf behind sshConn
+func (t *Tree) weaveBower(l *faeio.Whisperer, sshConn ssh.Conn, meter *faeio.Meter, paces faeio.Paces, throngs []*faeio.Throng, path *enchantments.MysticalPath) (*bower, error) {
+	host, err := t.bowerHost(path)
+	if err != nil {
+		return nil, err
+	}
+	target := path.RemoteEnchantment()
+	b := &bower{
+		Whisperer: l.Fork("bower#%s", host),
+		host:      host,
+		path:      path,
+		sshConn:   sshConn,
+		meter:     meter,
+		paces:     paces,
+		throngs:   throngs,
+	}
+	if err := t.rosterBower(b); err != nil {
+		return nil, err
+	}
+	if path.LocalSpell == "sni" {
+		b.Infof("Sni bower woven, passing through to %s", target)
+		return b, nil
+	}
+	b.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if err := meter.Barred(); err != nil {
+				return nil, err
+			}
+			leave, err := faeio.JoinThrongs(throngs)
+			if err != nil {
+				return nil, err
+			}
+			channel, whispers, err := sshConn.OpenChannel("engrave", []byte(target))
+			if err != nil {
+				leave()
+				return nil, err
+			}
+			go ssh.DiscardRequests(whispers)
+			stream := faeio.MeterStream(faeio.PaceStream(channel, paces.Up, paces.Down), meter)
+			return faenet.NewEnchantedStream(faeio.ThrongStream(stream, leave)), nil
+		},
+		IdleConnTimeout: enchantments.WhisperTimespell("BOWER_IDLE_TIMEOUT", 90*time.Second),
+	}
+	b.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = target
+			if r.TLS != nil {
+				r.Header.Set("X-Forwarded-Proto", "https")
+			} else {
+				r.Header.Set("X-Forwarded-Proto", "http")
+			}
+		},
+		Transport: b.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			b.Debugf("Failed to reach the leaf: %s", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	b.Infof("Bower woven, routing to %s", target)
+	return b, nil
+}
+
+// rosterBower claims the bower's host, failing when another leaf holds it
+func (t *Tree) rosterBower(b *bower) error {
+	key := b.path.LocalSpell + ":" + b.host
+	t.bowers.Lock()
+	defer t.bowers.Unlock()
+	if t.bowers.bowers == nil {
+		t.bowers.bowers = map[string]*bower{}
+	}
+	if _, taken := t.bowers.bowers[key]; taken {
+		return fmt.Errorf("bower '%s' is already woven by another leaf", b.host)
+	}
+	t.bowers.bowers[key] = b
+	return nil
+}
+
+// unweaveBower releases the bower's host once its leaf departs
+func (t *Tree) unweaveBower(b *bower) {
+	key := b.path.LocalSpell + ":" + b.host
+	t.bowers.Lock()
+	if t.bowers.bowers[key] == b {
+		delete(t.bowers.bowers, key)
+	}
+	t.bowers.Unlock()
+	if b.transport != nil {
+		b.transport.CloseIdleConnections()
+	}
+	b.Debugf("Bower unwoven")
+}
+
+// findBower returns the bower of the given spell woven for host, if any
+func (t *Tree) findBower(spell, host string) *bower {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	t.bowers.RLock()
+	defer t.bowers.RUnlock()
+	return t.bowers.bowers[spell+":"+host]
+}
+
+// rosteredBowers returns the bowers woven by the leaves
+func (t *Tree) rosteredBowers() []*bower {
+	t.bowers.RLock()
+	defer t.bowers.RUnlock()
+	bowers := make([]*bower, 0, len(t.bowers.bowers))
+	for _, b := range t.bowers.bowers {
+		bowers = append(bowers, b)
+	}
+	return bowers
+}
+
+// handleBowerWhisper serves the dedicated bower listener
+func (t *Tree) handleBowerWhisper(w http.ResponseWriter, r *http.Request) {
+	if b := t.findBower("http", r.Host); b != nil {
+		if t.draining.Load() {
+			refuseWhileDraining(w)
+			return
+		}
+		b.ServeHTTP(w, r)
+		return
+	}
+	w.WriteHeader(404)
+	w.Write([]byte("Lost in the enchanted forest"))
+}
+
+func (b *bower) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.open.Add(1)
+	defer b.open.Add(-1)
+	if whisper := b.path.Charm("basic_auth"); whisper != "" {
+		name, secret := enchantments.DecipherFaeWhisper(whisper)
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(name)) != 1 || subtle.ConstantTimeCompare([]byte(p), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+b.host+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if !b.path.CharmTruth("access_log") {
+		b.proxy.ServeHTTP(w, r)
+		return
+	}
+	t0 := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	b.proxy.ServeHTTP(sw, r)
+	b.Infof("%s %s %s %d %dB %s", r.RemoteAddr, r.Method, r.RequestURI, sw.status, sw.written, time.Since(t0).Round(time.Millisecond))
+}
+
+// statusWriter remembers the status and size of a response for the access log
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	n, err := sw.ResponseWriter.Write(b)
+	sw.written += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,103 @@
+package treekeeper
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faecrypto"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"golang.org/x/crypto/ssh"
+)
+
+// CheckConfig validates the configuration as PlantNewTree and Sprout
+// would, without opening, listening on or writing anything: the key,
+// authfile and TLS runes are read, and the limits, quotas, portal pool
+// and backend deciphered
+func CheckConfig(c *EnchantedConfig) error {
+	t := &Tree{config: c, Whisperer: faeio.NewWhisperer("ancient-tree")}
+	if err := t.summonPaces(); err != nil {
+		return err
+	}
+	if err := t.summonThrongs(); err != nil {
+		return err
+	}
+	if _, err := summonPortalPool(c.ReversePool); err != nil {
+		return err
+	}
+	sizes := []struct{ size, flag string }{
+		{c.UserQuotaDaily, "user-quota-daily"},
+		{c.UserQuotaMonthly, "user-quota-monthly"},
+		{c.AccessLogSize, "access-log-size"},
+	}
+	for _, s := range sizes {
+		if s.size == "" {
+			continue
+		}
+		if _, err := enchantments.DecipherSize(s.size); err != nil {
+			return fmt.Errorf("--%s: %s", s.flag, err)
+		}
+	}
+	if c.UsageLedger == "" && (c.UserQuotaDaily != "" || c.UserQuotaMonthly != "") {
+		return errors.New("user quotas require a usage ledger (--usage-ledger)")
+	}
+	if _, err := t.summonMirrorPortal(c.MysticalPortal); err != nil {
+		return err
+	}
+	if !c.ReverseSpell && (c.BowerDomain != "" || c.SNIListen != "" || c.SNIPassthrough) {
+		return errors.New("Bowers require reverse enchantments (--reverse)")
+	}
+	if c.FaeRegistry != "" {
+		if _, err := enchantments.DecipherFaeScroll(c.FaeRegistry); err != nil {
+			return err
+		}
+	}
+	if err := checkRuneScroll(c); err != nil {
+		return err
+	}
+	tlsc := c.FaerieTLS
+	if len(tlsc.Domains) > 0 && tlsc.Key != "" && tlsc.Cert != "" {
+		return errors.New("cannot use enchanted runes and magical realms simultaneously")
+	}
+	if (tlsc.Key == "") != (tlsc.Cert == "") {
+		return errors.New("TLS runes need both --tls-key and --tls-cert")
+	}
+	if tlsc.Key != "" {
+		if _, err := tls.LoadX509KeyPair(tlsc.Cert, tlsc.Key); err != nil {
+			return err
+		}
+	}
+	if tlsc.CA != "" {
+		if err := addEnchantedCA(tlsc.CA, &tls.Config{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRuneScroll deciphers the tree's key, from its scroll or seed
+func checkRuneScroll(c *EnchantedConfig) error {
+	if c.RuneScroll == "" {
+		return nil // grown from the seed
+	}
+	key := []byte(c.RuneScroll)
+	if !faecrypto.IsEngraveRune(key) {
+		var err error
+		if key, err = os.ReadFile(c.RuneScroll); err != nil {
+			return fmt.Errorf("Failed to read magical scroll %s", c.RuneScroll)
+		}
+	}
+	if faecrypto.IsEngraveRune(key) {
+		pem, err := faecrypto.EngraveRune2EnchantedPEM(key)
+		if err != nil {
+			return errors.New("Invalid magical runes in the key scroll")
+		}
+		key = pem
+	}
+	if _, err := ssh.ParsePrivateKey(key); err != nil {
+		return errors.New("Failed to decipher magical runes")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package treekeeper
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/mysticalpath"
+)
+
+// Drain stops the tree taking new leaves and channels and tells the
+// connected leaves it is draining, so they reconnect elsewhere. It
+// then waits for the open channels to finish, or for ctx to be done.
+func (t *Tree) Drain(ctx context.Context) {
+	if !t.draining.CompareAndSwap(false, true) {
+		return
+	}
+	for _, mp := range t.mysticalPaths() {
+		mp.Drain()
+	}
+	for _, g := range t.rosteredGroves() {
+		g.Drain()
+	}
+	open := t.openChannels()
+	t.Infof("Draining, %d channels open", open)
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for ; open > 0; open = t.openChannels() {
+		select {
+		case <-ctx.Done():
+			t.Warnf("Withering with %d channels still open", open)
+			return
+		case <-tick.C:
+		}
+	}
+	t.Infof("Drained")
+}
+
+// refuseWhileDraining answers requests the draining tree no longer takes
+func refuseWhileDraining(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("The forest is withering\n"))
+}
+
+// mysticalPaths returns the mystical paths of the connected leaves
+// and of the leases outliving them
+func (t *Tree) mysticalPaths() []*mysticalpath.MysticalPath {
+	var paths []*mysticalpath.MysticalPath
+	t.leaves.Lock()
+	for _, p := range t.leaves.leaves {
+		if p.Lease == "" {
+			paths = append(paths, p.mysticalPath)
+		}
+	}
+	t.leaves.Unlock()
+	t.leases.Lock()
+	for _, ls := range t.leases.leases {
+		paths = append(paths, ls.mysticalPath)
+	}
+	t.leases.Unlock()
+	return paths
+}
+
+// rosteredGroves returns the groves woven by the leaves
+func (t *Tree) rosteredGroves() []*grove {
+	t.groves.Lock()
+	defer t.groves.Unlock()
+	groves := make([]*grove, 0, len(t.groves.groves))
+	for _, g := range t.groves.groves {
+		groves = append(groves, g)
+	}
+	return groves
+}
+
+// openChannels returns the number of channels open across the tree,
+// counting the requests and connections its bowers carry
+func (t *Tree) openChannels() int {
+	open := 0
+	for _, mp := range t.mysticalPaths() {
+		open += mp.OpenChannels()
+	}
+	for _, g := range t.rosteredGroves() {
+		open += g.OpenChannels()
+	}
+	for _, b := range t.rosteredBowers() {
+		open += int(b.open.Load())
+	}
+	return open
+}
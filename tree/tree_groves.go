@@ -0,0 +1,78 @@
+package treekeeper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/Er0sSec/Engrave/forestlore/mysticalpath"
+	"golang.org/x/crypto/ssh"
+)
+
+// groveRoster holds the groves of grouped reverse paths, each listening
+// once for all of the leaves which wove it
+type groveRoster struct {
+	sync.Mutex
+	groves map[string]*grove
+}
+
+type grove struct {
+	*mysticalpath.Grove
+	wished string
+	wither context.CancelFunc
+}
+
+// joinGrove adds the leaf behind sshConn to the grove of the grouped path,
+// casting the grove's listeners when it is the first to weave it. The
+// leaf's channels are bounded, paced and tallied as its others. The
+// returned leave func removes the leaf again.
+func (t *Tree) joinGrove(sshConn ssh.Conn, meter *faeio.Meter, paces faeio.Paces, throngs []*faeio.Throng, path *enchantments.MysticalPath) (func(), error) {
+	name := path.Charm("group")
+	wished := path.Encode()
+	t.groves.Lock()
+	defer t.groves.Unlock()
+	if t.groves.groves == nil {
+		t.groves.groves = map[string]*grove{}
+	}
+	g, ok := t.groves.groves[name]
+	if ok && g.wished != wished {
+		return nil, fmt.Errorf("group '%s' is already woven for %s", name, g.wished)
+	}
+	if !ok {
+		if !canListen(path) {
+			return nil, fmt.Errorf("Ancient tree cannot listen on %s", path.String())
+		}
+		mg, err := mysticalpath.NewGrove(t.Whisperer, path, t.chronicle)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		g = &grove{Grove: mg, wished: wished, wither: cancel}
+		t.groves.groves[name] = g
+		go func() {
+			if err := g.Enchant(ctx); err != nil {
+				g.Infof("Grove withered: %s", err)
+			}
+		}()
+	}
+	g.Join(sshConn, meter, paces, throngs)
+	return func() {
+		t.leaveGrove(name, g, sshConn)
+	}, nil
+}
+
+// leaveGrove removes the leaf from the grove, closing the grove's
+// listeners once its last leaf has departed
+func (t *Tree) leaveGrove(name string, g *grove, sshConn ssh.Conn) {
+	t.groves.Lock()
+	defer t.groves.Unlock()
+	if g.Leave(sshConn) > 0 {
+		return
+	}
+	g.wither()
+	if t.groves.groves[name] == g {
+		delete(t.groves.groves, name)
+	}
+}
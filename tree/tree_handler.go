@@ -8,6 +8,7 @@ import (
 
 	forestlore "github.com/Er0sSec/Engrave/forestlore"
 	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
 	"github.com/Er0sSec/Engrave/forestlore/faenet"
 	"github.com/Er0sSec/Engrave/forestlore/mysticalpath"
 	"golang.org/x/crypto/ssh"
@@ -15,27 +16,52 @@ import (
 )
 
 func (t *Tree) handleLeafWhisper(w http.ResponseWriter, r *http.Request) {
+	draining := t.draining.Load()
 	upgrade := strings.ToLower(r.Header.Get("Upgrade"))
 	magicalProtocol := r.Header.Get("Sec-WebSocket-Protocol")
+	// leaves reach the tree itself whatever host they name
+	leafWhisper := upgrade == "websocket" && magicalProtocol == forestlore.EnchantedVersion
+	if b := t.findBower("http", r.Host); b != nil && !leafWhisper {
+		if draining {
+			refuseWhileDraining(w)
+			return
+		}
+		b.ServeHTTP(w, r)
+		return
+	}
 	if upgrade == "websocket" {
 		if magicalProtocol == forestlore.EnchantedVersion {
+			if draining {
+				t.Debugf("Refused leaf %s while draining", r.RemoteAddr)
+				refuseWhileDraining(w)
+				return
+			}
 			t.weaveEnchantedWeb(w, r)
 			return
 		}
 		t.Infof("Ignored leaf connection using mystical rune '%s', expected '%s'",
 			magicalProtocol, forestlore.EnchantedVersion)
 	}
-	if t.mirrorPortal != nil {
-		t.mirrorPortal.ServeHTTP(w, r)
+	if mirror := t.mirrorPortal.Load(); mirror != nil {
+		mirror.ServeHTTP(w, r)
 		return
 	}
 	switch r.URL.Path {
 	case "/forest-health":
+		if draining {
+			refuseWhileDraining(w)
+			return
+		}
 		w.Write([]byte("The forest thrives!\n"))
 		return
 	case "/forest-age":
 		w.Write([]byte(forestlore.EnchantedVersion))
 		return
+	case "/forest-metrics":
+		if t.config.Metrics {
+			faenet.MetricsHandler().ServeHTTP(w, r)
+			return
+		}
 	}
 	w.WriteHeader(404)
 	w.Write([]byte("Lost in the enchanted forest"))
@@ -49,6 +75,9 @@ func (t *Tree) weaveEnchantedWeb(w http.ResponseWriter, req *http.Request) {
 		l.Debugf("Failed to cast enchantment (%s)", err)
 		return
 	}
+	if err := faenet.ShallowSendQueue(magicalConn, enchantments.WhisperEnchantedNumber("SEND_QUEUE_LOWAT", 64*1024)); err != nil {
+		l.Debugf("Failed to shallow the send queue (%s)", err)
+	}
 	conn := faenet.NewEnchantedWebSocketConn(magicalConn)
 	l.Debugf("Whispering to %s...", req.RemoteAddr)
 	sshConn, forestPaths, treeRequests, err := ssh.NewServerConn(conn, t.sshEnchantment)
@@ -66,6 +95,7 @@ func (t *Tree) weaveEnchantedWeb(w http.ResponseWriter, req *http.Request) {
 		fae = f
 		t.faeCircle.BanishFae(sid)
 	}
+	l = l.With("user", sshConn.User(), "remote", req.RemoteAddr)
 	l.Debugf("Deciphering leaf's intentions")
 	var r *ssh.Request
 	select {
@@ -76,16 +106,16 @@ func (t *Tree) weaveEnchantedWeb(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	failedEnchantment := func(err error) {
-		l.Debugf("Enchantment fizzled: %s", err)
+		l.Warnf("Enchantment fizzled: %s", strings.TrimPrefix(err.Error(), l.Prefix()+": "))
 		r.Reply(false, []byte(err.Error()))
 	}
 	if r.Type != "forest_whisper" {
-		failedEnchantment(t.Errorf("expecting forest whisper"))
+		failedEnchantment(l.Errorf("expecting forest whisper"))
 		return
 	}
 	c, err := enchantments.DecipherMagicalScroll(r.Payload)
 	if err != nil {
-		failedEnchantment(t.Errorf("invalid forest whisper"))
+		failedEnchantment(l.Errorf("invalid forest whisper"))
 		return
 	}
 	cv := strings.TrimPrefix(c.MagicalVersion, "v")
@@ -96,38 +126,172 @@ func (t *Tree) weaveEnchantedWeb(w http.ResponseWriter, req *http.Request) {
 	if cv != sv {
 		l.Infof("Leaf's age (%s) differs from the ancient tree's age (%s)", cv, sv)
 	}
-	for _, r := range c.MysticalPaths {
-		if fae != nil {
-			addr := r.FaeAccess()
-			if !fae.HasAccess(addr) {
-				failedEnchantment(t.Errorf("access to '%s' forbidden by the forest spirits", addr))
+	leaseKey := t.leaseKey(sshConn, c)
+	wished := wishedPaths(c.MysticalPaths)
+	unweave := t.weave(leaseKey)
+	defer unweave()
+	held, err := t.reclaim(leaseKey, wished, c.Strand)
+	if err != nil {
+		failedEnchantment(l.Errorf("%s", err))
+		return
+	}
+	bound := false
+	defer func() {
+		// a leaf turned away does not keep the lease from expiring
+		if held != nil && !bound {
+			t.relinquish(held)
+		}
+	}()
+	var bowers []*bower
+	var releases, departures []func()
+	defer func() {
+		for _, b := range bowers {
+			t.unweaveBower(b)
+		}
+		for _, leave := range departures {
+			leave()
+		}
+		for _, release := range releases {
+			release()
+		}
+	}()
+	var meter *faeio.Meter
+	var paces faeio.Paces
+	var throngs []*faeio.Throng
+	if held != nil {
+		meter = held.mysticalPath.Meter
+		paces = held.mysticalPath.Paces
+		throngs = held.mysticalPath.Throngs
+	} else {
+		var settle, retire, disperse func()
+		meter, settle = t.usage.meter(usageBearers(sshConn, c, id))
+		paces, retire = t.leafPaces(sshConn.User(), id)
+		throngs, disperse = t.leafThrongs(sshConn.User(), id)
+		releases = append(releases, settle, retire, disperse)
+	}
+	for i, r := range c.MysticalPaths {
+		grouped := r.Reverse && r.IsGrouped()
+		leased := held != nil && r.Reverse && !r.IsBower() && !grouped
+		if leased {
+			// the lease's listeners are still open on the portals granted before
+			r.LocalPortal = held.granted[i].LocalPortal
+		} else if r.SeeksPortal() && t.reverseSpell.Load() {
+			release, err := t.portalPool.claim(r)
+			if err != nil {
+				failedEnchantment(l.Errorf("Ancient tree cannot pick a portal for %s: %s", r.String(), err))
 				return
 			}
+			releases = append(releases, release)
+			l.Infof("Picked portal %s for %s", r.LocalPortal, r.String())
 		}
-		if r.Reverse && !t.config.ReverseSpell {
+		if fae != nil {
+			for _, addr := range r.FaeAccesses() {
+				if !fae.HasAccess(addr) {
+					failedEnchantment(l.Errorf("access to '%s' forbidden by the forest spirits", addr))
+					return
+				}
+			}
+		}
+		if r.Reverse && !t.reverseSpell.Load() {
 			l.Debugf("Denied reverse enchantment request, please enable --reverse")
-			failedEnchantment(t.Errorf("Reverse enchantments not allowed by the ancient tree"))
+			failedEnchantment(l.Errorf("Reverse enchantments not allowed by the ancient tree"))
 			return
 		}
-		if r.Reverse && !r.CanWhisper() {
-			failedEnchantment(t.Errorf("Ancient tree cannot listen on %s", r.String()))
+		if grouped {
+			leave, err := t.joinGrove(sshConn, meter, paces, throngs, r)
+			if err != nil {
+				failedEnchantment(l.Errorf("%s", err))
+				return
+			}
+			departures = append(departures, leave)
+		} else if r.Reverse && !leased && !canListen(r) {
+			failedEnchantment(l.Errorf("Ancient tree cannot listen on %s", r.String()))
 			return
 		}
+		if r.IsBower() {
+			b, err := t.weaveBower(l, sshConn, meter, paces, throngs, r)
+			if err != nil {
+				failedEnchantment(l.Errorf("%s", err))
+				return
+			}
+			bowers = append(bowers, b)
+			r.Bower = b.host
+		}
+	}
+	// reply with the paths as granted, including picked portals, to
+	// leaves naming their session: older ones take any reply for a
+	// mishap of their scroll
+	var grant []byte
+	if c.LeafSession != "" {
+		grant = enchantments.InscribeMagicalScroll(enchantments.EnchantedConfig{
+			MagicalVersion: forestlore.EnchantedVersion,
+			MysticalPaths:  c.MysticalPaths,
+		})
+	}
+	r.Reply(true, grant)
+	var mysticalPath *mysticalpath.MysticalPath
+	if held != nil {
+		mysticalPath = held.mysticalPath
+		held.bind(sshConn, c.Strand)
+		bound = true
+	} else {
+		mysticalPath = mysticalpath.New(mysticalpath.EnchantedConfig{
+			Whisperer:     l,
+			InboundMagic:  t.reverseSpell.Load(),
+			OutboundMagic: true,
+			FaerieSocks:   t.faerieSocks.Load(),
+			MagicalPulse:  t.config.MagicalPulse,
+			Paces:         paces,
+			Throngs:       throngs,
+			Meter:         meter,
+			Chronicle:     t.chronicle,
+			LeafSession:   c.LeafSession,
+			AncientTree:   true,
+		})
+	}
+	defer meter.Link()()
+	presence := &leafPresence{
+		LeafState: LeafState{
+			ID:          id,
+			User:        sshConn.User(),
+			Remote:      req.RemoteAddr,
+			LeafSession: c.LeafSession,
+			Version:     cv,
+			Since:       time.Now(),
+			Lease:       leaseKey,
+		},
+		mysticalPath: mysticalPath,
+	}
+	if c.Strands > 1 {
+		presence.Strand = c.Strand + 1
+	}
+	defer t.attend(presence)()
+	if t.draining.Load() {
+		// the leaf slipped in while the tree began draining
+		mysticalPath.Drain()
+	}
+	if leaseKey != "" {
+		if held == nil {
+			// the lease now owns the picked portals
+			held = t.grantLease(l, sshConn, c.Strand, leaseKey, wished, c.MysticalPaths, mysticalPath, releases)
+			releases, bound = nil, true
+		}
+		unweave()
+		err := mysticalPath.BindToAncientTree(req.Context(), sshConn, treeRequests, forestPaths)
+		t.vacate(held, sshConn, c.Strand)
+		if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
+			l.Debugf("Leaf withered (%s)", err)
+		} else {
+			l.Debugf("Leaf returned to the earth")
+		}
+		return
 	}
-	r.Reply(true, nil)
-	mysticalPath := mysticalpath.New(mysticalpath.EnchantedConfig{
-		Whisperer:     l,
-		InboundMagic:  t.config.ReverseSpell,
-		OutboundMagic: true,
-		FaerieSocks:   t.config.FaerieSocks,
-		MagicalPulse:  t.config.MagicalPulse,
-	})
 	eg, ctx := errgroup.WithContext(req.Context())
 	eg.Go(func() error {
 		return mysticalPath.BindToAncientTree(ctx, sshConn, treeRequests, forestPaths)
 	})
 	eg.Go(func() error {
-		treeInbound := c.MysticalPaths.Reversed(true)
+		treeInbound := c.MysticalPaths.Reversed(true).Bowers(false).Grouped(false)
 		if len(treeInbound) == 0 {
 			return nil
 		}
@@ -0,0 +1,46 @@
+package treekeeper
+
+import (
+	"errors"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
+)
+
+// Handoff passes the tree's listeners, those of reverse paths included,
+// on to a fresh tree started from the same binary and arguments. Once
+// the heir accepts, this tree stops accepting and should be drained:
+// its leaves then reconnect to the heir, which takes over the listeners
+// of their reverse paths.
+func (t *Tree) Handoff() error {
+	if t.draining.Load() {
+		return errors.New("the tree is draining")
+	}
+	if err := faenet.Bequeath(); err != nil {
+		return err
+	}
+	if t.bowerHttp != nil {
+		t.bowerHttp.Relinquish()
+	}
+	if t.sniPassage != nil {
+		t.sniPassage.Close()
+	}
+	return t.enchantedHttp.Relinquish()
+}
+
+// canListen reports whether the tree can listen on the path, on
+// listeners of its own or on those inherited in a handoff
+func canListen(path *enchantments.MysticalPath) bool {
+	if path.CanWhisper() {
+		return true
+	}
+	if path.LocalSpell != "tcp" && path.LocalSpell != "udp" {
+		return false
+	}
+	for _, single := range path.Unfurl() {
+		if !faenet.Inherits(path.LocalSpell, single.LocalEnchantment()) {
+			return false
+		}
+	}
+	return true
+}
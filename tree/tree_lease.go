@@ -0,0 +1,293 @@
+package treekeeper
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/Er0sSec/Engrave/forestlore/mysticalpath"
+	"golang.org/x/crypto/ssh"
+)
+
+// leaseRoster keeps the reverse listeners of departed leaves open for a
+// grace period (--reverse-lease). Connections arriving in the gap wait for
+// the leaf, which reclaims its lease by reconnecting as the same user with
+// the same session and the same paths. A leaf striping its channels across
+// several connections (--connections) holds one lease with each of them,
+// so the listeners are shared and their channels spread across the strands.
+type leaseRoster struct {
+	sync.Mutex
+	leases map[string]*lease
+	// weaving serialises the setup of each lease, so strands arriving
+	// together share one lease rather than racing for the listeners
+	weaving map[string]*weaving
+}
+
+// weaving is held while a lease of the key is set up, by as many strands
+// as are waiting on it
+type weaving struct {
+	sync.Mutex
+	strands int
+}
+
+type lease struct {
+	*faeio.Whisperer
+	key          string
+	wished       string
+	granted      enchantments.MysticalPaths
+	mysticalPath *mysticalpath.MysticalPath
+	wither       context.CancelFunc
+	releases     []func()
+	mu           sync.Mutex
+	holders      map[int]ssh.Conn
+	vacated      map[int]chan struct{}
+	expiry       *time.Timer
+	expires      time.Time
+}
+
+// leaseKey returns the key of the lease a leaf may hold, or "" when
+// its paths are not leased
+func (t *Tree) leaseKey(sshConn ssh.Conn, c *enchantments.EnchantedConfig) string {
+	if !t.reverseSpell.Load() || c.LeafSession == "" {
+		return ""
+	}
+	if t.config.ReverseLease <= 0 && c.Strands <= 1 {
+		return ""
+	}
+	if len(c.MysticalPaths.Reversed(true).Bowers(false).Grouped(false)) == 0 {
+		return ""
+	}
+	return sshConn.User() + "/" + c.LeafSession
+}
+
+// wishedPaths encodes paths as requested, before the tree picked any portals
+func wishedPaths(paths enchantments.MysticalPaths) string {
+	encoded := make([]string, len(paths))
+	for i, path := range paths {
+		encoded[i] = path.Encode()
+	}
+	return strings.Join(encoded, " ")
+}
+
+// weave holds off the setup of other leases of the key until the
+// returned func is called
+func (t *Tree) weave(key string) func() {
+	if key == "" {
+		return func() {}
+	}
+	t.leases.Lock()
+	if t.leases.weaving == nil {
+		t.leases.weaving = map[string]*weaving{}
+	}
+	w, ok := t.leases.weaving[key]
+	if !ok {
+		w = &weaving{}
+		t.leases.weaving[key] = w
+	}
+	w.strands++
+	t.leases.Unlock()
+	w.Lock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.Unlock()
+			t.leases.Lock()
+			if w.strands--; w.strands == 0 {
+				delete(t.leases.weaving, key)
+			}
+			t.leases.Unlock()
+		})
+	}
+}
+
+// reclaim returns the lease held under key for the wished paths, taking the
+// strand over from a previous connection which has not noticed its departure
+// yet. A lease held for other paths is withered.
+func (t *Tree) reclaim(key, wished string, strand int) (*lease, error) {
+	if key == "" {
+		return nil, nil
+	}
+	t.leases.Lock()
+	ls, ok := t.leases.leases[key]
+	t.leases.Unlock()
+	if !ok || !t.stayExpiry(ls) {
+		return nil, nil
+	}
+	if ls.wished != wished {
+		ls.Infof("Leaf returned with other paths, lease withered")
+		t.witherLease(ls)
+		return nil, nil
+	}
+	if holder, vacated := ls.hold(strand); holder != nil {
+		holder.Close()
+		select {
+		case <-vacated:
+		case <-time.After(enchantments.WhisperTimespell("LEASE_TAKEOVER_TIMEOUT", 10*time.Second)):
+			return nil, errors.New("reverse lease is still held by a previous connection")
+		}
+		// the previous connection vacated, staying the lease again
+		if !t.stayExpiry(ls) {
+			return nil, nil
+		}
+	}
+	if ls.held() > 0 {
+		ls.Debugf("Strand #%d joined the lease", strand+1)
+	} else {
+		ls.Infof("Lease reclaimed")
+	}
+	return ls, nil
+}
+
+// stayExpiry stops the lease from expiring, reporting false when it
+// already expired
+func (t *Tree) stayExpiry(ls *lease) bool {
+	t.leases.Lock()
+	defer t.leases.Unlock()
+	if t.leases.leases[ls.key] != ls {
+		return false
+	}
+	if ls.expiry != nil && !ls.expiry.Stop() {
+		return false
+	}
+	ls.expiry = nil
+	return true
+}
+
+// grantLease records a new lease held by sshConn and binds its reverse
+// paths, which outlive the connection
+func (t *Tree) grantLease(l *faeio.Whisperer, sshConn ssh.Conn, strand int, key, wished string, granted enchantments.MysticalPaths, mysticalPath *mysticalpath.MysticalPath, releases []func()) *lease {
+	ctx, cancel := context.WithCancel(context.Background())
+	ls := &lease{
+		Whisperer:    l.Fork("lease"),
+		key:          key,
+		wished:       wished,
+		granted:      granted,
+		mysticalPath: mysticalPath,
+		wither:       cancel,
+		releases:     releases,
+		holders:      map[int]ssh.Conn{},
+		vacated:      map[int]chan struct{}{},
+	}
+	ls.bind(sshConn, strand)
+	t.leases.Lock()
+	if t.leases.leases == nil {
+		t.leases.leases = map[string]*lease{}
+	}
+	t.leases.leases[key] = ls
+	t.leases.Unlock()
+	go func() {
+		err := mysticalPath.BindRemotes(ctx, granted.Reversed(true).Bowers(false).Grouped(false))
+		if err != nil {
+			ls.Infof("Reverse paths unbound: %s", err)
+		}
+		// the listeners are gone, so the lease is too
+		t.witherLease(ls)
+		ls.mu.Lock()
+		for _, holder := range ls.holders {
+			holder.Close()
+		}
+		ls.mu.Unlock()
+	}()
+	return ls
+}
+
+// hold returns the connection holding the strand of the lease, if any,
+// along with a channel closed once it vacates
+func (ls *lease) hold(strand int) (ssh.Conn, chan struct{}) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.holders[strand], ls.vacated[strand]
+}
+
+// held returns the number of connections holding the lease
+func (ls *lease) held() int {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return len(ls.holders)
+}
+
+// bind marks the strand of the lease as held by sshConn
+func (ls *lease) bind(sshConn ssh.Conn, strand int) {
+	ls.mu.Lock()
+	ls.holders[strand] = sshConn
+	ls.vacated[strand] = make(chan struct{})
+	ls.mu.Unlock()
+}
+
+// vacate releases the strand of the lease held by sshConn. Once every
+// strand vacated, the listeners are kept open for the grace period.
+func (t *Tree) vacate(ls *lease, sshConn ssh.Conn, strand int) {
+	ls.mu.Lock()
+	if ls.holders[strand] != sshConn {
+		ls.mu.Unlock()
+		return
+	}
+	delete(ls.holders, strand)
+	close(ls.vacated[strand])
+	delete(ls.vacated, strand)
+	remaining := len(ls.holders)
+	ls.mu.Unlock()
+	if remaining > 0 {
+		return
+	}
+	t.holdOpen(ls, t.config.ReverseLease)
+}
+
+// relinquish gives up a reclaimed lease whose leaf was turned away
+// before binding: held by no other strand, it expires when it would
+// have, had the leaf not returned
+func (t *Tree) relinquish(ls *lease) {
+	if ls.held() > 0 {
+		return
+	}
+	t.leases.Lock()
+	grace := t.config.ReverseLease
+	if !ls.expires.IsZero() {
+		grace = time.Until(ls.expires)
+	}
+	t.leases.Unlock()
+	t.holdOpen(ls, grace)
+}
+
+// holdOpen keeps the listeners of a lease no strand holds open for the
+// grace period, withering the lease without one
+func (t *Tree) holdOpen(ls *lease, grace time.Duration) {
+	if grace <= 0 {
+		t.witherLease(ls)
+		return
+	}
+	t.leases.Lock()
+	defer t.leases.Unlock()
+	if t.leases.leases[ls.key] != ls || ls.expiry != nil {
+		return
+	}
+	ls.Infof("Holding reverse portals for %s", grace.Round(time.Millisecond))
+	ls.expires = time.Now().Add(grace)
+	ls.expiry = time.AfterFunc(grace, func() {
+		ls.Infof("Lease expired")
+		t.witherLease(ls)
+	})
+}
+
+// witherLease closes the lease's listeners and hands back its portals
+func (t *Tree) witherLease(ls *lease) {
+	t.leases.Lock()
+	if t.leases.leases[ls.key] == ls {
+		delete(t.leases.leases, ls.key)
+	}
+	if ls.expiry != nil {
+		ls.expiry.Stop()
+		ls.expiry = nil
+	}
+	releases := ls.releases
+	ls.releases = nil
+	t.leases.Unlock()
+	ls.wither()
+	for _, release := range releases {
+		release()
+	}
+}
@@ -1,6 +1,7 @@
 package treekeeper
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"path/filepath"
 
 	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faenet"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -20,31 +22,44 @@ type FaerieTLS struct {
 	CA      string
 }
 
-func (t *Tree) listenForWhispers(glade, portal string) (net.Listener, error) {
+// listenForWhispers listens on glade:portal, or takes over the socket
+// systemd passed for the name (whisper or vhost)
+func (t *Tree) listenForWhispers(name, glade, portal string) (net.Listener, error) {
 	hasMagicalRealms := len(t.config.FaerieTLS.Domains) > 0
 	hasEnchantedRunes := t.config.FaerieTLS.Key != "" && t.config.FaerieTLS.Cert != ""
 	if hasMagicalRealms && hasEnchantedRunes {
 		return nil, errors.New("cannot use enchanted runes and magical realms simultaneously")
 	}
-	var faerieSpell *tls.Config
-	if hasMagicalRealms {
+	faerieSpell := t.faerieShield
+	if faerieSpell == nil && hasMagicalRealms {
 		faerieSpell = t.summonFaerieSpell(t.config.FaerieTLS.Domains)
 	}
 	magicalWarning := ""
-	if hasEnchantedRunes {
+	if faerieSpell == nil && hasEnchantedRunes {
 		c, err := t.castEnchantedRuneSpell(t.config.FaerieTLS.Key, t.config.FaerieTLS.Cert, t.config.FaerieTLS.CA)
 		if err != nil {
 			return nil, err
 		}
-		faerieSpell = c
-		if portal != "443" && hasMagicalRealms {
-			magicalWarning = " (CAUTION: The Faerie Queen will attempt to connect to your realm on portal 443)"
+		// the runes are looked up on every handshake, to be recast on reload
+		t.enchantedRunes.Store(c)
+		faerieSpell = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return t.enchantedRunes.Load(), nil
+			},
 		}
 	}
-	whisperListener, err := net.Listen("tcp", glade+":"+portal)
+	if portal != "443" && hasMagicalRealms {
+		magicalWarning = " (CAUTION: The Faerie Queen will attempt to connect to your realm on portal 443)"
+	}
+	t.faerieShield = faerieSpell
+	var whisperListener net.Listener
+	whisperListener, err := faenet.Listen(name, glade+":"+portal)
 	if err != nil {
 		return nil, err
 	}
+	if t.config.SNIPassthrough {
+		whisperListener = t.sniListener(whisperListener, false)
+	}
 	magicalProtocol := "forest-whisper"
 	if faerieSpell != nil {
 		magicalProtocol += "s"
@@ -63,7 +78,7 @@ func (t *Tree) summonFaerieSpell(magicalRealms []string) *tls.Config {
 			return true
 		},
 		Email:      enchantments.WhisperEnchantment("FAERIE_QUEEN_MESSAGE"),
-		HostPolicy: autocert.HostWhitelist(magicalRealms...),
+		HostPolicy: t.faerieQueenPolicy(autocert.HostWhitelist(magicalRealms...)),
 	}
 	enchantedCache := enchantments.WhisperEnchantment("FAERIE_CACHE")
 	if enchantedCache == "" {
@@ -82,6 +97,17 @@ func (t *Tree) summonFaerieSpell(magicalRealms []string) *tls.Config {
 	return faerieQueen.TLSConfig()
 }
 
+// faerieQueenPolicy extends the whitelist of magical realms with the
+// hosts of currently woven bowers
+func (t *Tree) faerieQueenPolicy(whitelist autocert.HostPolicy) autocert.HostPolicy {
+	return func(ctx context.Context, host string) error {
+		if t.findBower("http", host) != nil {
+			return nil
+		}
+		return whitelist(ctx, host)
+	}
+}
+
 func (t *Tree) castEnchantedRuneSpell(key, cert string, ca string) (*tls.Config, error) {
 	magicalRunes, err := tls.LoadX509KeyPair(cert, key)
 	if err != nil {
@@ -0,0 +1,75 @@
+package treekeeper
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+)
+
+// paceRoster holds the rates every leaf is paced to (--leaf-rate-up and
+// --leaf-rate-down) and the paces shared by all leaves of a user
+// (--user-rate-up and --user-rate-down). Up paces the fairy dust
+// arriving from the leaves, Down the dust sent to them.
+type paceRoster struct {
+	sync.Mutex
+	userUp, userDown int64
+	leafUp, leafDown int64
+	users            map[string]faeio.Paces
+}
+
+// summonPaces deciphers the rates of the tree's config
+func (t *Tree) summonPaces() error {
+	rates := []struct {
+		rate   string
+		flag   string
+		target *int64
+	}{
+		{t.config.UserRateUp, "user-rate-up", &t.paces.userUp},
+		{t.config.UserRateDown, "user-rate-down", &t.paces.userDown},
+		{t.config.LeafRateUp, "leaf-rate-up", &t.paces.leafUp},
+		{t.config.LeafRateDown, "leaf-rate-down", &t.paces.leafDown},
+	}
+	for _, r := range rates {
+		if r.rate == "" {
+			continue
+		}
+		rate, err := enchantments.DecipherRate(r.rate)
+		if err != nil {
+			return fmt.Errorf("--%s: %s", r.flag, err)
+		}
+		*r.target = rate
+	}
+	return nil
+}
+
+// leafPaces returns the paces of a new leaf of the user, along with
+// a func retiring the leaf's own paces once it departs
+func (t *Tree) leafPaces(user string, id int32) (faeio.Paces, func()) {
+	t.paces.Lock()
+	defer t.paces.Unlock()
+	shared, ok := t.paces.users[user]
+	if !ok {
+		name := "user:" + user
+		shared = faeio.Paces{
+			Up:   []*faeio.Pace{faeio.NewPace(name+" up", t.paces.userUp)},
+			Down: []*faeio.Pace{faeio.NewPace(name+" down", t.paces.userDown)},
+		}
+		if t.paces.users == nil {
+			t.paces.users = map[string]faeio.Paces{}
+		}
+		t.paces.users[user] = shared
+	}
+	name := fmt.Sprintf("leaf#%d", id)
+	up := faeio.NewPace(name+" up", t.paces.leafUp)
+	down := faeio.NewPace(name+" down", t.paces.leafDown)
+	paces := faeio.Paces{
+		Up:   append([]*faeio.Pace{up}, shared.Up...),
+		Down: append([]*faeio.Pace{down}, shared.Down...),
+	}
+	return paces, func() {
+		up.Retire()
+		down.Retire()
+	}
+}
@@ -0,0 +1,97 @@
+package treekeeper
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+)
+
+// portalPool hands out portals to reverse paths which ask the tree
+// to pick one (R:0). Without a configured range the realm picks any
+// free portal.
+type portalPool struct {
+	sync.Mutex
+	first, last int
+	claimed     map[int]bool
+}
+
+func summonPortalPool(span string) (*portalPool, error) {
+	pool := &portalPool{claimed: map[int]bool{}}
+	if span == "" {
+		return pool, nil
+	}
+	head, tail, _ := strings.Cut(span, "-")
+	first, err1 := strconv.Atoi(head)
+	last, err2 := strconv.Atoi(tail)
+	if tail == "" {
+		last, err2 = first, nil
+	}
+	if err1 != nil || err2 != nil || first <= 0 || last < first || last > 65535 {
+		return nil, fmt.Errorf("Invalid reverse portal pool '%s' (expected <first>-<last>)", span)
+	}
+	pool.first, pool.last = first, last
+	return pool, nil
+}
+
+// claim picks a free portal for the path, rewriting its local portal.
+// The returned release hands the portal back to the pool.
+func (pp *portalPool) claim(path *enchantments.MysticalPath) (func(), error) {
+	pp.Lock()
+	defer pp.Unlock()
+	if pp.first == 0 {
+		portal, err := pickRealmPortal(path)
+		if err != nil {
+			return nil, err
+		}
+		return pp.hold(path, portal), nil
+	}
+	size := pp.last - pp.first + 1
+	start := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		portal := pp.first + (start+i)%size
+		if pp.claimed[portal] {
+			continue
+		}
+		candidate := *path
+		candidate.LocalPortal = strconv.Itoa(portal)
+		if candidate.CanWhisper() {
+			return pp.hold(path, portal), nil
+		}
+	}
+	return nil, errors.New("no free portal left in the reverse portal pool")
+}
+
+func (pp *portalPool) hold(path *enchantments.MysticalPath, portal int) func() {
+	pp.claimed[portal] = true
+	path.LocalPortal = strconv.Itoa(portal)
+	return func() {
+		pp.Lock()
+		delete(pp.claimed, portal)
+		pp.Unlock()
+	}
+}
+
+// pickRealmPortal lets the realm choose a free portal on the path's glade
+func pickRealmPortal(path *enchantments.MysticalPath) (int, error) {
+	glade := net.JoinHostPort(strings.Trim(path.LocalGlade, "[]"), "0")
+	if path.LocalSpell == "udp" {
+		c, err := net.ListenPacket("udp", glade)
+		if err != nil {
+			return 0, err
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	l, err := net.Listen("tcp", glade)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
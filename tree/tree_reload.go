@@ -0,0 +1,153 @@
+package treekeeper
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Reload applies the configuration anew without dropping any leaf: the
+// authfile, --auth and the users are read again, the TLS runes recast
+// and the backend replaced, while the --reverse and --socks5 policy
+// applies to leaves connecting from then on. Settings which take a
+// restart (see Handoff) are left as they were. Nothing changes when
+// anything fails.
+func (t *Tree) Reload(c *EnchantedConfig) error {
+	t.reloadMut.Lock()
+	defer t.reloadMut.Unlock()
+	was := t.reloaded
+	if !c.ReverseSpell && (t.config.BowerDomain != "" || t.config.SNIListen != "" || t.config.SNIPassthrough) {
+		return t.Errorf("Bowers require reverse enchantments (--reverse)")
+	}
+	mirror, err := t.summonMirrorPortal(c.MysticalPortal)
+	if err != nil {
+		return err
+	}
+	var runes *tls.Config
+	if t.enchantedRunes.Load() != nil && c.FaerieTLS.Key != "" && c.FaerieTLS.Cert != "" {
+		if runes, err = t.castEnchantedRuneSpell(c.FaerieTLS.Key, c.FaerieTLS.Cert, c.FaerieTLS.CA); err != nil {
+			return err
+		}
+	}
+	faeChanges, err := t.faeIndex.Reinterpret(c.FaeRegistry)
+	if err != nil {
+		return err
+	}
+
+	changes := []string{}
+	changed := func(format string, args ...any) {
+		changes = append(changes, fmt.Sprintf(format, args...))
+	}
+	if c.FaeRegistry != was.FaeRegistry {
+		changed("authfile %q → %q (%s)", was.FaeRegistry, c.FaeRegistry, faeChanges)
+	} else if !faeChanges.None() {
+		changed("authfile %s", faeChanges)
+	}
+	if keptChanges := t.faeIndex.KeepFae(steadfastFae(c)...); !keptChanges.None() {
+		changed("auth and users %s", keptChanges)
+	}
+	if runes != nil {
+		before := t.enchantedRunes.Swap(runes)
+		if runesEssence(before) != runesEssence(runes) {
+			changed("tls runes recast (%s)", runesEssence(runes))
+		}
+		if c.FaerieTLS.CA != was.FaerieTLS.CA {
+			changed("tls-ca %q → %q", was.FaerieTLS.CA, c.FaerieTLS.CA)
+		}
+		t.reloaded.FaerieTLS = c.FaerieTLS
+	}
+	t.mirrorPortal.Store(mirror)
+	if c.MysticalPortal != was.MysticalPortal {
+		changed("backend %q → %q", redactURL(was.MysticalPortal), redactURL(c.MysticalPortal))
+	}
+	t.reverseSpell.Store(c.ReverseSpell)
+	if c.ReverseSpell != was.ReverseSpell {
+		changed("reverse %t → %t (for leaves connecting from now on)", was.ReverseSpell, c.ReverseSpell)
+	}
+	t.faerieSocks.Store(c.FaerieSocks)
+	if c.FaerieSocks != was.FaerieSocks {
+		changed("socks5 %t → %t (for leaves connecting from now on)", was.FaerieSocks, c.FaerieSocks)
+	}
+	for _, r := range restartEnchantments {
+		if fmt.Sprint(r.of(c)) != fmt.Sprint(r.of(t.config)) {
+			t.Warnf("Reload left --%s as it was, which takes a restart (SIGUSR1)", r.flag)
+		}
+	}
+	t.reloaded.FaeRegistry = c.FaeRegistry
+	t.reloaded.MysticalPortal = c.MysticalPortal
+	t.reloaded.ReverseSpell, t.reloaded.FaerieSocks = c.ReverseSpell, c.FaerieSocks
+
+	if len(changes) == 0 {
+		t.Infof("Reloaded, nothing changed")
+		return nil
+	}
+	t.Infof("Reloaded, %d changes", len(changes))
+	for _, change := range changes {
+		t.Infof("  %s", change)
+	}
+	return nil
+}
+
+// restartEnchantments are the settings a reload cannot change, by
+// their flags
+var restartEnchantments = []struct {
+	flag string
+	of   func(c *EnchantedConfig) any
+}{
+	{"key", func(c *EnchantedConfig) any { return c.AncientSeed }},
+	{"keyfile", func(c *EnchantedConfig) any { return c.RuneScroll }},
+	{"keepalive", func(c *EnchantedConfig) any { return c.MagicalPulse }},
+	{"tls-domain", func(c *EnchantedConfig) any { return c.FaerieTLS.Domains }},
+	{"tls-key", func(c *EnchantedConfig) any { return c.FaerieTLS.Key != "" }},
+	{"tls-cert", func(c *EnchantedConfig) any { return c.FaerieTLS.Cert != "" }},
+	{"vhost-domain", func(c *EnchantedConfig) any { return c.BowerDomain }},
+	{"vhost-listen", func(c *EnchantedConfig) any { return c.BowerListen }},
+	{"sni-listen", func(c *EnchantedConfig) any { return c.SNIListen }},
+	{"sni-passthrough", func(c *EnchantedConfig) any { return c.SNIPassthrough }},
+	{"reverse-pool", func(c *EnchantedConfig) any { return c.ReversePool }},
+	{"reverse-lease", func(c *EnchantedConfig) any { return c.ReverseLease }},
+	{"metrics", func(c *EnchantedConfig) any { return c.Metrics }},
+	{"admin", func(c *EnchantedConfig) any { return c.Admin }},
+	{"user-rate-up", func(c *EnchantedConfig) any { return c.UserRateUp }},
+	{"user-rate-down", func(c *EnchantedConfig) any { return c.UserRateDown }},
+	{"leaf-rate-up", func(c *EnchantedConfig) any { return c.LeafRateUp }},
+	{"leaf-rate-down", func(c *EnchantedConfig) any { return c.LeafRateDown }},
+	{"user-max-channels", func(c *EnchantedConfig) any { return c.UserMaxChannels }},
+	{"leaf-max-channels", func(c *EnchantedConfig) any { return c.LeafMaxChannels }},
+	{"user-channel-rate", func(c *EnchantedConfig) any { return c.UserChannelRate }},
+	{"leaf-channel-rate", func(c *EnchantedConfig) any { return c.LeafChannelRate }},
+	{"usage-ledger", func(c *EnchantedConfig) any { return c.UsageLedger }},
+	{"user-quota-daily", func(c *EnchantedConfig) any { return c.UserQuotaDaily }},
+	{"user-quota-monthly", func(c *EnchantedConfig) any { return c.UserQuotaMonthly }},
+	{"access-log", func(c *EnchantedConfig) any { return c.AccessLog }},
+	{"access-log-size", func(c *EnchantedConfig) any { return c.AccessLogSize }},
+	{"access-log-keep", func(c *EnchantedConfig) any { return c.AccessLogKeep }},
+	{"drain-timeout", func(c *EnchantedConfig) any { return c.DrainTimeout }},
+}
+
+// runesEssence describes the certificate of the runes by its
+// fingerprint and expiry
+func runesEssence(c *tls.Config) string {
+	if c == nil || len(c.Certificates) == 0 || len(c.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	cert := c.Certificates[0]
+	sum := sha256.Sum256(cert.Certificate[0])
+	essence := "sha256 " + hex.EncodeToString(sum[:8])
+	if cert.Leaf != nil {
+		essence += ", expires " + cert.Leaf.NotAfter.UTC().Format(time.RFC3339)
+	}
+	return essence
+}
+
+// redactURL hides the password of a URL
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
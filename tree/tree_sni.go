@@ -0,0 +1,170 @@
+package treekeeper
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"github.com/jpillora/sizestr"
+	"golang.org/x/crypto/ssh"
+)
+
+// sniListener peeks at the TLS ClientHello of every accepted connection
+// and hands connections naming an sni bower to its leaf, untouched and
+// still encrypted. Other connections are returned from Accept with the
+// peeked bytes replayed, or sealed when the listener is dedicated to sni.
+type sniListener struct {
+	net.Listener
+	t         *Tree
+	dedicated bool
+	conns     chan net.Conn
+	failed    chan struct{}
+	failure   error
+	closeOnce sync.Once
+}
+
+func (t *Tree) sniListener(inner net.Listener, dedicated bool) *sniListener {
+	l := &sniListener{
+		Listener:  inner,
+		t:         t,
+		dedicated: dedicated,
+		conns:     make(chan net.Conn),
+		failed:    make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.failure = err
+			close(l.failed)
+			return
+		}
+		go l.sort(c)
+	}
+}
+
+func (l *sniListener) sort(c net.Conn) {
+	name, replay := peekServerName(c)
+	if b := l.t.findSNIBower(name); b != nil {
+		if l.t.draining.Load() {
+			l.t.Debugf("Refused sni bower '%s' while draining (%s)", name, c.RemoteAddr())
+			c.Close()
+			return
+		}
+		b.passthrough(replay)
+		return
+	}
+	if l.dedicated {
+		l.t.Debugf("No sni bower woven for '%s' (%s)", name, c.RemoteAddr())
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- replay:
+	case <-l.failed:
+		c.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.failed:
+		return nil, l.failure
+	}
+}
+
+func (l *sniListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+var errHelloPeeked = errors.New("client hello peeked")
+
+// peekServerName reads the ClientHello from c without answering it and
+// returns the requested server name (if any) along with a connection
+// which replays everything read so far
+func peekServerName(c net.Conn) (string, net.Conn) {
+	peeked := &bytes.Buffer{}
+	serverName := ""
+	c.SetReadDeadline(time.Now().Add(enchantments.WhisperTimespell("SNI_PEEK_TIMEOUT", 10*time.Second)))
+	tls.Server(helloReader{io.TeeReader(c, peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	c.SetReadDeadline(time.Time{})
+	return serverName, &replayConn{Conn: c, r: io.MultiReader(peeked, c)}
+}
+
+// helloReader is a read-only net.Conn used to parse a ClientHello
+type helloReader struct {
+	r io.Reader
+}
+
+func (h helloReader) Read(p []byte) (int, error)         { return h.r.Read(p) }
+func (h helloReader) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (h helloReader) Close() error                       { return nil }
+func (h helloReader) LocalAddr() net.Addr                { return nil }
+func (h helloReader) RemoteAddr() net.Addr               { return nil }
+func (h helloReader) SetDeadline(t time.Time) error      { return nil }
+func (h helloReader) SetReadDeadline(t time.Time) error  { return nil }
+func (h helloReader) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayConn replays peeked bytes before reading from the connection
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (rc *replayConn) Read(p []byte) (int, error) {
+	return rc.r.Read(p)
+}
+
+// findSNIBower returns the sni bower woven for the given server name, if any
+func (t *Tree) findSNIBower(serverName string) *bower {
+	if serverName == "" {
+		return nil
+	}
+	return t.findBower("sni", serverName)
+}
+
+// passthrough pipes a still encrypted connection to the bower's leaf
+func (b *bower) passthrough(c net.Conn) {
+	b.open.Add(1)
+	defer b.open.Add(-1)
+	defer c.Close()
+	if err := b.meter.Barred(); err != nil {
+		b.Warnf("Refused %s: %s", c.RemoteAddr(), err)
+		return
+	}
+	leave, err := faeio.JoinThrongs(b.throngs)
+	if err != nil {
+		b.Warnf("Refused %s: %s", c.RemoteAddr(), err)
+		return
+	}
+	defer leave()
+	channel, whispers, err := b.sshConn.OpenChannel("engrave", []byte(b.path.RemoteEnchantment()))
+	if err != nil {
+		b.Debugf("Failed to reach the leaf: %s", err)
+		return
+	}
+	go ssh.DiscardRequests(whispers)
+	sent, received := faeio.MagicalStream(c, faeio.MeterStream(faeio.PaceStream(channel, b.paces.Up, b.paces.Down), b.meter))
+	b.Debugf("%s passed through (sent %s received %s)", c.RemoteAddr(), sizestr.ToString(sent), sizestr.ToString(received))
+}
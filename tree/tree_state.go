@@ -0,0 +1,185 @@
+package treekeeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/mysticalpath"
+)
+
+// TreeState is a snapshot of the tree's tunnels: its leaves, the
+// leases outliving them and its groves. It is dumped on SIGUSR2 and
+// served at /forest-state on the admin listener.
+type TreeState struct {
+	Time   time.Time    `json:"time"`
+	Leaves []LeafState  `json:"leaves"`
+	Leases []LeaseState `json:"leases,omitempty"`
+	Groves []GroveState `json:"groves,omitempty"`
+}
+
+// LeafState describes a connected leaf. The mystical path of a leased
+// leaf belongs to its lease, and is described there.
+type LeafState struct {
+	ID          int32                   `json:"id"`
+	User        string                  `json:"user,omitempty"`
+	Remote      string                  `json:"remote"`
+	LeafSession string                  `json:"leaf_session,omitempty"`
+	Version     string                  `json:"version"`
+	Strand      int                     `json:"strand,omitempty"`
+	Since       time.Time               `json:"since"`
+	Lease       string                  `json:"lease,omitempty"`
+	Path        *mysticalpath.PathState `json:"path,omitempty"`
+}
+
+// LeaseState describes a lease and the reverse listeners it holds
+type LeaseState struct {
+	Key      string                 `json:"key"`
+	Paths    string                 `json:"paths"`
+	Holders  int                    `json:"holders"`
+	Expiring bool                   `json:"expiring"`
+	Path     mysticalpath.PathState `json:"path"`
+}
+
+// GroveState describes the grove of a group
+type GroveState struct {
+	Name string `json:"name"`
+	mysticalpath.GroveState
+}
+
+// leafRoster holds the leaves connected to the tree
+type leafRoster struct {
+	sync.Mutex
+	leaves map[int32]*leafPresence
+}
+
+type leafPresence struct {
+	LeafState
+	mysticalPath *mysticalpath.MysticalPath
+}
+
+// attend puts the leaf on the roster, returning a func taking it off
+func (t *Tree) attend(p *leafPresence) func() {
+	t.leaves.Lock()
+	defer t.leaves.Unlock()
+	if t.leaves.leaves == nil {
+		t.leaves.leaves = map[int32]*leafPresence{}
+	}
+	t.leaves.leaves[p.ID] = p
+	return func() {
+		t.leaves.Lock()
+		defer t.leaves.Unlock()
+		delete(t.leaves.leaves, p.ID)
+	}
+}
+
+// State returns a snapshot of the tree's tunnels
+func (t *Tree) State() TreeState {
+	state := TreeState{Time: time.Now().UTC(), Leaves: []LeafState{}}
+	t.leaves.Lock()
+	presences := make([]*leafPresence, 0, len(t.leaves.leaves))
+	for _, p := range t.leaves.leaves {
+		presences = append(presences, p)
+	}
+	t.leaves.Unlock()
+	sort.Slice(presences, func(i, j int) bool {
+		return presences[i].ID < presences[j].ID
+	})
+	for _, p := range presences {
+		leaf := p.LeafState
+		if leaf.Lease == "" {
+			path := p.mysticalPath.State()
+			leaf.Path = &path
+		}
+		state.Leaves = append(state.Leaves, leaf)
+	}
+	t.leases.Lock()
+	leases := make([]*lease, 0, len(t.leases.leases))
+	expiring := map[*lease]bool{}
+	for _, ls := range t.leases.leases {
+		leases = append(leases, ls)
+		expiring[ls] = ls.expiry != nil
+	}
+	t.leases.Unlock()
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].key < leases[j].key
+	})
+	for _, ls := range leases {
+		state.Leases = append(state.Leases, LeaseState{
+			Key:      ls.key,
+			Paths:    wishedPaths(ls.granted),
+			Holders:  ls.held(),
+			Expiring: expiring[ls],
+			Path:     ls.mysticalPath.State(),
+		})
+	}
+	t.groves.Lock()
+	groves := make(map[string]*grove, len(t.groves.groves))
+	names := make([]string, 0, len(t.groves.groves))
+	for name, g := range t.groves.groves {
+		groves[name] = g
+		names = append(names, name)
+	}
+	t.groves.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		state.Groves = append(state.Groves, GroveState{Name: name, GroveState: groves[name].State()})
+	}
+	return state
+}
+
+// Describe writes the state for people to read
+func (s TreeState) Describe(w io.Writer) {
+	fmt.Fprintf(w, "Ancient tree state at %s: %d leaves, %d leases, %d groves\n",
+		s.Time.Format(time.RFC3339), len(s.Leaves), len(s.Leases), len(s.Groves))
+	for _, l := range s.Leaves {
+		session := ""
+		if l.LeafSession != "" {
+			session = " session " + l.LeafSession
+		}
+		if l.Strand > 0 {
+			session += fmt.Sprintf(" strand #%d", l.Strand)
+		}
+		user := ""
+		if l.User != "" {
+			user = " " + l.User
+		}
+		fmt.Fprintf(w, "leaf#%d%s from %s%s (version %s), up %s\n",
+			l.ID, user, l.Remote, session, l.Version, time.Since(l.Since).Round(time.Second))
+		if l.Lease != "" {
+			fmt.Fprintf(w, "  holds lease %s\n", l.Lease)
+		}
+		if l.Path != nil {
+			l.Path.Describe(w, "  ")
+		}
+	}
+	for _, ls := range s.Leases {
+		expiring := ""
+		if ls.Expiring {
+			expiring = ", expiring"
+		}
+		fmt.Fprintf(w, "lease %s for %s, %d holders%s\n", ls.Key, ls.Paths, ls.Holders, expiring)
+		ls.Path.Describe(w, "  ")
+	}
+	for _, g := range s.Groves {
+		fmt.Fprintf(w, "grove %s (%s), %d members\n", g.Name, g.Balance, len(g.Members))
+		g.GroveState.Describe(w, "  ")
+	}
+}
+
+// revealState serves the state of the tree at /forest-state, for
+// people to read with ?format=text
+func (t *Tree) revealState(w http.ResponseWriter, r *http.Request) {
+	state := t.State()
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		state.Describe(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,66 @@
+package treekeeper
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+)
+
+// throngRoster holds the bounds on the channels of every leaf
+// (--leaf-max-channels and --leaf-channel-rate) and the throngs shared
+// by all leaves of a user (--user-max-channels and --user-channel-rate)
+type throngRoster struct {
+	sync.Mutex
+	userMax, leafMax int
+	userCount        int
+	userPer          time.Duration
+	leafCount        int
+	leafPer          time.Duration
+	users            map[string]*faeio.Throng
+}
+
+// summonThrongs deciphers the channel cadences of the tree's config
+func (t *Tree) summonThrongs() error {
+	t.throngs.userMax = t.config.UserMaxChannels
+	t.throngs.leafMax = t.config.LeafMaxChannels
+	cadences := []struct {
+		cadence string
+		flag    string
+		count   *int
+		per     *time.Duration
+	}{
+		{t.config.UserChannelRate, "user-channel-rate", &t.throngs.userCount, &t.throngs.userPer},
+		{t.config.LeafChannelRate, "leaf-channel-rate", &t.throngs.leafCount, &t.throngs.leafPer},
+	}
+	for _, c := range cadences {
+		if c.cadence == "" {
+			continue
+		}
+		count, per, err := enchantments.DecipherCadence(c.cadence)
+		if err != nil {
+			return fmt.Errorf("--%s: %s", c.flag, err)
+		}
+		*c.count, *c.per = count, per
+	}
+	return nil
+}
+
+// leafThrongs returns the throngs of a new leaf of the user, along
+// with a func retiring the leaf's own throng once it departs
+func (t *Tree) leafThrongs(user string, id int32) ([]*faeio.Throng, func()) {
+	t.throngs.Lock()
+	defer t.throngs.Unlock()
+	shared, ok := t.throngs.users[user]
+	if !ok {
+		shared = faeio.NewThrong("user:"+user, t.throngs.userMax, t.throngs.userCount, t.throngs.userPer)
+		if t.throngs.users == nil {
+			t.throngs.users = map[string]*faeio.Throng{}
+		}
+		t.throngs.users[user] = shared
+	}
+	own := faeio.NewThrong(fmt.Sprintf("leaf#%d", id), t.throngs.leafMax, t.throngs.leafCount, t.throngs.leafPer)
+	return []*faeio.Throng{own, shared}, own.Retire
+}
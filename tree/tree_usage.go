@@ -0,0 +1,402 @@
+package treekeeper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faeio"
+	"golang.org/x/crypto/ssh"
+)
+
+// The usage ledger (--usage-ledger) tallies the fairy dust, channels and
+// connected time of every user and leaf by day and month (in UTC), kept
+// in a JSON scroll which survives restarts. Users over their daily or
+// monthly quota (--user-quota-daily, --user-quota-monthly) have new
+// channels refused until the day or month turns.
+
+const (
+	// usageTallyInterval is how often the meters are drained into the ledger
+	usageTallyInterval = 5 * time.Second
+	// usageInscribeInterval is how often the ledger is written out
+	usageInscribeInterval = 30 * time.Second
+	// usageKeepDays is how long daily tallies and departed leaves are kept
+	usageKeepDays = 62
+)
+
+// UsageTally is the usage of a user or leaf over a span of time. Up is
+// the fairy dust arriving from the leaves, Down the dust sent to them.
+type UsageTally struct {
+	Up               int64   `json:"up"`
+	Down             int64   `json:"down"`
+	Channels         int64   `json:"channels"`
+	ChannelMinutes   float64 `json:"channel_minutes"`
+	ConnectedMinutes float64 `json:"connected_minutes"`
+}
+
+func (u *UsageTally) add(r faeio.MeterReading) {
+	u.Up += r.Up
+	u.Down += r.Down
+	u.Channels += r.Channels
+	u.ChannelMinutes += r.ChannelTime.Minutes()
+	u.ConnectedMinutes += r.LinkTime.Minutes()
+}
+
+// UsageRecord holds the usage of a user or leaf by day (2006-01-02)
+// and month (2006-01)
+type UsageRecord struct {
+	Total    UsageTally             `json:"total"`
+	Days     map[string]*UsageTally `json:"days"`
+	Months   map[string]*UsageTally `json:"months"`
+	LastSeen time.Time              `json:"last_seen"`
+}
+
+// Day returns the usage of the day of t
+func (r *UsageRecord) Day(t time.Time) UsageTally {
+	if u, ok := r.Days[t.UTC().Format("2006-01-02")]; ok {
+		return *u
+	}
+	return UsageTally{}
+}
+
+// Month returns the usage of the month of t
+func (r *UsageRecord) Month(t time.Time) UsageTally {
+	if u, ok := r.Months[t.UTC().Format("2006-01")]; ok {
+		return *u
+	}
+	return UsageTally{}
+}
+
+func (r *UsageRecord) add(now time.Time, reading faeio.MeterReading) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if r.Days == nil {
+		r.Days = map[string]*UsageTally{}
+	}
+	if r.Months == nil {
+		r.Months = map[string]*UsageTally{}
+	}
+	if r.Days[day] == nil {
+		r.Days[day] = &UsageTally{}
+	}
+	if r.Months[month] == nil {
+		r.Months[month] = &UsageTally{}
+	}
+	r.Total.add(reading)
+	r.Days[day].add(reading)
+	r.Months[month].add(reading)
+	r.LastSeen = now
+}
+
+// UsageScroll is the usage ledger as inscribed on disk. Leaves are
+// keyed by user and leaf session (user/session).
+type UsageScroll struct {
+	Users  map[string]*UsageRecord `json:"users"`
+	Leaves map[string]*UsageRecord `json:"leaves"`
+}
+
+// ReadUsageScroll reads the usage ledger inscribed at path
+func ReadUsageScroll(path string) (*UsageScroll, error) {
+	scroll := &UsageScroll{}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, scroll); err != nil {
+		return nil, fmt.Errorf("Invalid usage ledger %s: %s", path, err)
+	}
+	if scroll.Users == nil {
+		scroll.Users = map[string]*UsageRecord{}
+	}
+	if scroll.Leaves == nil {
+		scroll.Leaves = map[string]*UsageRecord{}
+	}
+	return scroll, nil
+}
+
+type usageLedger struct {
+	*faeio.Whisperer
+	sync.Mutex
+	path           string
+	daily, monthly int64
+	quotas         [2]string
+	scroll         *UsageScroll
+	meters         map[*faeio.Meter]usageBearer
+	over           map[string]string
+	dirty          bool
+}
+
+// usageBearer is who a meter's usage is charged to
+type usageBearer struct {
+	user, leaf string
+}
+
+// summonUsage opens the usage ledger of the tree's config
+func (t *Tree) summonUsage() error {
+	c := t.config
+	if c.UsageLedger == "" {
+		if c.UserQuotaDaily != "" || c.UserQuotaMonthly != "" {
+			return errors.New("user quotas require a usage ledger (--usage-ledger)")
+		}
+		return nil
+	}
+	u := &usageLedger{
+		Whisperer: t.Fork("usage"),
+		path:      c.UsageLedger,
+		meters:    map[*faeio.Meter]usageBearer{},
+		over:      map[string]string{},
+	}
+	quotas := []struct {
+		quota  string
+		flag   string
+		target *int64
+	}{
+		{c.UserQuotaDaily, "user-quota-daily", &u.daily},
+		{c.UserQuotaMonthly, "user-quota-monthly", &u.monthly},
+	}
+	u.quotas = [2]string{c.UserQuotaDaily, c.UserQuotaMonthly}
+	for _, q := range quotas {
+		if q.quota == "" {
+			continue
+		}
+		size, err := enchantments.DecipherSize(q.quota)
+		if err != nil {
+			return fmt.Errorf("--%s: %s", q.flag, err)
+		}
+		*q.target = size
+	}
+	scroll, err := ReadUsageScroll(u.path)
+	if errors.Is(err, os.ErrNotExist) {
+		scroll, err = &UsageScroll{Users: map[string]*UsageRecord{}, Leaves: map[string]*UsageRecord{}}, nil
+	}
+	if err != nil {
+		return err
+	}
+	u.scroll = scroll
+	t.usage = u
+	return nil
+}
+
+// meter returns the meter of a new leaf of the user, along with a func
+// settling its last tally once the leaf departs
+func (u *usageLedger) meter(user, leaf string) (*faeio.Meter, func()) {
+	if u == nil {
+		return nil, func() {}
+	}
+	m := faeio.NewMeter()
+	u.Lock()
+	defer u.Unlock()
+	u.meters[m] = usageBearer{user: user, leaf: leaf}
+	m.Bar(u.over[user])
+	return m, func() {
+		u.Lock()
+		defer u.Unlock()
+		u.charge(m, time.Now().UTC())
+		delete(u.meters, m)
+	}
+}
+
+// keep tallies the meters and inscribes the ledger until ctx is done
+func (u *usageLedger) keep(ctx context.Context) {
+	if u == nil {
+		return
+	}
+	tally := time.NewTicker(usageTallyInterval)
+	defer tally.Stop()
+	inscribed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tally.C:
+		}
+		u.tally()
+		if time.Since(inscribed) >= usageInscribeInterval {
+			if err := u.inscribe(); err != nil {
+				u.Cryf("Failed to inscribe the usage ledger: %s", err)
+			}
+			inscribed = time.Now()
+		}
+	}
+}
+
+// tally drains every meter into the ledger and bars the users over quota
+func (u *usageLedger) tally() {
+	u.Lock()
+	defer u.Unlock()
+	now := time.Now().UTC()
+	for m := range u.meters {
+		u.charge(m, now)
+	}
+	for user, record := range u.scroll.Users {
+		reason := u.overQuota(user, record, now)
+		if reason == u.over[user] {
+			continue
+		}
+		if reason != "" {
+			u.Warnf("Refusing new channels: %s", reason)
+			u.over[user] = reason
+		} else {
+			u.Infof("User %s is within its quotas again", user)
+			delete(u.over, user)
+		}
+		for m, bearer := range u.meters {
+			if bearer.user == user {
+				m.Bar(reason)
+			}
+		}
+	}
+}
+
+// charge drains the meter into the records of its user and leaf
+func (u *usageLedger) charge(m *faeio.Meter, now time.Time) {
+	reading := m.Drain()
+	if reading == (faeio.MeterReading{}) {
+		return
+	}
+	bearer := u.meters[m]
+	for _, r := range []struct {
+		records map[string]*UsageRecord
+		key     string
+	}{
+		{u.scroll.Users, bearer.user},
+		{u.scroll.Leaves, bearer.leaf},
+	} {
+		if r.records[r.key] == nil {
+			r.records[r.key] = &UsageRecord{}
+		}
+		r.records[r.key].add(now, reading)
+	}
+	u.dirty = true
+}
+
+// overQuota returns why the user is over quota, or an empty string
+func (u *usageLedger) overQuota(user string, record *UsageRecord, now time.Time) string {
+	if day := record.Day(now); u.daily > 0 && day.Up+day.Down >= u.daily {
+		return fmt.Sprintf("user %s is over its daily quota of %s", user, u.quotas[0])
+	}
+	if month := record.Month(now); u.monthly > 0 && month.Up+month.Down >= u.monthly {
+		return fmt.Sprintf("user %s is over its monthly quota of %s", user, u.quotas[1])
+	}
+	return ""
+}
+
+// inscribe writes the ledger out, replacing the previous scroll at once
+// so a crash never leaves half of it behind
+func (u *usageLedger) inscribe() error {
+	if u == nil {
+		return nil
+	}
+	u.Lock()
+	defer u.Unlock()
+	if !u.dirty {
+		return nil
+	}
+	u.prune(time.Now().UTC())
+	b, err := json.MarshalIndent(u.scroll, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), filepath.Base(u.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), u.path); err != nil {
+		return err
+	}
+	u.dirty = false
+	return nil
+}
+
+// prune forgets the daily tallies and departed leaves past keeping
+func (u *usageLedger) prune(now time.Time) {
+	horizon := now.AddDate(0, 0, -usageKeepDays)
+	for _, records := range []map[string]*UsageRecord{u.scroll.Users, u.scroll.Leaves} {
+		for _, r := range records {
+			for day := range r.Days {
+				if d, err := time.Parse("2006-01-02", day); err == nil && d.Before(horizon) {
+					delete(r.Days, day)
+				}
+			}
+		}
+	}
+	for key, r := range u.scroll.Leaves {
+		if r.LastSeen.Before(horizon) {
+			delete(u.scroll.Leaves, key)
+		}
+	}
+}
+
+// settle tallies the meters one last time and inscribes the ledger
+func (u *usageLedger) settle() error {
+	if u == nil {
+		return nil
+	}
+	u.tally()
+	return u.inscribe()
+}
+
+// reveal returns the ledger as JSON for the usage API, only the
+// records of the given user (and their leaves) when not empty
+func (u *usageLedger) reveal(user string) ([]byte, error) {
+	u.Lock()
+	defer u.Unlock()
+	if user == "" {
+		return json.Marshal(u.scroll)
+	}
+	scroll := UsageScroll{Users: map[string]*UsageRecord{}, Leaves: map[string]*UsageRecord{}}
+	if r, ok := u.scroll.Users[user]; ok {
+		scroll.Users[user] = r
+	}
+	for key, r := range u.scroll.Leaves {
+		if strings.HasPrefix(key, user+"/") {
+			scroll.Leaves[key] = r
+		}
+	}
+	return json.Marshal(scroll)
+}
+
+// usageBearers returns the user and the leaf the usage of a leaf is
+// charged to
+func usageBearers(sshConn ssh.Conn, c *enchantments.EnchantedConfig, id int32) (string, string) {
+	user := sshConn.User()
+	if user == "" {
+		user = "anonymous"
+	}
+	session := c.LeafSession
+	if session == "" {
+		session = fmt.Sprintf("leaf#%d", id)
+	}
+	return user, user + "/" + session
+}
+
+// revealUsage serves the usage ledger at /forest-usage, only the
+// records of ?user= when given
+func (t *Tree) revealUsage(w http.ResponseWriter, r *http.Request) {
+	b, err := t.usage.reveal(r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
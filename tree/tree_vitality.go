@@ -0,0 +1,31 @@
+package treekeeper
+
+import (
+	"fmt"
+	"time"
+)
+
+// Vitality reports the tree's status for systemd (see faeOS.TendWatchdog).
+// The tree is alive while some connected leaf answered a keepalive pulse
+// within the window, or twice the keepalive interval if longer, or while
+// no leaf is connected or keepalive is off.
+func (t *Tree) Vitality(window time.Duration) (status string, alive bool) {
+	paths := t.mysticalPaths()
+	bound, open := 0, t.openChannels()
+	var heard time.Time
+	for _, mp := range paths {
+		n, h := mp.Pulse()
+		bound += n
+		if h.After(heard) {
+			heard = h
+		}
+	}
+	status = fmt.Sprintf("%d leaves connected, %d channels open", bound, open)
+	if t.draining.Load() {
+		status += ", draining"
+	}
+	if bound == 0 || t.config.MagicalPulse <= 0 {
+		return status, true
+	}
+	return status, time.Since(heard) < max(window, 2*t.config.MagicalPulse)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Er0sSec/Engrave/forestlore/enchantments"
+	"github.com/Er0sSec/Engrave/forestlore/faecrypto"
+	treekeeper "github.com/Er0sSec/Engrave/tree"
+	"gopkg.in/yaml.v3"
+)
+
+// treeScroll is the tree's configuration file (--config), in YAML. Each
+// setting stands for an enchantment, which takes precedence over it, as
+// does the environment (see treeScroll.whisperEnvironment).
+type treeScroll struct {
+	Listen struct {
+		Host           string `yaml:"host,omitempty"`
+		Port           string `yaml:"port,omitempty"`
+		Vhost          string `yaml:"vhost,omitempty"`
+		SNI            string `yaml:"sni,omitempty"`
+		SNIPassthrough bool   `yaml:"sni-passthrough,omitempty"`
+	} `yaml:"listen,omitempty"`
+	TLS struct {
+		Key     string   `yaml:"key,omitempty"`
+		Cert    string   `yaml:"cert,omitempty"`
+		Domains []string `yaml:"domains,omitempty"`
+		CA      string   `yaml:"ca,omitempty"`
+	} `yaml:"tls,omitempty"`
+	Keys struct {
+		File string `yaml:"file,omitempty"`
+		Seed string `yaml:"seed,omitempty"`
+	} `yaml:"keys,omitempty"`
+	Auth struct {
+		File  string                    `yaml:"file,omitempty"`
+		User  string                    `yaml:"user,omitempty"`
+		Users map[string]treeScrollUser `yaml:"users,omitempty"`
+	} `yaml:"auth,omitempty"`
+	Backend      string        `yaml:"backend,omitempty"`
+	Reverse      bool          `yaml:"reverse,omitempty"`
+	Socks5       bool          `yaml:"socks5,omitempty"`
+	Keepalive    time.Duration `yaml:"keepalive,omitempty"`
+	VhostDomain  string        `yaml:"vhost-domain,omitempty"`
+	ReversePool  string        `yaml:"reverse-pool,omitempty"`
+	ReverseLease time.Duration `yaml:"reverse-lease,omitempty"`
+	Limits       struct {
+		UserRateUp       string `yaml:"user-rate-up,omitempty"`
+		UserRateDown     string `yaml:"user-rate-down,omitempty"`
+		LeafRateUp       string `yaml:"leaf-rate-up,omitempty"`
+		LeafRateDown     string `yaml:"leaf-rate-down,omitempty"`
+		UserMaxChannels  int    `yaml:"user-max-channels,omitempty"`
+		LeafMaxChannels  int    `yaml:"leaf-max-channels,omitempty"`
+		UserChannelRate  string `yaml:"user-channel-rate,omitempty"`
+		LeafChannelRate  string `yaml:"leaf-channel-rate,omitempty"`
+		UserQuotaDaily   string `yaml:"user-quota-daily,omitempty"`
+		UserQuotaMonthly string `yaml:"user-quota-monthly,omitempty"`
+	} `yaml:"limits,omitempty"`
+	UsageLedger string `yaml:"usage-ledger,omitempty"`
+	AccessLog   struct {
+		Path string `yaml:"path,omitempty"`
+		Size string `yaml:"size,omitempty"`
+		Keep int    `yaml:"keep,omitempty"`
+	} `yaml:"access-log,omitempty"`
+	Logging struct {
+		Format  string `yaml:"format,omitempty"`
+		Level   string `yaml:"level,omitempty"`
+		Verbose bool   `yaml:"verbose,omitempty"`
+	} `yaml:"logging,omitempty"`
+	Metrics      bool          `yaml:"metrics,omitempty"`
+	Admin        string        `yaml:"admin,omitempty"`
+	DrainTimeout time.Duration `yaml:"drain-timeout,omitempty"`
+	PID          bool          `yaml:"pid,omitempty"`
+}
+
+// treeScrollUser is a user of the scroll, as in an authfile: allow
+// lists the patterns of the addresses it may reach ("*" for any)
+type treeScrollUser struct {
+	Password string   `yaml:"password"`
+	Allow    []string `yaml:"allow,omitempty"`
+}
+
+// summonTreeScroll returns the scroll of the defaults
+func summonTreeScroll() *treeScroll {
+	return &treeScroll{Keepalive: 25 * time.Second}
+}
+
+// read reads the scroll at path over the settings of s, refusing
+// settings it does not know of
+func (s *treeScroll) read(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	if err := d.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// whisperEnvironment takes the settings given by the environment,
+// which win over the scroll's and yield to the enchantments
+func (s *treeScroll) whisperEnvironment() {
+	whispers := []struct {
+		name   string
+		target *string
+	}{
+		{"HOST", &s.Listen.Host},
+		{"PORT", &s.Listen.Port},
+		{"AUTH", &s.Auth.User},
+		{"ENGRAVE_KEY_FILE", &s.Keys.File},
+		{"ENGRAVE_KEY", &s.Keys.Seed},
+	}
+	for _, w := range whispers {
+		if v := os.Getenv(w.name); v != "" {
+			*w.target = v
+		}
+	}
+}
+
+// enchantedConfig returns the tree's configuration as of the scroll
+func (s *treeScroll) enchantedConfig() (*treekeeper.EnchantedConfig, error) {
+	c := &treekeeper.EnchantedConfig{
+		AncientSeed:      s.Keys.Seed,
+		RuneScroll:       s.Keys.File,
+		FaeRegistry:      s.Auth.File,
+		FaeWhisper:       s.Auth.User,
+		MysticalPortal:   s.Backend,
+		FaerieSocks:      s.Socks5,
+		ReverseSpell:     s.Reverse,
+		MagicalPulse:     s.Keepalive,
+		BowerDomain:      s.VhostDomain,
+		BowerListen:      s.Listen.Vhost,
+		SNIListen:        s.Listen.SNI,
+		SNIPassthrough:   s.Listen.SNIPassthrough,
+		ReversePool:      s.ReversePool,
+		ReverseLease:     s.ReverseLease,
+		Metrics:          s.Metrics,
+		Admin:            s.Admin,
+		UserRateUp:       s.Limits.UserRateUp,
+		UserRateDown:     s.Limits.UserRateDown,
+		LeafRateUp:       s.Limits.LeafRateUp,
+		LeafRateDown:     s.Limits.LeafRateDown,
+		UserMaxChannels:  s.Limits.UserMaxChannels,
+		LeafMaxChannels:  s.Limits.LeafMaxChannels,
+		UserChannelRate:  s.Limits.UserChannelRate,
+		LeafChannelRate:  s.Limits.LeafChannelRate,
+		UsageLedger:      s.UsageLedger,
+		UserQuotaDaily:   s.Limits.UserQuotaDaily,
+		UserQuotaMonthly: s.Limits.UserQuotaMonthly,
+		AccessLog:        s.AccessLog.Path,
+		AccessLogSize:    s.AccessLog.Size,
+		AccessLogKeep:    s.AccessLog.Keep,
+		DrainTimeout:     s.DrainTimeout,
+	}
+	c.FaerieTLS = treekeeper.FaerieTLS{
+		Key:     s.TLS.Key,
+		Cert:    s.TLS.Cert,
+		Domains: s.TLS.Domains,
+		CA:      s.TLS.CA,
+	}
+	names := make([]string, 0, len(s.Auth.Users))
+	for name := range s.Auth.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("auth.users: invalid name '%s'", name)
+		}
+		fae := &enchantments.Fae{TrueName: name, SecretRune: s.Auth.Users[name].Password}
+		for _, glade := range s.Auth.Users[name].Allow {
+			if glade == "" || glade == "*" {
+				fae.EnchantedGlades = append(fae.EnchantedGlades, enchantments.FaeAllowAll)
+				continue
+			}
+			magicalPath, err := regexp.Compile(glade)
+			if err != nil {
+				return nil, fmt.Errorf("auth.users.%s.allow: %s", name, err)
+			}
+			fae.EnchantedGlades = append(fae.EnchantedGlades, magicalPath)
+		}
+		c.Fae = append(c.Fae, fae)
+	}
+	return c, nil
+}
+
+const redactedSecret = "<redacted>"
+
+// redacted returns a copy of the scroll with its secrets redacted: the
+// key seed, the passwords and an inline key
+func (s *treeScroll) redacted() *treeScroll {
+	r := *s
+	if r.Keys.Seed != "" {
+		r.Keys.Seed = redactedSecret
+	}
+	if faecrypto.IsEngraveRune([]byte(r.Keys.File)) {
+		r.Keys.File = redactedSecret
+	}
+	if name, _, ok := strings.Cut(r.Auth.User, ":"); ok {
+		r.Auth.User = name + ":" + redactedSecret
+	}
+	if u, err := url.Parse(r.Backend); err == nil {
+		r.Backend = u.Redacted()
+	}
+	if len(s.Auth.Users) > 0 {
+		r.Auth.Users = map[string]treeScrollUser{}
+		for name, u := range s.Auth.Users {
+			u.Password = redactedSecret
+			r.Auth.Users[name] = u
+		}
+	}
+	return &r
+}
+
+// inscribe writes the scroll as YAML
+func (s *treeScroll) inscribe(w io.Writer) error {
+	e := yaml.NewEncoder(w)
+	e.SetIndent(2)
+	if err := e.Encode(s); err != nil {
+		return err
+	}
+	return e.Close()
+}